@@ -1,13 +1,67 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
-	"html"
+	"html/template"
 	"strings"
+
+	"cloud.google.com/go/datastore"
 )
 
-func (address *Entity) snippet() string {
+// Postal address of its parent Person.
+type Address struct {
+	Key           *datastore.Key      `datastore:"__key__"`
+	AddressType   string              `datastore:"address_type,omitempty" form:"select"`
+	AddressLine1  string              `datastore:"address_line1,omitempty"`
+	AddressLine2  string              `datastore:"address_line2,omitempty"`
+	City          string              `datastore:"city,omitempty"`
+	StateProvince string              `datastore:"state_province,omitempty"`
+	PostalCode    string              `datastore:"postal_code,omitempty"`
+	Country       string              `datastore:"country,omitempty"`
+	Location      *datastore.GeoPoint `datastore:"location,omitempty" form:"hidden"`            // Of `Geocoded`, nil when not found.
+	Geocoded      string              `datastore:"geocoded,omitempty,noindex" form:"hidden"`    // The `mapsQuery` last geocoded.
+	GeocodedBy    string              `datastore:"geocoded_by,omitempty,noindex" form:"hidden"` // The `Geocoder.Name` of `Location`.
+	Common
+}
+
+func (address *Address) key() *datastore.Key {
+	return address.Key
+}
+
+func (address *Address) common() *Common {
+	return &address.Common
+}
+
+func (address *Address) LoadKey(key *datastore.Key) error {
+	address.Key = key
+	return nil
+}
+
+func (address *Address) Load(props []datastore.Property) error {
+	return loadModelProperties(address, props)
+}
+
+func (address *Address) Save() ([]datastore.Property, error) {
+	return saveModelProperties(address)
+}
+
+func (address *Address) words() []string {
+	words := modelWords(address)
+	if address.Location != nil {
+		words = append(words, GEOHASH_WORD+geohash(address.Location.Lat, address.Location.Lng, GEOHASH_PRECISION))
+	}
+	return words
+}
+
+func (address *Address) view() (template.HTML, error) {
+	return render("Address", address)
+}
+
+func (address *Address) fix() {
+	// After other fixes, lastly.
+	address.Words = address.words()
+}
+
+func (address *Address) snippet() string {
 	s := strings.Join([]string{
 		address.AddressLine1,
 		address.AddressLine2,
@@ -19,34 +73,35 @@ func (address *Entity) snippet() string {
 	return strings.ReplaceAll(s, "/  /", "/")
 }
 
-func addressView(address *Entity) string {
-	var buffer bytes.Buffer
-
-	qlocation := strings.ReplaceAll(address.snippet(), " / ", " ")
-	mapsURL := "https://maps.google.com/?q=" + qlocation
-
-	buffer.WriteString(fmt.Sprintf(`
-		<div class="%s">
-			<a href="%s" class="edit-link">Edit</a>
-
-			<span class="thing %s">%s</span>
-			<a href="%s" target="_blank">[Google Maps]</a></a>
-			<span class="tag" target="_blank">(%s) [%s]</span><br>
-
-			<div class="comments">%s</div>
-		</div>
-	`,
-		address.enabledClass(),
-		address.editURL(),
-
-		address.Key.Kind,
-		html.EscapeString(address.snippet()),
-		mapsURL,
-		address.AddressType,
-		address.enabledText(),
+// Query for the address on Google Maps.
+func (address *Address) mapsQuery() string {
+	return strings.ReplaceAll(address.snippet(), " / ", " ")
+}
 
-		html.EscapeString(address.Comments),
-	))
+// Returns the four postal lines used by mail merge and labels: street lines,
+// the locality line formatted per country, and the country.
+func (address *Address) mailingLines() []string {
+	// United States
+	line3 := address.City + ", " + address.StateProvince + " " + address.PostalCode
+	switch address.Country {
+	case "The Netherlands":
+		line3 = address.PostalCode + "  " + address.City
+		if address.StateProvince != "" {
+			line3 = line3 + ", " + address.StateProvince
+		}
+	case "Portugal":
+		line3 = address.PostalCode + "  " + address.City
+		if address.StateProvince != "" {
+			line3 = line3 + ", " + address.StateProvince
+		}
+	case "Canada":
+		line3 = address.City + " " + address.StateProvince + "  " + address.PostalCode
+	}
 
-	return buffer.String()
+	return []string{
+		address.AddressLine1,
+		address.AddressLine2,
+		strings.TrimSpace(line3),
+		address.Country,
+	}
 }
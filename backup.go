@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/appengine/v2/taskqueue"
+)
+
+// Entities per restore chunk, each processed by one task.
+const BACKUP_CHUNK_SIZE = 500
+
+// A backup is newline-delimited JSON: one `backupEntity` per line for every
+// entity of every kind in `backupKinds`, parents before children, followed by one
+// `backupSummary` line with the SHA-256 of all the entity lines.
+type backupEntity struct {
+	Key        string              `json:"key,omitempty"`
+	Path       []backupPathElement `json:"path,omitempty"`
+	Properties []backupProperty    `json:"properties,omitempty"`
+}
+
+type backupPathElement struct {
+	Kind string `json:"kind"`
+	ID   int64  `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type backupProperty struct {
+	Name    string      `json:"name"`
+	NoIndex bool        `json:"noindex,omitempty"`
+	Value   backupValue `json:"value"`
+}
+
+// Exactly one field is set, or none for a null value.
+type backupValue struct {
+	String *string             `json:"string,omitempty"`
+	Int    *int64              `json:"int,omitempty"`
+	Float  *float64            `json:"float,omitempty"`
+	Bool   *bool               `json:"bool,omitempty"`
+	Time   *time.Time          `json:"time,omitempty"`
+	Key    []backupPathElement `json:"key,omitempty"`
+	Blob   []byte              `json:"blob,omitempty"`
+	Geo    *datastore.GeoPoint `json:"geo,omitempty"`
+	Array  *[]backupValue      `json:"array,omitempty"`
+}
+
+type backupSummary struct {
+	Entities int            `json:"entities"`
+	Kinds    map[string]int `json:"kinds"`
+	SHA256   string         `json:"sha256"`
+}
+
+type backupLine struct {
+	backupEntity
+	Summary *backupSummary `json:"summary,omitempty"`
+}
+
+func keyPath(key *datastore.Key) []backupPathElement {
+	var path []backupPathElement
+	for ; key != nil; key = key.Parent {
+		path = append([]backupPathElement{{Kind: key.Kind, ID: key.ID, Name: key.Name}}, path...)
+	}
+	return path
+}
+
+func pathKey(path []backupPathElement) (*datastore.Key, error) {
+	var key *datastore.Key
+	for _, e := range path {
+		if e.Kind == "" || (e.ID == 0 && e.Name == "") {
+			return nil, fmt.Errorf("invalid key path element %+v", e)
+		}
+		if e.Name != "" {
+			key = datastore.NameKey(e.Kind, e.Name, key)
+		} else {
+			key = datastore.IDKey(e.Kind, e.ID, key)
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("empty key path")
+	}
+	return key, nil
+}
+
+func toBackupValue(v any) (backupValue, error) {
+	switch v := v.(type) {
+	case nil:
+		return backupValue{}, nil
+	case string:
+		return backupValue{String: &v}, nil
+	case int64:
+		return backupValue{Int: &v}, nil
+	case float64:
+		return backupValue{Float: &v}, nil
+	case bool:
+		return backupValue{Bool: &v}, nil
+	case time.Time:
+		return backupValue{Time: &v}, nil
+	case *datastore.Key:
+		return backupValue{Key: keyPath(v)}, nil
+	case []byte:
+		return backupValue{Blob: v}, nil
+	case datastore.GeoPoint:
+		return backupValue{Geo: &v}, nil
+	case []any:
+		array := make([]backupValue, len(v))
+		for i, e := range v {
+			var err error
+			array[i], err = toBackupValue(e)
+			if err != nil {
+				return backupValue{}, err
+			}
+		}
+		return backupValue{Array: &array}, nil
+	}
+	return backupValue{}, fmt.Errorf("unsupported property type %T", v)
+}
+
+// Converts back to a property value, mapping keys with `mapKey`.
+func (b backupValue) value(mapKey func(key *datastore.Key) (*datastore.Key, error)) (any, error) {
+	switch {
+	case b.String != nil:
+		return *b.String, nil
+	case b.Int != nil:
+		return *b.Int, nil
+	case b.Float != nil:
+		return *b.Float, nil
+	case b.Bool != nil:
+		return *b.Bool, nil
+	case b.Time != nil:
+		return *b.Time, nil
+	case b.Key != nil:
+		key, err := pathKey(b.Key)
+		if err != nil {
+			return nil, err
+		}
+		return mapKey(key)
+	case b.Blob != nil:
+		return b.Blob, nil
+	case b.Geo != nil:
+		return *b.Geo, nil
+	case b.Array != nil:
+		array := make([]any, len(*b.Array))
+		for i, e := range *b.Array {
+			var err error
+			array[i], err = e.value(mapKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, nil
+}
+
+func toBackupEntity(key *datastore.Key, props datastore.PropertyList) (*backupEntity, error) {
+	e := &backupEntity{Key: key.Encode(), Path: keyPath(key)}
+	for _, p := range props {
+		value, err := toBackupValue(p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert %v property %s: %v", key, p.Name, err)
+		}
+		e.Properties = append(e.Properties, backupProperty{Name: p.Name, NoIndex: p.NoIndex, Value: value})
+	}
+	return e, nil
+}
+
+func (e *backupEntity) propertyList(mapKey func(key *datastore.Key) (*datastore.Key, error)) (datastore.PropertyList, error) {
+	props := make(datastore.PropertyList, len(e.Properties))
+	for i, p := range e.Properties {
+		value, err := p.Value.value(mapKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert property %s: %v", p.Name, err)
+		}
+		props[i] = datastore.Property{Name: p.Name, NoIndex: p.NoIndex, Value: value}
+	}
+	return props, nil
+}
+
+// Kinds of a backup in the order a restore maps their keys: people, then the
+// households of people, then the children of both, then the root entities
+// referring to people, then the admin configuration and the campaigns with
+// their statuses. Tags need no kind of their own, they are only on people.
+var backupKinds = slices.Concat(kinds[:1], []string{"Household"}, kinds[1:], []string{"Relationship"},
+	[]string{"ChoiceList", "CustomField", "Campaign", "CampaignStatus"})
+
+// Writes the backup of every entity in `backupKinds`, ending with the summary line.
+func exportBackup(ctx context.Context, store Store, w io.Writer) (*backupSummary, error) {
+	summary := &backupSummary{Kinds: map[string]int{}}
+	hash := sha256.New()
+	out := io.MultiWriter(w, hash)
+
+	// Kinds are in hierarchy order, with `Person` first.
+	for _, kind := range backupKinds {
+		var entities []datastore.PropertyList
+		keys, err := store.GetAll(ctx, &storeQuery{Kind: kind}, &entities)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s entities: %v", kind, err)
+		}
+		for i, key := range keys {
+			e, err := toBackupEntity(key, entities[i])
+			if err != nil {
+				return nil, err
+			}
+			line, err := json.Marshal(e)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal %v: %v", key, err)
+			}
+			_, err = out.Write(append(line, '\n'))
+			if err != nil {
+				return nil, fmt.Errorf("failed to write backup: %v", err)
+			}
+			summary.Entities++
+			summary.Kinds[kind]++
+		}
+	}
+
+	summary.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	line, err := json.Marshal(&backupLine{Summary: summary})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal summary: %v", err)
+	}
+	_, err = w.Write(append(line, '\n'))
+	if err != nil {
+		return nil, fmt.Errorf("failed to write backup: %v", err)
+	}
+	return summary, nil
+}
+
+// Parses a backup, verifying the checksum of the summary line when present.
+func parseBackup(r io.Reader) ([]backupEntity, *backupSummary, error) {
+	var entities []backupEntity
+	var summary *backupSummary
+	hash := sha256.New()
+	counted := &backupSummary{Kinds: map[string]int{}}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if summary != nil {
+			return nil, nil, fmt.Errorf("line %d: entity after summary", n)
+		}
+
+		var b backupLine
+		err := json.Unmarshal(line, &b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if b.Summary != nil {
+			summary = b.Summary
+			continue
+		}
+
+		key, err := pathKey(b.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		hash.Write(line)
+		hash.Write([]byte{'\n'})
+		counted.Entities++
+		counted.Kinds[key.Kind]++
+		entities = append(entities, b.backupEntity)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read backup: %v", err)
+	}
+
+	counted.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	if summary != nil {
+		if summary.SHA256 != counted.SHA256 {
+			return nil, nil, fmt.Errorf("checksum mismatch: summary %s, computed %s", summary.SHA256, counted.SHA256)
+		}
+		if summary.Entities != counted.Entities {
+			return nil, nil, fmt.Errorf("entity count mismatch: summary %d, counted %d", summary.Entities, counted.Entities)
+		}
+	}
+	return entities, counted, nil
+}
+
+// A restore in progress, whose chunks are written by sequential tasks so that
+// parents are always restored before their children.
+type Restore struct {
+	Key        *datastore.Key `datastore:"__key__"`
+	Created    time.Time      `datastore:"created"`
+	Remap      bool           `datastore:"remap,noindex"` // Allocate new IDs instead of preserving them.
+	Chunks     int            `datastore:"chunks,noindex"`
+	ChunksDone int            `datastore:"chunks_done,noindex"`
+	Entities   int            `datastore:"entities,noindex"`
+	Written    int            `datastore:"written,noindex"`
+	Checksum   string         `datastore:"checksum,noindex"`
+	Error      string         `datastore:"error,noindex"`
+	Finished   time.Time      `datastore:"finished,noindex"`
+}
+
+// Up to `BACKUP_CHUNK_SIZE` backup lines of a restore, keyed by 1-based index.
+type RestoreChunk struct {
+	Lines string `datastore:"lines,noindex"`
+}
+
+// The new key of a remapped entity, keyed by the name of its encoded old key.
+type RestoreKeyMap struct {
+	New *datastore.Key `datastore:"new,noindex"`
+}
+
+func (restore *Restore) status() string {
+	switch {
+	case restore.Error != "":
+		return "failed: " + restore.Error
+	case !restore.Finished.IsZero():
+		return "done " + restore.Finished.Format("2006-01-02 15:04")
+	default:
+		return fmt.Sprintf("%d/%d chunks", restore.ChunksDone, restore.Chunks)
+	}
+}
+
+func restoreChunkPath(restoreKey *datastore.Key, chunk int) (string, error) {
+	return url.JoinPath("/task/restore", restoreKey.Encode(), strconv.Itoa(chunk))
+}
+
+// Maps old keys to new ones for a remapping restore, remembering the mappings
+// in `RestoreKeyMap` entities written with the entities they map.
+type keyMapper struct {
+	restoreKey *datastore.Key
+	store      Store
+	mapped     map[string]*datastore.Key
+}
+
+func (m *keyMapper) mapKey(old *datastore.Key) *datastore.Key {
+	return datastore.NameKey("RestoreKeyMap", old.Encode(), m.restoreKey)
+}
+
+func (m *keyMapper) lookup(ctx context.Context, key *datastore.Key) (*datastore.Key, error) {
+	if key == nil {
+		return nil, nil
+	}
+	if mapped, ok := m.mapped[key.Encode()]; ok {
+		return mapped, nil
+	}
+
+	var km RestoreKeyMap
+	err := m.store.Get(ctx, m.mapKey(key), &km)
+	if err == datastore.ErrNoSuchEntity {
+		// Not in the backup, so keep references to it as they are.
+		km.New = key
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get key mapping for %v: %v", key, err)
+	}
+	m.mapped[key.Encode()] = km.New
+	return km.New, nil
+}
+
+// Writes the entity of the `old` key at `new`, together with its mapping,
+// unless a retried task already did. Returns the key the entity has.
+func (m *keyMapper) put(ctx context.Context, old *datastore.Key, new *datastore.Key, props *datastore.PropertyList) (*datastore.Key, error) {
+	var written *datastore.Key
+	err := m.store.RunInTransaction(ctx, func(tx Transaction) error {
+		var km RestoreKeyMap
+		err := tx.Get(m.mapKey(old), &km)
+		if err == nil {
+			written = km.New
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		err = tx.Put(new, props)
+		if err != nil {
+			return err
+		}
+		written = new
+		return tx.Put(m.mapKey(old), &RestoreKeyMap{New: new})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to put %v as %v: %v", old, new, err)
+	}
+	m.mapped[old.Encode()] = written
+	return written, nil
+}
+
+// Reports the first entity that can't be converted back, which no retry fixes.
+func checkBackupEntities(entities []backupEntity) error {
+	for _, e := range entities {
+		key, err := pathKey(e.Path)
+		if err != nil {
+			return err
+		}
+		_, err = e.propertyList(func(key *datastore.Key) (*datastore.Key, error) { return key, nil })
+		if err != nil {
+			return fmt.Errorf("failed to convert %v: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Writes the entities, or with `dryRun` only reports what the restore would do.
+// Remapped entities are written once, even when a failed chunk is retried.
+func restoreEntities(ctx context.Context, store Store, restore *Restore, entities []backupEntity, dryRun bool) (string, error) {
+	var buffer bytes.Buffer
+
+	var mapper *keyMapper
+	if restore.Remap && !dryRun {
+		mapper = &keyMapper{restoreKey: restore.Key, store: store, mapped: map[string]*datastore.Key{}}
+	}
+	mapKey := func(key *datastore.Key) (*datastore.Key, error) {
+		if mapper == nil {
+			return key, nil
+		}
+		return mapper.lookup(ctx, key)
+	}
+
+	// Preserved IDs are never allocated to new entities.
+	if !restore.Remap && !dryRun {
+		var reserved []*datastore.Key
+		for _, e := range entities {
+			key, err := pathKey(e.Path)
+			if err != nil {
+				return "", err
+			}
+			if key.ID != 0 {
+				reserved = append(reserved, key)
+			}
+		}
+		if len(reserved) > 0 {
+			err := store.ReserveIDs(ctx, reserved)
+			if err != nil {
+				return "", fmt.Errorf("failed to reserve %d IDs: %v", len(reserved), err)
+			}
+		}
+	}
+
+	for _, e := range entities {
+		key, err := pathKey(e.Path)
+		if err != nil {
+			return "", err
+		}
+		props, err := e.propertyList(mapKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to convert %v: %v", key, err)
+		}
+
+		if dryRun && restore.Remap && key.Name == "" {
+			buffer.WriteString(fmt.Sprintf("create    %v with a new ID\n", key))
+			continue
+		}
+		if dryRun && restore.Remap {
+			buffer.WriteString(fmt.Sprintf("write     %v keeping its name\n", key))
+			continue
+		}
+		if dryRun {
+			var existing datastore.PropertyList
+			err = store.Get(ctx, key, &existing)
+			switch err {
+			case nil:
+				buffer.WriteString(fmt.Sprintf("overwrite %v\n", key))
+			case datastore.ErrNoSuchEntity:
+				buffer.WriteString(fmt.Sprintf("create    %v\n", key))
+			default:
+				return "", fmt.Errorf("failed to get %v: %v", key, err)
+			}
+			continue
+		}
+
+		newKey := key
+		if mapper != nil {
+			parent, err := mapper.lookup(ctx, key.Parent)
+			if err != nil {
+				return "", err
+			}
+			var target *datastore.Key
+			if key.Name != "" {
+				// Names are kept, except those of a remapped key, as of a
+				// `CampaignStatus`.
+				name := key.Name
+				if named, err := datastore.DecodeKey(name); err == nil {
+					mapped, err := mapper.lookup(ctx, named)
+					if err != nil {
+						return "", err
+					}
+					if !mapped.Equal(named) {
+						name = mapped.Encode()
+					}
+				}
+				target = datastore.NameKey(key.Kind, name, parent)
+			} else {
+				allocated, err := store.AllocateIDs(ctx, []*datastore.Key{datastore.IncompleteKey(key.Kind, parent)})
+				if err != nil {
+					return "", fmt.Errorf("failed to allocate a key for %v: %v", key, err)
+				}
+				target = allocated[0]
+			}
+			newKey, err = mapper.put(ctx, key, target, &props)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			newKey, err = store.Put(ctx, newKey, &props)
+			if err != nil {
+				return "", fmt.Errorf("failed to put %v: %v", key, err)
+			}
+		}
+		restore.Written++
+		buffer.WriteString(fmt.Sprintf("%v => %v\n", key, newKey))
+	}
+	return buffer.String(), nil
+}
+
+// Stores the backup in chunks and queues the task restoring the first one.
+func startRestore(ctx context.Context, store Store, entities []backupEntity, summary *backupSummary, remap bool) (*Restore, error) {
+	restore := &Restore{
+		Created:  time.Now(),
+		Remap:    remap,
+		Entities: summary.Entities,
+		Checksum: summary.SHA256,
+		Chunks:   (len(entities) + BACKUP_CHUNK_SIZE - 1) / BACKUP_CHUNK_SIZE,
+	}
+	key, err := store.Put(ctx, datastore.IncompleteKey("Restore", nil), restore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put restore: %v", err)
+	}
+	restore.Key = key
+
+	var keys []*datastore.Key
+	var chunks []RestoreChunk
+	for start := 0; start < len(entities); start += BACKUP_CHUNK_SIZE {
+		var lines bytes.Buffer
+		for _, e := range entities[start:min(start+BACKUP_CHUNK_SIZE, len(entities))] {
+			line, err := json.Marshal(&e)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal %s: %v", e.Key, err)
+			}
+			lines.Write(append(line, '\n'))
+		}
+		keys = append(keys, datastore.IDKey("RestoreChunk", int64(len(keys)+1), key))
+		chunks = append(chunks, RestoreChunk{Lines: lines.String()})
+	}
+	if len(keys) > 0 {
+		_, err = store.PutMulti(ctx, keys, chunks)
+		if err != nil {
+			return nil, fmt.Errorf("failed to put %d restore chunks: %v", len(keys), err)
+		}
+
+		path, err := restoreChunkPath(key, 1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to join path: %v", err)
+		}
+		resp, err := addTask(ctx, taskqueue.NewPOSTTask(path, nil))
+		if err != nil {
+			return nil, err
+		}
+		log.Print(resp)
+	}
+	return restore, nil
+}
+
+// Restores one chunk, then queues the next one.
+func taskRestoreHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	var buffer bytes.Buffer
+
+	restoreKey, err := datastore.DecodeKey(r.PathValue("restore"))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode restore key %q: %v", r.PathValue("restore"), err)
+	}
+	chunk, err := strconv.Atoi(r.PathValue("chunk"))
+	if err != nil {
+		return "", fmt.Errorf("invalid chunk %q: %v", r.PathValue("chunk"), err)
+	}
+
+	restore := &Restore{}
+	err = store.Get(ctx, restoreKey, restore)
+	if err != nil {
+		return "", fmt.Errorf("failed to get restore %v: %v", restoreKey, err)
+	}
+	if chunk <= restore.ChunksDone {
+		return fmt.Sprintf("Chunk %d already restored", chunk), nil
+	}
+
+	var rc RestoreChunk
+	err = store.Get(ctx, datastore.IDKey("RestoreChunk", int64(chunk), restoreKey), &rc)
+	if err != nil {
+		return "", fmt.Errorf("failed to get restore chunk %d: %v", chunk, err)
+	}
+	entities, _, err := parseBackup(strings.NewReader(rc.Lines))
+	if err == nil {
+		err = checkBackupEntities(entities)
+	}
+	if err != nil {
+		// Record the failure and stop, rather than retrying a broken backup.
+		restore.Error = fmt.Sprintf("chunk %d: %v", chunk, err)
+		restore.Finished = time.Now()
+		_, perr := store.Put(ctx, restoreKey, restore)
+		if perr != nil {
+			return "", fmt.Errorf("failed to put restore after %v: %v", err, perr)
+		}
+		return restore.Error, nil
+	}
+
+	// Failed writes are retried by the task queue.
+	resp, err := restoreEntities(ctx, store, restore, entities, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to restore chunk %d: %v", chunk, err)
+	}
+	buffer.WriteString(resp)
+
+	restore.ChunksDone = chunk
+	if chunk == restore.Chunks {
+		restore.Finished = time.Now()
+	}
+	_, err = store.Put(ctx, restoreKey, restore)
+	if err != nil {
+		return "", fmt.Errorf("failed to put restore: %v", err)
+	}
+
+	if chunk < restore.Chunks {
+		path, err := restoreChunkPath(restoreKey, chunk+1)
+		if err != nil {
+			return "", fmt.Errorf("failed to join path: %v", err)
+		}
+		resp, err := addTask(ctx, taskqueue.NewPOSTTask(path, nil))
+		if err != nil {
+			return "", err
+		}
+		buffer.WriteString(resp)
+	}
+	return buffer.String(), nil
+}
+
+type backupData struct {
+	Message  string
+	Summary  *backupSummary
+	DryRun   string
+	Restores []*Restore
+	CSRF     string
+}
+
+func backupHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	if !isAdmin(ctx) {
+		return "", httpError(http.StatusForbidden, "backups are for admins only")
+	}
+
+	data := &backupData{CSRF: csrfToken(ctx)}
+	if r.Method == "POST" {
+		file, _, err := r.FormFile("backup")
+		if err != nil {
+			return "", httpError(http.StatusBadRequest, "failed to read uploaded backup: %v", err)
+		}
+		defer file.Close()
+
+		entities, summary, err := parseBackup(file)
+		if err != nil {
+			return "", httpError(http.StatusBadRequest, "invalid backup: %v", err)
+		}
+		data.Summary = summary
+
+		if getValue(r, "dryrun") != "" {
+			data.Message = "Dry run, nothing was written"
+			restore := &Restore{Remap: getValue(r, "mode") == "remap"}
+			resp, err := restoreEntities(ctx, store, restore, entities, true)
+			if err != nil {
+				return "", err
+			}
+			data.DryRun = resp
+		} else {
+			restore, err := startRestore(ctx, store, entities, summary, getValue(r, "mode") == "remap")
+			if err != nil {
+				return "", err
+			}
+			data.Message = fmt.Sprintf("Restoring %d entities in %d chunks", restore.Entities, restore.Chunks)
+		}
+	}
+
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "Restore", Order: "-created", Limit: 10}, &data.Restores)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch restores: %v", err)
+	}
+
+	return renderPage(ctx, "backup", data)
+}
+
+func (a *app) handleExport() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !isAdmin(ctx) {
+			errorPage(w, r, httpError(http.StatusForbidden, "backups are for admins only"))
+			return
+		}
+
+		name := fmt.Sprintf("%s-%s.ndjson", projectID(), time.Now().Format("20060102-150405"))
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		summary, err := exportBackup(ctx, a.store, w)
+		if err != nil {
+			// Headers are already sent, so the truncated download lacks a summary line.
+			log.Printf("Failed to export backup: %v", err)
+			return
+		}
+		log.Printf("Exported %d entities, sha256 %s", summary.Entities, summary.SHA256)
+	})
+}
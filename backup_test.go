@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Fails the transaction numbered `failAt`, as Datastore might.
+type flakyStore struct {
+	*memoryStore
+	failAt       int
+	transactions int
+}
+
+func (s *flakyStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	s.transactions++
+	if s.transactions == s.failAt {
+		return errors.New("unavailable")
+	}
+	return s.memoryStore.RunInTransaction(ctx, f)
+}
+
+func restoreChunk(ctx context.Context, store Store, restoreKey *datastore.Key, chunk int) (string, error) {
+	r := httptest.NewRequest("POST", "/task/restore", nil)
+	r.SetPathValue("restore", restoreKey.Encode())
+	r.SetPathValue("chunk", strconv.Itoa(chunk))
+	return taskRestoreHandler(r, ctx, store)
+}
+
+func TestRestoreRemapRetry(t *testing.T) {
+	ctx := context.Background()
+	source := newMemoryStore()
+	personKey, err := saveModel(ctx, source, &Person{Key: datastore.IncompleteKey("Person", nil), LastName: "Doe", Common: Common{Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = saveModel(ctx, source, &Contact{Key: datastore.IncompleteKey("Contact", personKey), ContactType: "Email", ContactText: "jane@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	_, err = exportBackup(ctx, source, &backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entities, summary, err := parseBackup(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Contact fails to be written after its Person was.
+	store := &flakyStore{memoryStore: newMemoryStore(), failAt: 2}
+	restore, err := startRestore(ctx, store, entities, summary, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = restoreChunk(ctx, store, restore.Key, 1)
+	if err == nil {
+		t.Fatal("failed write reported as done, so the queue won't retry it")
+	}
+	err = store.Get(ctx, restore.Key, restore)
+	if err != nil || restore.Error != "" || restore.ChunksDone != 0 {
+		t.Fatalf("restore %+v, %v, want the chunk pending a retry", restore, err)
+	}
+
+	_, err = restoreChunk(ctx, store, restore.Key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var people []Person
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Person"}, &people)
+	if err != nil || len(people) != 1 {
+		t.Fatalf("restored %d people, %v, want 1 despite the retry", len(people), err)
+	}
+	if people[0].Key.Equal(personKey) {
+		t.Errorf("remapped person kept its key %v", personKey)
+	}
+	var contacts []Contact
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Contact"}, &contacts)
+	if err != nil || len(contacts) != 1 || !contacts[0].Key.Parent.Equal(people[0].Key) {
+		t.Errorf("restored contacts %+v, %v, want one below the new person", contacts, err)
+	}
+	err = store.Get(ctx, restore.Key, restore)
+	if err != nil || restore.Finished.IsZero() || restore.Written != 2 {
+		t.Errorf("restore %+v, %v, want finished with 2 written", restore, err)
+	}
+}
+
+func TestRestoreBadBackup(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	entities := []backupEntity{{
+		Path: keyPath(datastore.IDKey("Person", 1, nil)),
+		Properties: []backupProperty{
+			{Name: "spouse", Value: backupValue{Key: []backupPathElement{{Kind: "Person"}}}},
+		},
+	}}
+	restore, err := startRestore(ctx, store, entities, &backupSummary{Entities: 1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Recorded as failed, and done for the queue which would retry forever.
+	_, err = restoreChunk(ctx, store, restore.Key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Get(ctx, restore.Key, restore)
+	if err != nil || restore.Error == "" {
+		t.Errorf("restore %+v, %v, want the conversion error recorded", restore, err)
+	}
+	err = store.Get(ctx, datastore.IDKey("Person", 1, nil), &Person{})
+	if !errors.Is(err, datastore.ErrNoSuchEntity) {
+		t.Errorf("Get person = %v, want nothing written", err)
+	}
+}
+
+func TestBackupRelationships(t *testing.T) {
+	ctx := context.Background()
+	source := newMemoryStore()
+	var people []*datastore.Key
+	for _, name := range []string{"Jane", "John"} {
+		key, err := saveModel(ctx, source, &Person{Key: datastore.IncompleteKey("Person", nil), FirstName: name, Common: Common{Enabled: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, key)
+	}
+	_, err := source.Put(ctx, datastore.IncompleteKey("Relationship", nil), &Relationship{Person: people[0], Other: people[1], Type: "spouse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var backup bytes.Buffer
+	summary, err := exportBackup(ctx, source, &backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Kinds["Relationship"] != 1 {
+		t.Fatalf("backup of %v, want the relationship", summary.Kinds)
+	}
+	entities, summary, err := parseBackup(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := newMemoryStore()
+	restore, err := startRestore(ctx, store, entities, summary, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = restoreChunk(ctx, store, restore.Key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rels []Relationship
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Relationship"}, &rels)
+	if err != nil || len(rels) != 1 {
+		t.Fatalf("restored %d relationships, %v, want 1", len(rels), err)
+	}
+	jane, john := &Person{}, &Person{}
+	err = store.Get(ctx, rels[0].Person, jane)
+	if err == nil {
+		err = store.Get(ctx, rels[0].Other, john)
+	}
+	if err != nil || jane.FirstName != "Jane" || john.FirstName != "John" || rels[0].Person.Equal(people[0]) {
+		t.Errorf("restored relationship %+v, %v, want it between the remapped people", rels[0], err)
+	}
+}
+
+func TestBackupConfiguration(t *testing.T) {
+	ctx := context.Background()
+	source := newMemoryStore()
+	personKey, err := saveModel(ctx, source, &Person{Key: datastore.IncompleteKey("Person", nil), LastName: "Doe", Common: Common{Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = source.Put(ctx, datastore.NameKey("ChoiceList", "Category", nil), &ChoiceList{Values: []string{UNSPECIFIED_CHOICE, "Family"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = source.Put(ctx, datastore.IncompleteKey("CustomField", nil), &CustomField{Kind: "Person", Name: "Shirt", Type: "text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	campaignKey, err := source.Put(ctx, datastore.IncompleteKey("Campaign", nil), &Campaign{Name: "Holiday"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = markCampaign(ctx, source, campaignKey, []*datastore.Key{personKey}, "sent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var backup bytes.Buffer
+	_, err = exportBackup(ctx, source, &backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entities, summary, err := parseBackup(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"ChoiceList", "CustomField", "Campaign", "CampaignStatus"} {
+		if summary.Kinds[kind] != 1 {
+			t.Errorf("backup of %v, want one %s", summary.Kinds, kind)
+		}
+	}
+
+	// Preserved IDs aren't allocated again.
+	store := newMemoryStore()
+	restore, err := startRestore(ctx, store, entities, summary, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = restoreChunk(ctx, store, restore.Key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var maxID int64
+	for _, e := range entities {
+		key, err := pathKey(e.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		maxID = max(maxID, key.ID)
+	}
+	allocated, err := store.AllocateIDs(ctx, []*datastore.Key{datastore.IncompleteKey("Campaign", nil)})
+	if err != nil || allocated[0].ID <= maxID {
+		t.Errorf("allocated %v, %v, want an ID above the restored %d", allocated, err, maxID)
+	}
+
+	// Names are kept, but not the old Person key naming a status.
+	store = newMemoryStore()
+	restore, err = startRestore(ctx, store, entities, summary, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = restoreChunk(ctx, store, restore.Key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := &ChoiceList{}
+	err = store.Get(ctx, datastore.NameKey("ChoiceList", "Category", nil), list)
+	if err != nil || !slices.Equal(list.Values, []string{UNSPECIFIED_CHOICE, "Family"}) {
+		t.Errorf("restored choice list %+v, %v, want it under its name", list, err)
+	}
+	var campaigns []Campaign
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Campaign"}, &campaigns)
+	if err != nil || len(campaigns) != 1 {
+		t.Fatalf("restored %d campaigns, %v, want 1", len(campaigns), err)
+	}
+	var people []Person
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Person"}, &people)
+	if err != nil || len(people) != 1 {
+		t.Fatalf("restored %d people, %v, want 1", len(people), err)
+	}
+	status := &CampaignStatus{}
+	err = store.Get(ctx, campaignStatusKey(campaigns[0].Key, people[0].Key), status)
+	if err != nil || !status.Person.Equal(people[0].Key) || !status.has("sent") {
+		t.Errorf("restored status %+v, %v, want it keyed by the new person", status, err)
+	}
+}
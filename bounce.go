@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Number of bounces after which a Contact is disabled. Set to 0 to never disable.
+const BOUNCE_DISABLE_AFTER = "BOUNCE_DISABLE_AFTER"
+const DEFAULT_BOUNCE_DISABLE_AFTER = 3
+
+type bounceNotification struct {
+	Recipient string
+	Status    string // RFC 3464 status code, e.g. `5.1.1`, when the bounce has one.
+	Reason    string
+}
+
+// https://docs.cloud.google.com/appengine/docs/standard/services/mail/bounce?tab=go
+// The bounce is POSTed as form data with `original-*` and `notification-*`
+// fields describing the message we sent and the delivery status notification.
+func parseBounce(r *http.Request) (*bounceNotification, error) {
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		err = r.ParseMultipartForm(10 << 20)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bounce form: %v", err)
+	}
+
+	return parseBounceFields(r.Form)
+}
+
+func parseBounceFields(fields url.Values) (*bounceNotification, error) {
+	bounce := &bounceNotification{}
+
+	// Delivery status notification fields from RFC 3464, which may appear in
+	// either the notification text or the raw message.
+	dsn := dsnFields(fields.Get("notification-text") + "\n" + fields.Get("raw-message"))
+
+	if to := fields.Get("original-to"); to != "" {
+		addresses, err := mail.ParseAddressList(to)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse original recipient %q: %v", to, err)
+		}
+		bounce.Recipient = addresses[0].Address
+	} else if recipient := dsnValue(dsn["original-recipient"]); recipient != "" {
+		bounce.Recipient = recipient
+	} else if recipient := dsnValue(dsn["final-recipient"]); recipient != "" {
+		bounce.Recipient = recipient
+	} else {
+		// Plain text bounces, e.g. from Exim, name the address in a header.
+		recipient, _, _ = strings.Cut(dsn["x-failed-recipients"], ",")
+		bounce.Recipient = strings.TrimSpace(recipient)
+	}
+	if bounce.Recipient == "" {
+		return nil, fmt.Errorf("failed to find original recipient in bounce")
+	}
+
+	bounce.Status = dsn["status"]
+	switch {
+	case dsn["diagnostic-code"] != "":
+		bounce.Reason = dsnValue(dsn["diagnostic-code"])
+	case dsn["status"] != "":
+		bounce.Reason = "Status " + dsn["status"]
+	case fields.Get("notification-subject") != "":
+		bounce.Reason = fields.Get("notification-subject")
+	default:
+		bounce.Reason = "unknown"
+	}
+
+	return bounce, nil
+}
+
+// First value of each `Name: value` header line, keyed by lowercase name.
+// Folded continuation lines are joined onto the previous value.
+func dsnFields(text string) map[string]string {
+	fields := make(map[string]string)
+	last := ""
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if last != "" && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[last] += " " + strings.TrimSpace(line)
+			continue
+		}
+		last = ""
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.ContainsAny(name, " \t") {
+			continue
+		}
+		name = strings.ToLower(name)
+		if _, seen := fields[name]; !seen {
+			fields[name] = strings.TrimSpace(value)
+			last = name
+		}
+	}
+	return fields
+}
+
+// Strips the type prefix from values such as `rfc822; someone@example.com`.
+func dsnValue(value string) string {
+	if _, after, ok := strings.Cut(value, ";"); ok {
+		return strings.TrimSpace(after)
+	}
+	return strings.TrimSpace(value)
+}
+
+func bounceDisableAfter() int {
+	value := os.Getenv(BOUNCE_DISABLE_AFTER)
+	if value == "" {
+		return DEFAULT_BOUNCE_DISABLE_AFTER
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", BOUNCE_DISABLE_AFTER, value, err)
+		return DEFAULT_BOUNCE_DISABLE_AFTER
+	}
+	return n
+}
+
+// Contacts whose text matches the address, as typed or lowercased.
+func contactsForAddress(ctx context.Context, store Store, address string) ([]Contact, error) {
+	var contacts []Contact
+	seen := make(map[string]struct{})
+	for _, text := range []string{address, strings.ToLower(address)} {
+		query := &storeQuery{Kind: "Contact", Filters: map[string]any{"contact_text": text}}
+		var results []Contact
+		_, err := store.GetAll(ctx, query, &results)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch contacts for %q: %v", text, err)
+		}
+		for _, contact := range results {
+			if _, ok := seen[contact.Key.Encode()]; !ok {
+				seen[contact.Key.Encode()] = struct{}{}
+				contacts = append(contacts, contact)
+			}
+		}
+	}
+	return contacts, nil
+}
+
+func bounceHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	var buffer bytes.Buffer
+
+	bounce, err := parseBounce(r)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Bounced email to %q: %s", bounce.Recipient, bounce.Reason)
+	buffer.WriteString(fmt.Sprintf("Bounced email to %q: %s\n", bounce.Recipient, bounce.Reason))
+
+	contacts, err := contactsForAddress(ctx, store, bounce.Recipient)
+	if err != nil {
+		return "", err
+	}
+	if len(contacts) == 0 {
+		buffer.WriteString("No matching contact\n")
+		return buffer.String(), nil
+	}
+
+	disableAfter := bounceDisableAfter()
+	now := time.Now()
+	keys := make([]*datastore.Key, len(contacts))
+	for i := range contacts {
+		contact := &contacts[i]
+		keys[i] = contact.Key
+		contact.BounceCount++
+		contact.LastBounce = now
+		if contact.Enabled && disableAfter > 0 && contact.BounceCount >= disableAfter {
+			contact.Enabled = false
+			contact.Comments = strings.TrimSpace(contact.Comments + fmt.Sprintf("\n%s disabled after %d bounces: %s",
+				now.Format("2006-01-02"), contact.BounceCount, bounce.Reason))
+			buffer.WriteString(fmt.Sprintf("Disabled %v\n", contact.Key))
+		}
+		contact.fix()
+		buffer.WriteString(fmt.Sprintf("%v bounce count %d\n", contact.Key, contact.BounceCount))
+	}
+
+	_, err = store.PutMulti(ctx, keys, contacts)
+	if err != nil {
+		return "", fmt.Errorf("failed to put %d bounced contacts: %v", len(contacts), err)
+	}
+
+	return buffer.String(), nil
+}
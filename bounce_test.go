@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+// A `/_ah/bounce` POST of the captured bounce in `testdata/bounces`, with the
+// form fields App Engine derives from it.
+func bounceRequest(t *testing.T, name string) *http.Request {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join("testdata", "bounces", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", name, err)
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"original-from":        "pda@my-app-id.appspotmail.com",
+		"notification-from":    msg.Header.Get("From"),
+		"notification-subject": msg.Header.Get("Subject"),
+		"raw-message":          string(raw),
+	}
+	for name, value := range fields {
+		err = w.WriteField(name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/_ah/bounce", &body)
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	return r
+}
+
+func TestParseBounce(t *testing.T) {
+	tests := []struct {
+		file      string
+		recipient string
+		status    string
+		reason    string
+	}{
+		{"dsn.eml", "jane@example.com", "5.1.1", "550 5.1.1 <jane@example.com>: Recipient address rejected: User unknown in virtual mailbox table"},
+		{"plain.eml", "bob@example.org", "", "Mail delivery failed: returning message to sender"},
+		{"original-recipient.eml", "Ann.Lee@Example.net", "5.2.2", "mailbox full"},
+	}
+	for _, test := range tests {
+		bounce, err := parseBounce(bounceRequest(t, test.file))
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		if bounce.Recipient != test.recipient || bounce.Status != test.status || bounce.Reason != test.reason {
+			t.Errorf("%s: parsed %+v, want recipient %q, status %q, reason %q", test.file, bounce, test.recipient, test.status, test.reason)
+		}
+	}
+}
+
+func TestParseBounceOriginalTo(t *testing.T) {
+	bounce, err := parseBounceFields(map[string][]string{
+		"original-to":       {"Jane Doe <jane@example.com>"},
+		"notification-text": {"Final-Recipient: rfc822; other@example.com\nStatus: 5.0.0\n"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounce.Recipient != "jane@example.com" {
+		t.Errorf("recipient %q, want the original-to address", bounce.Recipient)
+	}
+}
+
+func TestBounceDisablesContact(t *testing.T) {
+	t.Setenv(BOUNCE_DISABLE_AFTER, "2")
+	ctx := context.Background()
+	store := newMemoryStore()
+	personKey, err := saveModel(ctx, store, &Person{Key: datastore.IncompleteKey("Person", nil), LastName: "Lee", Common: Common{Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stored lowercased, bounced as typed by the sender.
+	contactKey, err := saveModel(ctx, store, &Contact{
+		Key:         datastore.IncompleteKey("Contact", personKey),
+		ContactType: "Email",
+		ContactText: "ann.lee@example.net",
+		Common:      Common{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, wantEnabled := range []bool{true, false} {
+		resp, err := bounceHandler(bounceRequest(t, "original-recipient.eml"), ctx, store)
+		if err != nil {
+			t.Fatalf("bounce %d: %v", i+1, err)
+		}
+		contact := &Contact{}
+		err = store.Get(ctx, contactKey, contact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contact.BounceCount != i+1 || contact.LastBounce.IsZero() {
+			t.Errorf("bounce %d: count %d, last bounce %v", i+1, contact.BounceCount, contact.LastBounce)
+		}
+		if contact.Enabled != wantEnabled {
+			t.Errorf("bounce %d: enabled %v, want %v\n%s", i+1, contact.Enabled, wantEnabled, resp)
+		}
+	}
+
+	contact := &Contact{}
+	err = store.Get(ctx, contactKey, contact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(contact.Comments, "disabled after 2 bounces: mailbox full") {
+		t.Errorf("comments %q, want the reason it was disabled", contact.Comments)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// A read-only calendar of the enabled Calendar entries of enabled people, as
+// yearly all-day events.
+// https://datatracker.ietf.org/doc/html/rfc4791
+const DAV_CALENDAR = "/dav/calendar/"
+
+// Start year of events whose first occurrence has no year. A leap year, so
+// that February 29 stays valid.
+const UNKNOWN_YEAR = 2000
+
+const ICAL_DATE = "20060102"
+const ICAL_UTC = "20060102T150405Z"
+
+type event struct {
+	Calendar *Calendar
+	Person   *Person
+}
+
+func eventHref(key *datastore.Key) string {
+	return DAV_CALENDAR + key.Encode() + ".ics"
+}
+
+// First occurrence, with `UNKNOWN_YEAR` when the year isn't known.
+func (e *event) start() time.Time {
+	first := e.Calendar.FirstOccurrence
+	year := first.Year()
+	if year <= 1 {
+		year = UNKNOWN_YEAR
+	}
+	return time.Date(year, first.Month(), first.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Occurrence in `year`, on the last day of the month when the day doesn't
+// exist, as `BYMONTHDAY=-1` does for February 29.
+func (e *event) occurrence(year int) time.Time {
+	start := e.start()
+	t := time.Date(year, start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	if t.Month() != start.Month() {
+		t = time.Date(year, start.Month()+1, 0, 0, 0, 0, 0, time.UTC)
+	}
+	return t
+}
+
+// Whether any all-day occurrence overlaps [from, to). Zero times are unbounded.
+func (e *event) overlaps(from time.Time, to time.Time) bool {
+	start := e.start()
+	if from.Before(start) {
+		from = start
+	}
+	if to.IsZero() {
+		return true
+	}
+	for year := from.Year() - 1; year <= to.Year(); year++ {
+		day := e.occurrence(year)
+		if !day.Before(start) && day.Before(to) && day.AddDate(0, 0, 1).After(from) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *event) summary() string {
+	name := strings.TrimSpace(e.Person.displayName())
+	if e.Calendar.Occasion == "" {
+		return name
+	}
+	return name + " - " + e.Calendar.Occasion
+}
+
+// https://datatracker.ietf.org/doc/html/rfc5545
+func (e *event) ical() string {
+	start := e.start()
+	rrule := "FREQ=YEARLY"
+	if start.Month() == time.February && start.Day() == 29 {
+		rrule += ";BYMONTH=2;BYMONTHDAY=-1"
+	}
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//pda//CalDAV//EN",
+		"BEGIN:VEVENT",
+		"UID:" + e.Calendar.Key.Encode(),
+		// Nothing records when entities change, and the stamp must not change
+		// the ETag on every request.
+		"DTSTAMP:" + start.Format(ICAL_UTC),
+		"DTSTART;VALUE=DATE:" + start.Format(ICAL_DATE),
+		"DTEND;VALUE=DATE:" + start.AddDate(0, 0, 1).Format(ICAL_DATE),
+		"RRULE:" + rrule,
+		"SUMMARY:" + vcardEscape(e.summary()),
+	}
+	if e.Calendar.Comments != "" {
+		lines = append(lines, "DESCRIPTION:"+vcardEscape(e.Calendar.Comments))
+	}
+	lines = append(lines,
+		"URL:"+e.Person.viewURL(),
+		"TRANSP:TRANSPARENT",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	)
+	return foldLines(lines)
+}
+
+func (e *event) etag() string {
+	sum := sha1.Sum([]byte(e.ical()))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (e *event) served() bool {
+	return e.Calendar.Enabled && e.Person.Enabled && !e.Calendar.FirstOccurrence.IsZero()
+}
+
+// Events of the enabled Calendar entries of enabled people, in key order.
+func fetchEvents(ctx context.Context, store Store) ([]*event, error) {
+	enabled := map[string]any{"enabled": true}
+	var calendars []*Calendar
+	var people []*Person
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "Calendar", Filters: enabled}, &calendars)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch calendar entries: %v", err)
+	}
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Person", Filters: enabled}, &people)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch people: %v", err)
+	}
+
+	byKey := make(map[string]*Person, len(people))
+	for _, person := range people {
+		byKey[person.Key.Encode()] = person
+	}
+	var events []*event
+	for _, calendar := range calendars {
+		if calendar.Key.Parent == nil {
+			continue
+		}
+		e := &event{Calendar: calendar, Person: byKey[calendar.Key.Parent.Encode()]}
+		if e.Person != nil && e.served() {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func fetchEvent(ctx context.Context, store Store, href string) (*event, error) {
+	name, ok := strings.CutPrefix(href, DAV_CALENDAR)
+	if !ok || !strings.HasSuffix(name, ".ics") {
+		return nil, httpError(http.StatusNotFound, "no such event %q", href)
+	}
+	key, err := datastore.DecodeKey(strings.TrimSuffix(name, ".ics"))
+	if err != nil || key.Kind != "Calendar" || key.Parent == nil {
+		return nil, httpError(http.StatusNotFound, "no such event %q", href)
+	}
+
+	e := &event{Calendar: &Calendar{}, Person: &Person{}}
+	err = store.GetMulti(ctx, []*datastore.Key{key, key.Parent}, []model{e.Calendar, e.Person})
+	if err != nil {
+		return nil, httpError(http.StatusNotFound, "no such event %q: %v", href, err)
+	}
+	if !e.served() {
+		return nil, httpError(http.StatusNotFound, "no such event %q", href)
+	}
+	return e, nil
+}
+
+func eventResponse(e *event, withData bool) davResponse {
+	prop := davProp{GetETag: e.etag(), GetContentType: "text/calendar; charset=utf-8; component=VEVENT"}
+	if withData {
+		prop.CalendarData = e.ical()
+	}
+	return davResponse{
+		Href:     eventHref(e.Calendar.Key),
+		Propstat: []davPropstat{{Prop: prop, Status: davStatus(http.StatusOK)}},
+	}
+}
+
+// Members without their data, for PROPFIND and sync-collection.
+func eventResponses(events []*event) []davResponse {
+	responses := make([]davResponse, len(events))
+	for i, e := range events {
+		responses[i] = eventResponse(e, false)
+	}
+	return responses
+}
+
+// Zero for an empty time.
+func parseICalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(ICAL_UTC, value)
+	if err != nil {
+		return time.Time{}, httpError(http.StatusBadRequest, "invalid time %q: %v", value, err)
+	}
+	return t, nil
+}
+
+func caldav(ctx context.Context, store Store, w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "REPORT":
+		return caldavReport(ctx, store, w, r)
+	case http.MethodGet, http.MethodHead:
+		e, err := fetchEvent(ctx, store, r.URL.Path)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("ETag", e.etag())
+		_, _ = io.WriteString(w, e.ical())
+		return nil
+	}
+	return httpError(http.StatusForbidden, "the calendar is read-only, edit Calendar entries in PDA")
+}
+
+func caldavReport(ctx context.Context, store Store, w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Path != DAV_CALENDAR {
+		return httpError(http.StatusForbidden, "reports are only supported on %s", DAV_CALENDAR)
+	}
+	req, err := parseReport(r)
+	if err != nil {
+		return err
+	}
+
+	events, err := fetchEvents(ctx, store)
+	if err != nil {
+		return err
+	}
+	if req.XMLName.Local == "sync-collection" {
+		return syncCollection(w, req.SyncToken, eventResponses(events))
+	}
+	ms := &davMultistatus{}
+
+	switch req.XMLName.Local {
+	case "calendar-query":
+		// Only the VEVENT time range is supported, other filters match everything.
+		var from, to time.Time
+		if req.TimeRange != nil {
+			from, err = parseICalTime(req.TimeRange.Start)
+			if err != nil {
+				return err
+			}
+			to, err = parseICalTime(req.TimeRange.End)
+			if err != nil {
+				return err
+			}
+		}
+		for _, e := range events {
+			if e.overlaps(from, to) {
+				ms.Responses = append(ms.Responses, eventResponse(e, true))
+			}
+		}
+	case "calendar-multiget":
+		byHref := make(map[string]*event, len(events))
+		for _, e := range events {
+			byHref[eventHref(e.Calendar.Key)] = e
+		}
+		for _, href := range req.Hrefs {
+			if e := byHref[href]; e != nil {
+				ms.Responses = append(ms.Responses, eventResponse(e, true))
+			} else {
+				ms.Responses = append(ms.Responses, davResponse{Href: href, Status: davStatus(http.StatusNotFound)})
+			}
+		}
+	default:
+		return httpError(http.StatusForbidden, "unsupported report %q", req.XMLName.Local)
+	}
+	return writeMultistatus(w, ms)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func testEvent(year int, month time.Month, day int) *event {
+	return &event{
+		Calendar: &Calendar{Key: datastore.IDKey("Calendar", 2, datastore.IDKey("Person", 1, nil)), FirstOccurrence: time.Date(year, month, day, 0, 0, 0, 0, time.UTC), Common: Common{Enabled: true}},
+		Person:   &Person{Key: datastore.IDKey("Person", 1, nil), FirstName: "Jane", Common: Common{Enabled: true}},
+	}
+}
+
+func utcDate(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestEventOccurrence(t *testing.T) {
+	leap := testEvent(1996, time.February, 29)
+	if got := leap.occurrence(2023); !got.Equal(utcDate(2023, time.February, 28)) {
+		t.Errorf("Feb 29 occurrence in 2023 = %v, want Feb 28", got)
+	}
+	if got := leap.occurrence(2024); !got.Equal(utcDate(2024, time.February, 29)) {
+		t.Errorf("Feb 29 occurrence in 2024 = %v, want Feb 29", got)
+	}
+	if ical := leap.ical(); !strings.Contains(ical, "RRULE:FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=-1") {
+		t.Errorf("Feb 29 event lacks the last day of February rule:\n%s", ical)
+	}
+	unknown := testEvent(0, time.February, 29)
+	if got := unknown.start(); !got.Equal(utcDate(UNKNOWN_YEAR, time.February, 29)) {
+		t.Errorf("start without a year = %v, want Feb 29 of %d", got, UNKNOWN_YEAR)
+	}
+}
+
+func TestEventOverlaps(t *testing.T) {
+	tests := []struct {
+		name  string
+		event *event
+		from  time.Time
+		to    time.Time
+		want  bool
+	}{
+		{"Dec 31 across the new year", testEvent(1980, time.December, 31), utcDate(2023, time.December, 25), utcDate(2024, time.January, 5), true},
+		{"Jan 3 across the new year", testEvent(1980, time.January, 3), utcDate(2023, time.December, 25), utcDate(2024, time.January, 5), true},
+		{"Jan 10 after the range", testEvent(1980, time.January, 10), utcDate(2023, time.December, 25), utcDate(2024, time.January, 5), false},
+		{"Jan 1 at the exclusive end", testEvent(1980, time.January, 1), utcDate(2023, time.December, 31), utcDate(2024, time.January, 1), false},
+		{"Dec 31 by its last hour", testEvent(1980, time.December, 31), utcDate(2023, time.December, 31).Add(23 * time.Hour), utcDate(2024, time.January, 2), true},
+		{"Feb 29 on Feb 28 of a common year", testEvent(1996, time.February, 29), utcDate(2023, time.February, 28), utcDate(2023, time.March, 1), true},
+		{"Feb 29 not on Mar 1 of a common year", testEvent(1996, time.February, 29), utcDate(2023, time.March, 1), utcDate(2023, time.March, 2), false},
+		{"before the first occurrence", testEvent(2020, time.January, 3), utcDate(2018, time.January, 1), utcDate(2020, time.January, 1), false},
+		{"unbounded end", testEvent(1980, time.June, 1), utcDate(2023, time.July, 1), time.Time{}, true},
+	}
+	for _, test := range tests {
+		if got := test.event.overlaps(test.from, test.to); got != test.want {
+			t.Errorf("%s: overlaps [%v, %v) = %v, want %v", test.name, test.from, test.to, got, test.want)
+		}
+	}
+}
+
+func TestCalDAVQuery(t *testing.T) {
+	t.Setenv(CARDDAV_USERNAME, "pda")
+	t.Setenv(CARDDAV_PASSWORD, "secret")
+	ctx := context.Background()
+	store := newMemoryStore()
+	handler := davAuth((&app{store: store}).dav())
+
+	hrefs := map[string]string{}
+	for _, birthday := range []time.Time{
+		utcDate(1980, time.December, 31),
+		utcDate(1980, time.January, 3),
+		utcDate(1996, time.February, 29),
+		utcDate(1980, time.January, 10),
+	} {
+		personKey, err := saveModel(ctx, store, &Person{Key: datastore.IncompleteKey("Person", nil), FirstName: birthday.Format("Jan 2"), Common: Common{Enabled: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := saveModel(ctx, store, &Calendar{Key: datastore.IncompleteKey("Calendar", personKey), FirstOccurrence: birthday, Occasion: "Birthday", Common: Common{Enabled: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hrefs[birthday.Format("Jan 2")] = eventHref(key)
+	}
+
+	w := davRequest(t, handler, "REPORT", DAV_CALENDAR, "davx5-report-calendar-query.xml", map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("status %d, want 207\n%s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for day, href := range hrefs {
+		want := day == "Dec 31" || day == "Jan 3"
+		if got := strings.Contains(body, "<D:href>"+href+"</D:href>"); got != want {
+			t.Errorf("%s event in the response = %v, want %v\n%s", day, got, want, body)
+		}
+	}
+	if !strings.Contains(body, "SUMMARY:Dec 31 - Birthday") {
+		t.Errorf("response lacks the calendar data\n%s", body)
+	}
+}
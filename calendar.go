@@ -1,32 +1,65 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
+	"html/template"
+	"time"
 
-	"golang.org/x/net/html"
+	"cloud.google.com/go/datastore"
 )
 
-func calendarView(calendar *Entity) string {
-	var buffer bytes.Buffer
-
-	formattedDate := calendar.FirstOccurrence.Format("2006-01-02")
-	buffer.WriteString(fmt.Sprintf(`
-		<div class="%s">
-		<a href="%s" class="edit-link">Edit</a>
-		<span class="thing %s">%s</span> <span class="tag">(%s %s) [%s]</span><br>
-		<div class="comments">%s</div>
-		</div>
-	`,
-		calendar.enabledClass(),
-		calendar.editURL(),
-		calendar.Key.Kind,
-		formattedDate,
-		calendar.Frequency,
-		html.EscapeString(calendar.Occasion),
-		calendar.enabledText(),
-		html.EscapeString(calendar.Comments),
-	))
-
-	return buffer.String()
+// Yearly occasion of its parent Person, e.g. a birthday.
+type Calendar struct {
+	Key             *datastore.Key `datastore:"__key__"`
+	FirstOccurrence time.Time      `datastore:"first_occurrence,omitempty" hint:"YYYY-MM-DD"`
+	Frequency       string         `datastore:"frequency,omitempty" form:"select"`
+	Occasion        string         `datastore:"occasion,omitempty"`
+	CardSent        time.Time      `datastore:"card_sent,omitempty" hint:"YYYY-MM-DD"`
+	Common
+}
+
+func (calendar *Calendar) key() *datastore.Key {
+	return calendar.Key
+}
+
+func (calendar *Calendar) common() *Common {
+	return &calendar.Common
+}
+
+func (calendar *Calendar) LoadKey(key *datastore.Key) error {
+	calendar.Key = key
+	return nil
+}
+
+func (calendar *Calendar) Load(props []datastore.Property) error {
+	return loadModelProperties(calendar, props)
+}
+
+func (calendar *Calendar) Save() ([]datastore.Property, error) {
+	return saveModelProperties(calendar)
+}
+
+func (calendar *Calendar) words() []string {
+	return modelWords(calendar)
+}
+
+func (calendar *Calendar) view() (template.HTML, error) {
+	return render("Calendar", calendar)
+}
+
+func (calendar *Calendar) fix() {
+	// After other fixes, lastly.
+	calendar.Words = calendar.words()
+}
+
+type cardSentData struct {
+	Event *Calendar
+	CSRF  string
+}
+
+func (calendar *Calendar) cardSentText() string {
+	if calendar.CardSent.IsZero() {
+		return ""
+	} else {
+		return "[CardSent " + calendar.CardSent.Format("2006-01-02") + "]"
+	}
 }
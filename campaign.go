@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+var campaignStatuses = []string{"planned", "sent", "received", "returned"}
+
+// A card campaign, e.g. "Holiday 2026". Root entity, parent of its `CampaignStatus` entities.
+type Campaign struct {
+	Key      *datastore.Key `datastore:"__key__"`
+	Name     string         `datastore:"name"`
+	Created  time.Time      `datastore:"created"`
+	Comments string         `datastore:"comments,omitempty,noindex"`
+}
+
+// Card status of one Person in a Campaign, keyed by the encoded Person key.
+// Dates are zero until the corresponding status is marked.
+type CampaignStatus struct {
+	Key      *datastore.Key `datastore:"__key__"`
+	Person   *datastore.Key `datastore:"person"`
+	Planned  time.Time      `datastore:"planned,omitempty"`
+	Sent     time.Time      `datastore:"sent,omitempty"`
+	Received time.Time      `datastore:"received,omitempty"`
+	Returned time.Time      `datastore:"returned,omitempty"`
+}
+
+func campaignStatusKey(campaignKey *datastore.Key, personKey *datastore.Key) *datastore.Key {
+	return datastore.NameKey("CampaignStatus", personKey.Encode(), campaignKey)
+}
+
+func (status *CampaignStatus) mark(s string, now time.Time) error {
+	switch s {
+	case "planned":
+		status.Planned = now
+	case "sent":
+		status.Sent = now
+	case "received":
+		status.Received = now
+	case "returned":
+		status.Returned = now
+	default:
+		return httpError(http.StatusBadRequest, "unknown campaign status %q, expected one of %q", s, campaignStatuses)
+	}
+	return nil
+}
+
+func (status *CampaignStatus) has(s string) bool {
+	switch s {
+	case "planned":
+		return !status.Planned.IsZero()
+	case "sent":
+		return !status.Sent.IsZero()
+	case "received":
+		return !status.Received.IsZero()
+	case "returned":
+		return !status.Returned.IsZero()
+	}
+	return false
+}
+
+func (status *CampaignStatus) dateText(s string) string {
+	switch s {
+	case "planned":
+		return formatDate(status.Planned)
+	case "sent":
+		return formatDate(status.Sent)
+	case "received":
+		return formatDate(status.Received)
+	case "returned":
+		return formatDate(status.Returned)
+	}
+	return ""
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+func fetchCampaignStatuses(ctx context.Context, store Store, campaignKey *datastore.Key) ([]CampaignStatus, error) {
+	var statuses []CampaignStatus
+	_, err := store.QueryChildren(ctx, campaignKey, "CampaignStatus", &statuses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch statuses for campaign %v: %v", campaignKey, err)
+	}
+	return statuses, nil
+}
+
+// Marks each Person with the given status, creating missing `CampaignStatus` entities.
+func markCampaign(ctx context.Context, store Store, campaignKey *datastore.Key, personKeys []*datastore.Key, s string) (int, error) {
+	if len(personKeys) == 0 {
+		return 0, nil
+	}
+
+	keys := make([]*datastore.Key, len(personKeys))
+	for i, personKey := range personKeys {
+		keys[i] = campaignStatusKey(campaignKey, personKey)
+	}
+
+	statuses := make([]CampaignStatus, len(keys))
+	err := store.GetMulti(ctx, keys, statuses)
+	if merr, ok := err.(datastore.MultiError); ok {
+		for i, err := range merr {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return 0, fmt.Errorf("failed to get status %v: %v", keys[i], err)
+			}
+		}
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get statuses: %v", err)
+	}
+
+	now := time.Now()
+	for i := range statuses {
+		statuses[i].Key = keys[i]
+		statuses[i].Person = personKeys[i]
+		err = statuses[i].mark(s, now)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = store.PutMulti(ctx, keys, statuses)
+	if err != nil {
+		return 0, fmt.Errorf("failed to put %d statuses: %v", len(statuses), err)
+	}
+	return len(statuses), nil
+}
+
+func getCampaign(ctx context.Context, store Store, key string) (*Campaign, error) {
+	dbkey, err := datastore.DecodeKey(key)
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, "invalid campaign key %q", key)
+	}
+	campaign := &Campaign{}
+	err = store.Get(ctx, dbkey, campaign)
+	if err != nil {
+		return nil, httpError(http.StatusNotFound, "failed to get campaign %v: %v", dbkey, err)
+	}
+	return campaign, nil
+}
+
+// People of a campaign, optionally only those with the given status.
+func campaignPeople(ctx context.Context, store Store, campaignKey *datastore.Key, s string) ([]Person, error) {
+	statuses, err := fetchCampaignStatuses(ctx, store, campaignKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*datastore.Key
+	for _, status := range statuses {
+		if s == "" || status.has(s) {
+			keys = append(keys, status.Person)
+		}
+	}
+
+	found, err := getPeople(ctx, store, keys)
+	if err != nil {
+		return nil, err
+	}
+	var people []Person
+	for _, person := range found {
+		if person != nil {
+			people = append(people, *person)
+		}
+	}
+	return people, nil
+}
+
+func campaignHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	key := getValue(r, "campaign")
+	action := getValue(r, "action")
+	message := ""
+
+	if action != "" && r.Method != "POST" {
+		return "", httpError(http.StatusMethodNotAllowed, "action %q requires POST", action)
+	}
+
+	switch action {
+	case "":
+	case "create":
+		name := getValue(r, "name")
+		if name == "" {
+			return "", httpError(http.StatusBadRequest, "missing campaign name")
+		}
+		campaign := &Campaign{Name: name, Created: time.Now()}
+		dbkey, err := store.Put(ctx, datastore.IncompleteKey("Campaign", nil), campaign)
+		if err != nil {
+			return "", fmt.Errorf("failed to put campaign %q: %v", name, err)
+		}
+		key = dbkey.Encode()
+		message = fmt.Sprintf("Created campaign %q", name)
+	case "mark", "plan":
+		campaign, err := getCampaign(ctx, store, key)
+		if err != nil {
+			return "", err
+		}
+
+		var personKeys []*datastore.Key
+		status := getValue(r, "status")
+		if action == "plan" {
+			// Everyone on the current mailing list.
+			mailings, err := mailingList(ctx, store)
+			if err != nil {
+				return "", fmt.Errorf("failed to fetch mailing list: %v", err)
+			}
+			for _, m := range mailings {
+				if !slices.ContainsFunc(personKeys, m.Person.Key.Equal) {
+					personKeys = append(personKeys, m.Person.Key)
+				}
+			}
+		} else {
+			for _, k := range r.Form["person"] {
+				dbkey, err := datastore.DecodeKey(k)
+				if err != nil {
+					return "", httpError(http.StatusBadRequest, "invalid person key %q", k)
+				}
+				personKeys = append(personKeys, dbkey)
+			}
+		}
+
+		count, err := markCampaign(ctx, store, campaign.Key, personKeys, status)
+		if err != nil {
+			return "", err
+		}
+		message = fmt.Sprintf("Marked %d people as %s", count, status)
+	default:
+		return "", httpError(http.StatusBadRequest, "unknown campaign action %q", action)
+	}
+
+	var content template.HTML
+	var err error
+	if key == "" {
+		content, err = campaignListView(ctx, store, message)
+	} else {
+		var campaign *Campaign
+		campaign, err = getCampaign(ctx, store, key)
+		if err != nil {
+			return "", err
+		}
+		content, err = campaignView(ctx, store, campaign, message)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return page(ctx, "", content)
+}
+
+type campaignListData struct {
+	Message   string
+	Campaigns []*Campaign
+	CSRF      string
+}
+
+func campaignListView(ctx context.Context, store Store, message string) (template.HTML, error) {
+	query := &storeQuery{Kind: "Campaign", Order: "-created"}
+	var campaigns []*Campaign
+	_, err := store.GetAll(ctx, query, &campaigns)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch campaigns: %v", err)
+	}
+
+	return render("campaigns", &campaignListData{Message: message, Campaigns: campaigns, CSRF: csrfToken(ctx)})
+}
+
+type campaignRow struct {
+	Person *Person
+	Status *CampaignStatus
+}
+
+type campaignSection struct {
+	Title  string
+	People []*Person
+}
+
+type campaignViewData struct {
+	Message  string
+	Campaign *Campaign
+	Statuses []string
+	Rows     []campaignRow
+	Report   []campaignSection
+	CSRF     string
+}
+
+func campaignView(ctx context.Context, store Store, campaign *Campaign, message string) (template.HTML, error) {
+	statuses, err := fetchCampaignStatuses(ctx, store, campaign.Key)
+	if err != nil {
+		return "", err
+	}
+
+	personKeys := make([]*datastore.Key, len(statuses))
+	for i, status := range statuses {
+		personKeys[i] = status.Person
+	}
+	people, err := getPeople(ctx, store, personKeys)
+	if err != nil {
+		return "", err
+	}
+
+	data := &campaignViewData{
+		Message:  message,
+		Campaign: campaign,
+		Statuses: campaignStatuses,
+		Report: []campaignSection{
+			{Title: "Sent, not heard from"},
+			{Title: "Heard from, not sent"},
+			{Title: "Returned"},
+		},
+		CSRF: csrfToken(ctx),
+	}
+	for i := range statuses {
+		status := &statuses[i]
+		person := people[i]
+		if person == nil {
+			continue
+		}
+		data.Rows = append(data.Rows, campaignRow{Person: person, Status: status})
+		switch {
+		case status.has("returned"):
+			data.Report[2].People = append(data.Report[2].People, person)
+		case status.has("sent") && !status.has("received"):
+			data.Report[0].People = append(data.Report[0].People, person)
+		case status.has("received") && !status.has("sent"):
+			data.Report[1].People = append(data.Report[1].People, person)
+		}
+	}
+
+	return render("campaign", data)
+}
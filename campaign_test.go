@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestCampaignActionRequiresPost(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+
+	_, err := campaignHandler(getRequest("/campaign?action=create&name=Holiday"), ctx, store)
+	if statusCode(err) != http.StatusMethodNotAllowed {
+		t.Errorf("GET create = %v, want 405", err)
+	}
+	var campaigns []Campaign
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Campaign"}, &campaigns)
+	if err != nil || len(campaigns) != 0 {
+		t.Errorf("created %d campaigns, %v, want none", len(campaigns), err)
+	}
+}
+
+func TestCampaignReport(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+
+	_, err := campaignHandler(postForm("/campaign", url.Values{"action": {"create"}, "name": {"Holiday"}}), ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var campaigns []Campaign
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Campaign"}, &campaigns)
+	if err != nil || len(campaigns) != 1 || campaigns[0].Name != "Holiday" {
+		t.Fatalf("campaigns %+v, %v, want the created one", campaigns, err)
+	}
+	campaignKey := campaigns[0].Key.Encode()
+
+	people := map[string]*datastore.Key{}
+	for _, name := range []string{"Sent", "Received", "Both", "Returned", "Gone"} {
+		key, err := saveModel(ctx, store, &Person{Key: datastore.IncompleteKey("Person", nil), FirstName: name, LastName: "Doe", Common: Common{Enabled: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		people[name] = key
+	}
+	mark := func(status string, names ...string) error {
+		values := url.Values{"action": {"mark"}, "campaign": {campaignKey}, "status": {status}}
+		for _, name := range names {
+			values.Add("person", people[name].Encode())
+		}
+		_, err := campaignHandler(postForm("/campaign", values), ctx, store)
+		return err
+	}
+	for _, m := range []struct {
+		status string
+		names  []string
+	}{
+		{"sent", []string{"Sent", "Both", "Returned", "Gone"}},
+		{"received", []string{"Received", "Both"}},
+		{"returned", []string{"Returned"}},
+	} {
+		err = mark(m.status, m.names...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = mark("lost", "Sent")
+	if statusCode(err) != http.StatusBadRequest {
+		t.Errorf("mark lost = %v, want 400", err)
+	}
+	err = store.Delete(ctx, people["Gone"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Later marks keep the earlier dates.
+	statuses, err := fetchCampaignStatuses(ctx, store, campaigns[0].Key)
+	if err != nil || len(statuses) != 5 {
+		t.Fatalf("%d statuses, %v, want 5", len(statuses), err)
+	}
+	for _, status := range statuses {
+		if status.Person.Equal(people["Both"]) && (!status.has("sent") || !status.has("received") || status.has("returned")) {
+			t.Errorf("status %+v, want sent and received", status)
+		}
+	}
+
+	resp, err := campaignHandler(getRequest("/campaign?campaign="+campaignKey), ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []struct {
+		title, name string
+	}{
+		{"Sent, not heard from (1)", "Sent Doe"},
+		{"Heard from, not sent (1)", "Received Doe"},
+		{"Returned (1)", "Returned Doe"},
+	} {
+		_, after, ok := strings.Cut(resp, section.title)
+		if !ok {
+			t.Errorf("report without %q:\n%s", section.title, resp)
+			continue
+		}
+		if next := strings.Index(after, "<h4>"); next >= 0 {
+			after = after[:next]
+		}
+		if !strings.Contains(after, section.name) {
+			t.Errorf("report section %q without %q:\n%s", section.title, section.name, after)
+		}
+	}
+	if strings.Contains(resp, "Gone Doe") {
+		t.Errorf("report lists the deleted person:\n%s", resp)
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/appengine/v2"
+)
+
+// Basic auth credentials for CardDAV and CalDAV clients, which can't sign in
+// with Google. Both are disabled while the password is unset.
+const CARDDAV_USERNAME = "CARDDAV_USERNAME"
+const CARDDAV_PASSWORD = "CARDDAV_PASSWORD"
+
+// A single address book of all enabled people, one vCard per Person, next to
+// the calendar of `caldav.go`.
+// https://datatracker.ietf.org/doc/html/rfc6352
+const DAV_ROOT = "/dav/"
+const DAV_CONTACTS = "/dav/contacts/"
+
+const davNamespaces = `xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav" xmlns:CAL="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/"`
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Responses []davResponse `xml:"D:response"`
+	SyncToken string        `xml:"D:sync-token,omitempty"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"D:href"`
+	Propstat []davPropstat `xml:"D:propstat,omitempty"`
+	Status   string        `xml:"D:status,omitempty"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	ResourceType         *davResourceType `xml:"D:resourcetype,omitempty"`
+	DisplayName          string           `xml:"D:displayname,omitempty"`
+	CurrentUserPrincipal *davHref         `xml:"D:current-user-principal,omitempty"`
+	AddressbookHomeSet   *davHref         `xml:"C:addressbook-home-set,omitempty"`
+	CalendarHomeSet      *davHref         `xml:"CAL:calendar-home-set,omitempty"`
+	SupportedReportSet   *davReports      `xml:"D:supported-report-set,omitempty"`
+	SupportedComponents  *davXML          `xml:"CAL:supported-calendar-component-set,omitempty"`
+	Privileges           *davXML          `xml:"D:current-user-privilege-set,omitempty"`
+	GetCTag              string           `xml:"CS:getctag,omitempty"`
+	SyncToken            string           `xml:"D:sync-token,omitempty"`
+	GetETag              string           `xml:"D:getetag,omitempty"`
+	GetContentType       string           `xml:"D:getcontenttype,omitempty"`
+	AddressData          string           `xml:"C:address-data,omitempty"`
+	CalendarData         string           `xml:"CAL:calendar-data,omitempty"`
+}
+
+type davResourceType struct {
+	Collection  *struct{} `xml:"D:collection,omitempty"`
+	Addressbook *struct{} `xml:"C:addressbook,omitempty"`
+	Calendar    *struct{} `xml:"CAL:calendar,omitempty"`
+}
+
+// Literal content, with the prefixes of `davNamespaces`.
+type davXML struct {
+	Inner string `xml:",innerxml"`
+}
+
+type davHref struct {
+	Href string `xml:"D:href"`
+}
+
+type davReports struct {
+	Reports []davSupportedReport `xml:"D:supported-report"`
+}
+
+type davSupportedReport struct {
+	Report davXML `xml:"D:report"`
+}
+
+// Body of a REPORT request, with the report type in `XMLName`.
+type davReportRequest struct {
+	XMLName   xml.Name
+	Hrefs     []string `xml:"DAV: href"`
+	SyncToken string   `xml:"DAV: sync-token"`
+	// The VEVENT time range of a `calendar-query`.
+	TimeRange *struct {
+		Start string `xml:"start,attr"`
+		End   string `xml:"end,attr"`
+	} `xml:"filter>comp-filter>comp-filter>time-range"`
+}
+
+func davStatus(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+// Requires the CardDAV Basic auth credentials, since `/dav/` is exempt from
+// `login: admin` in `app.yaml`.
+func davAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		password := os.Getenv(CARDDAV_PASSWORD)
+		if password == "" {
+			http.Error(w, "DAV is not configured", http.StatusForbidden)
+			return
+		}
+		u, p, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(u), []byte(os.Getenv(CARDDAV_USERNAME))) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pda", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *app) dav() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+
+		var err error
+		switch {
+		case r.Method == http.MethodOptions:
+			w.Header().Set("DAV", "1, 3, addressbook, calendar-access")
+			w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+		case r.Method == "PROPFIND":
+			err = davPropfind(ctx, a.store, w, r)
+		case strings.HasPrefix(r.URL.Path, DAV_CALENDAR):
+			err = caldav(ctx, a.store, w, r)
+		case r.Method == "REPORT":
+			err = davReport(ctx, a.store, w, r)
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			err = davGet(ctx, a.store, w, r)
+		case r.Method == http.MethodPut:
+			err = davPut(ctx, a.store, w, r)
+		case r.Method == http.MethodDelete:
+			err = davDelete(ctx, a.store, w, r)
+		default:
+			err = httpError(http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		}
+		if err != nil {
+			errorPage(w, r, err)
+		}
+	})
+}
+
+// Enabled people are named by their encoded key, and those created by a
+// CardDAV client by the client's resource name.
+func cardName(key *datastore.Key) string {
+	if key.Name != "" {
+		return key.Name
+	}
+	return key.Encode()
+}
+
+func cardHref(key *datastore.Key) string {
+	return DAV_CONTACTS + cardName(key) + ".vcf"
+}
+
+func cardKey(href string) (*datastore.Key, error) {
+	name, ok := strings.CutPrefix(href, DAV_CONTACTS)
+	if !ok || !strings.HasSuffix(name, ".vcf") || strings.Contains(name, "/") {
+		return nil, httpError(http.StatusNotFound, "no such card %q", href)
+	}
+	name = strings.TrimSuffix(name, ".vcf")
+	if key, err := datastore.DecodeKey(name); err == nil && key.Kind == "Person" && key.Parent == nil {
+		return key, nil
+	}
+	return datastore.NameKey("Person", name, nil), nil
+}
+
+// All enabled people with their enabled Contacts and Addresses, in key order.
+func fetchCards(ctx context.Context, store Store) ([]*card, error) {
+	enabled := map[string]any{"enabled": true}
+	var people []*Person
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "Person", Filters: enabled}, &people)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch people: %v", err)
+	}
+	var contacts []*Contact
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Contact", Filters: enabled}, &contacts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch Contact entities: %v", err)
+	}
+	var addresses []*Address
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Address", Filters: enabled}, &addresses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch Address entities: %v", err)
+	}
+	var children []model
+	for _, contact := range contacts {
+		children = append(children, contact)
+	}
+	for _, address := range addresses {
+		children = append(children, address)
+	}
+
+	cards := make([]*card, len(people))
+	byKey := make(map[string]*card, len(people))
+	for i, person := range people {
+		cards[i] = &card{Person: person}
+		byKey[person.Key.Encode()] = cards[i]
+	}
+	for _, child := range children {
+		if c := byKey[child.key().Parent.Encode()]; c != nil {
+			c.Children = append(c.Children, child)
+		}
+	}
+	for _, c := range cards {
+		slices.SortFunc(c.Children, func(a, b model) int { return compareKeys(a.key(), b.key()) })
+	}
+	return cards, nil
+}
+
+// The Person with all of its Contacts and Addresses, or nil.
+func fetchCard(ctx context.Context, store Store, key *datastore.Key) (*card, error) {
+	entities, err := fetchFamily(ctx, store, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch card %v: %v", key, err)
+	}
+	var c *card
+	for _, entity := range entities {
+		if person, ok := entity.(*Person); ok && person.Key.Equal(key) {
+			c = &card{Person: person}
+		}
+	}
+	if c == nil {
+		return nil, nil
+	}
+	for _, entity := range entities {
+		switch entity.(type) {
+		case *Contact, *Address:
+			c.Children = append(c.Children, entity)
+		}
+	}
+	return c, nil
+}
+
+// The card as served, or nil for a disabled Person.
+func (c *card) enabled() *card {
+	if c == nil || !c.Person.Enabled {
+		return nil
+	}
+	enabled := &card{Person: c.Person}
+	for _, child := range c.Children {
+		if child.common().Enabled {
+			enabled.Children = append(enabled.Children, child)
+		}
+	}
+	return enabled
+}
+
+// Hash of the member hrefs and ETags, which changes whenever a member does, so
+// `getctag` and the sync token need no change log.
+func collectionTag(members []davResponse) string {
+	h := sha1.New()
+	for _, m := range members {
+		fmt.Fprintf(h, "%s %s\n", m.Href, m.Propstat[0].Prop.GetETag)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func syncToken(members []davResponse) string {
+	return "urn:pda:sync:" + collectionTag(members)
+}
+
+// Without a change log, a known token is either current or invalid, which
+// makes the client start over with a full sync.
+func syncCollection(w http.ResponseWriter, token string, members []davResponse) error {
+	ms := &davMultistatus{SyncToken: syncToken(members)}
+	switch token {
+	case ms.SyncToken:
+	case "":
+		ms.Responses = members
+	default:
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s<D:error xmlns:D=\"DAV:\"><D:valid-sync-token/></D:error>\n", xml.Header)
+		return nil
+	}
+	return writeMultistatus(w, ms)
+}
+
+// Members without their data, for PROPFIND and sync-collection.
+func cardResponses(cards []*card) []davResponse {
+	responses := make([]davResponse, len(cards))
+	for i, c := range cards {
+		responses[i] = cardResponse(c, false)
+	}
+	return responses
+}
+
+func cardResponse(c *card, withData bool) davResponse {
+	prop := davProp{GetETag: c.etag(), GetContentType: "text/vcard; charset=utf-8"}
+	if withData {
+		prop.AddressData = c.vcard()
+	}
+	return davResponse{
+		Href:     cardHref(c.Person.Key),
+		Propstat: []davPropstat{{Prop: prop, Status: davStatus(http.StatusOK)}},
+	}
+}
+
+func writeMultistatus(w http.ResponseWriter, ms *davMultistatus) error {
+	body, err := xml.MarshalIndent(ms, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal multistatus: %v", err)
+	}
+	// `encoding/xml` can't declare prefixes, so add them to the root element.
+	root := "<D:multistatus"
+	body = []byte(root + " " + davNamespaces + string(body[len(root):]))
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = io.WriteString(w, xml.Header)
+	_, _ = w.Write(body)
+	return nil
+}
+
+// Returns all properties, whatever the request asks for.
+func davPropfind(ctx context.Context, store Store, w http.ResponseWriter, r *http.Request) error {
+	depth := r.Header.Get("Depth")
+	if depth == "" || depth == "infinity" {
+		depth = "1"
+	}
+
+	ms := &davMultistatus{}
+	ok := func(href string, prop davProp) {
+		ms.Responses = append(ms.Responses, davResponse{
+			Href:     href,
+			Propstat: []davPropstat{{Prop: prop, Status: davStatus(http.StatusOK)}},
+		})
+	}
+	addressbook := func(members []davResponse) {
+		ok(DAV_CONTACTS, davProp{
+			ResourceType: &davResourceType{Collection: &struct{}{}, Addressbook: &struct{}{}},
+			DisplayName:  "PDA",
+			SupportedReportSet: &davReports{Reports: []davSupportedReport{
+				supportedReport("<C:addressbook-query/>"),
+				supportedReport("<C:addressbook-multiget/>"),
+				supportedReport("<D:sync-collection/>"),
+			}},
+			GetCTag:   collectionTag(members),
+			SyncToken: syncToken(members),
+		})
+	}
+	calendar := func(members []davResponse) {
+		ok(DAV_CALENDAR, davProp{
+			ResourceType: &davResourceType{Collection: &struct{}{}, Calendar: &struct{}{}},
+			DisplayName:  "PDA occasions",
+			SupportedReportSet: &davReports{Reports: []davSupportedReport{
+				supportedReport("<CAL:calendar-query/>"),
+				supportedReport("<CAL:calendar-multiget/>"),
+				supportedReport("<D:sync-collection/>"),
+			}},
+			SupportedComponents: &davXML{`<CAL:comp name="VEVENT"/>`},
+			Privileges:          &davXML{`<D:privilege><D:read/></D:privilege>`},
+			GetCTag:             collectionTag(members),
+			SyncToken:           syncToken(members),
+		})
+	}
+
+	switch path := r.URL.Path; {
+	case path == DAV_ROOT:
+		// Principal and home of both collections in one.
+		ok(DAV_ROOT, davProp{
+			ResourceType:         &davResourceType{Collection: &struct{}{}},
+			DisplayName:          "PDA",
+			CurrentUserPrincipal: &davHref{Href: DAV_ROOT},
+			AddressbookHomeSet:   &davHref{Href: DAV_ROOT},
+			CalendarHomeSet:      &davHref{Href: DAV_ROOT},
+		})
+		if depth != "0" {
+			cards, err := fetchCards(ctx, store)
+			if err != nil {
+				return err
+			}
+			addressbook(cardResponses(cards))
+			events, err := fetchEvents(ctx, store)
+			if err != nil {
+				return err
+			}
+			calendar(eventResponses(events))
+		}
+	case path == DAV_CONTACTS:
+		cards, err := fetchCards(ctx, store)
+		if err != nil {
+			return err
+		}
+		members := cardResponses(cards)
+		addressbook(members)
+		if depth != "0" {
+			ms.Responses = append(ms.Responses, members...)
+		}
+	case path == DAV_CALENDAR:
+		events, err := fetchEvents(ctx, store)
+		if err != nil {
+			return err
+		}
+		members := eventResponses(events)
+		calendar(members)
+		if depth != "0" {
+			ms.Responses = append(ms.Responses, members...)
+		}
+	case strings.HasPrefix(path, DAV_CALENDAR):
+		e, err := fetchEvent(ctx, store, path)
+		if err != nil {
+			return err
+		}
+		ms.Responses = append(ms.Responses, eventResponse(e, false))
+	default:
+		key, err := cardKey(path)
+		if err != nil {
+			return err
+		}
+		c, err := fetchCard(ctx, store, key)
+		if err != nil {
+			return err
+		}
+		c = c.enabled()
+		if c == nil {
+			return httpError(http.StatusNotFound, "no such card %q", path)
+		}
+		ms.Responses = append(ms.Responses, cardResponse(c, false))
+	}
+	return writeMultistatus(w, ms)
+}
+
+func supportedReport(name string) davSupportedReport {
+	return davSupportedReport{Report: davXML{name}}
+}
+
+func parseReport(r *http.Request) (*davReportRequest, error) {
+	var req davReportRequest
+	err := xml.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, "failed to parse report: %v", err)
+	}
+	return &req, nil
+}
+
+func davReport(ctx context.Context, store Store, w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Path != DAV_CONTACTS {
+		return httpError(http.StatusForbidden, "reports are only supported on %s", DAV_CONTACTS)
+	}
+	req, err := parseReport(r)
+	if err != nil {
+		return err
+	}
+
+	cards, err := fetchCards(ctx, store)
+	if err != nil {
+		return err
+	}
+	if req.XMLName.Local == "sync-collection" {
+		return syncCollection(w, req.SyncToken, cardResponses(cards))
+	}
+	ms := &davMultistatus{}
+
+	switch req.XMLName.Local {
+	case "addressbook-query":
+		// Filters aren't supported, every card matches.
+		for _, c := range cards {
+			ms.Responses = append(ms.Responses, cardResponse(c, true))
+		}
+	case "addressbook-multiget":
+		byHref := make(map[string]*card, len(cards))
+		for _, c := range cards {
+			byHref[cardHref(c.Person.Key)] = c
+		}
+		for _, href := range req.Hrefs {
+			if c := byHref[href]; c != nil {
+				ms.Responses = append(ms.Responses, cardResponse(c, true))
+			} else {
+				ms.Responses = append(ms.Responses, davResponse{Href: href, Status: davStatus(http.StatusNotFound)})
+			}
+		}
+	default:
+		return httpError(http.StatusForbidden, "unsupported report %q", req.XMLName.Local)
+	}
+	return writeMultistatus(w, ms)
+}
+
+func davGet(ctx context.Context, store Store, w http.ResponseWriter, r *http.Request) error {
+	key, err := cardKey(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	c, err := fetchCard(ctx, store, key)
+	if err != nil {
+		return err
+	}
+	c = c.enabled()
+	if c == nil {
+		return httpError(http.StatusNotFound, "no such card %q", r.URL.Path)
+	}
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("ETag", c.etag())
+	_, _ = io.WriteString(w, c.vcard())
+	return nil
+}
+
+// Creates or updates a Person from a vCard. The stored card is normalized, so
+// no ETag is returned and the client fetches it again.
+func davPut(ctx context.Context, store Store, w http.ResponseWriter, r *http.Request) error {
+	key, err := cardKey(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return httpError(http.StatusBadRequest, "failed to read vCard: %v", err)
+	}
+	props, err := parseVCard(string(body))
+	if err != nil {
+		return httpError(http.StatusBadRequest, "%v", err)
+	}
+
+	// A card deleted by a client, and its disabled children, are enabled again
+	// when they match.
+	c, err := fetchCard(ctx, store, key)
+	if err != nil {
+		return err
+	}
+	exists := c.enabled() != nil
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !exists || (match != "*" && match != c.enabled().etag()) {
+			return httpError(http.StatusPreconditionFailed, "card %q was changed", r.URL.Path)
+		}
+	}
+	if r.Header.Get("If-None-Match") == "*" && exists {
+		return httpError(http.StatusPreconditionFailed, "card %q already exists", r.URL.Path)
+	}
+
+	if c == nil {
+		c = &card{Person: &Person{Key: key}}
+	}
+	choices, err := fetchChoices(ctx, store)
+	if err != nil {
+		return err
+	}
+	c.update(props, choices["Category"])
+
+	c.Person.fix()
+	key, err = saveModel(ctx, store, c.Person)
+	if err != nil {
+		return err
+	}
+	for _, child := range c.Children {
+		if child.key().Incomplete() {
+			child.LoadKey(datastore.IncompleteKey(child.key().Kind, key))
+		}
+		child.fix()
+		_, err = saveModel(ctx, store, child)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !exists {
+		log.Printf("CardDAV created %v", key)
+		w.Header().Set("Location", cardHref(key))
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		log.Printf("CardDAV updated %v", key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return nil
+}
+
+// Disables the Person, like the edit form does, rather than deleting it.
+func davDelete(ctx context.Context, store Store, w http.ResponseWriter, r *http.Request) error {
+	key, err := cardKey(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	c, err := fetchCard(ctx, store, key)
+	if err != nil {
+		return err
+	}
+	c = c.enabled()
+	if c == nil {
+		return httpError(http.StatusNotFound, "no such card %q", r.URL.Path)
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != c.etag() {
+		return httpError(http.StatusPreconditionFailed, "card %q was changed", r.URL.Path)
+	}
+
+	c.Person.Enabled = false
+	c.Person.fix()
+	_, err = saveModel(ctx, store, c.Person)
+	if err != nil {
+		return err
+	}
+	log.Printf("CardDAV disabled %v", key)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func wellKnownDAV(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, DAV_ROOT, http.StatusMovedPermanently)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+const testCardHref = "/dav/contacts/6F1C2B3A-8D4E-4B5F-9A6B-7C8D9E0F1A2B.vcf"
+
+// Serves a DAV request with the body of `testdata/dav/<fixture>`, in the form
+// iOS Contacts and DAVx5 send them, when not empty.
+func davRequest(t *testing.T, handler http.Handler, method string, path string, fixture string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body string
+	if fixture != "" {
+		b, err := os.ReadFile(filepath.Join("testdata", "dav", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = string(b)
+	}
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.SetBasicAuth("pda", "secret")
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestCardDAV(t *testing.T) {
+	t.Setenv(CARDDAV_USERNAME, "pda")
+	t.Setenv(CARDDAV_PASSWORD, "secret")
+	store := newMemoryStore()
+	handler := davAuth((&app{store: store}).dav())
+
+	r := httptest.NewRequest("PROPFIND", DAV_ROOT, nil)
+	r.SetBasicAuth("pda", "wrong")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: status %d, want 401", w.Code)
+	}
+
+	w = davRequest(t, handler, "PUT", testCardHref, "ios-put.vcf", map[string]string{"If-None-Match": "*", "Content-Type": "text/vcard"})
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != testCardHref {
+		t.Fatalf("PUT: status %d, location %q, want 201 at the href\n%s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	w = davRequest(t, handler, "PUT", testCardHref, "ios-put.vcf", map[string]string{"If-None-Match": "*"})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT existing with If-None-Match: status %d, want 412", w.Code)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		fixture string
+		depth   string
+		want    []string
+	}{
+		{"principal", "PROPFIND", DAV_ROOT, "ios-propfind-principal.xml", "0",
+			[]string{"<D:current-user-principal>", "<D:href>/dav/</D:href>", "<C:addressbook-home-set>"}},
+		{"address book", "PROPFIND", DAV_CONTACTS, "davx5-propfind-addressbook.xml", "1",
+			[]string{"<C:addressbook></C:addressbook>", "<CS:getctag>", "<D:href>" + testCardHref + "</D:href>", "<D:getetag>"}},
+		{"sync", "REPORT", DAV_CONTACTS, "davx5-report-sync.xml", "",
+			[]string{"<D:href>" + testCardHref + "</D:href>", "<D:sync-token>urn:pda:sync:"}},
+		{"multiget", "REPORT", DAV_CONTACTS, "davx5-report-multiget.xml", "",
+			[]string{"FN:Dr. Jane Doe", "ORG:Doe\\, Ray &amp; Partners", "EMAIL;TYPE=INTERNET,HOME:jane@example.com",
+				"ADR;TYPE=HOME:;;1 Main St\\nApt 2;Springfield;IL;62701;United States",
+				"<D:href>/dav/contacts/missing.vcf</D:href>", "404 Not Found"}},
+	}
+	for _, test := range tests {
+		w := davRequest(t, handler, test.method, test.path, test.fixture, map[string]string{"Depth": test.depth})
+		if w.Code != http.StatusMultiStatus {
+			t.Errorf("%s: status %d, want 207\n%s", test.name, w.Code, w.Body)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s: response lacks %q\n%s", test.name, want, w.Body)
+			}
+		}
+	}
+
+	w = davRequest(t, handler, "GET", testCardHref, "", nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET: status %d, ETag %q", w.Code, etag)
+	}
+	w = davRequest(t, handler, "DELETE", testCardHref, "", map[string]string{"If-Match": `"stale"`})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with a stale ETag: status %d, want 412", w.Code)
+	}
+	w = davRequest(t, handler, "DELETE", testCardHref, "", map[string]string{"If-Match": etag})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d, want 204\n%s", w.Code, w.Body)
+	}
+	w = davRequest(t, handler, "GET", testCardHref, "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET deleted: status %d, want 404", w.Code)
+	}
+
+	// Deleted cards are only disabled.
+	person := &Person{}
+	err := store.Get(context.Background(), datastore.NameKey("Person", "6F1C2B3A-8D4E-4B5F-9A6B-7C8D9E0F1A2B", nil), person)
+	if err != nil || person.Enabled || person.LastName != "Doe" {
+		t.Errorf("deleted person %+v, %v, want it disabled", person, err)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/appengine/v2/taskqueue"
+)
+
+// Entities renamed by one `/task/choices/rename` request, before it continues in a new task.
+const RENAME_CHOICE_BATCH = 100
+
+// Option of a select field left unset, which isn't a value to import into.
+const UNSPECIFIED_CHOICE = "(Unspecified)"
+
+// Options of the `form:"select"` fields until an admin saves them on the
+// `/choices` page. The first option is the default for new entities.
+var defaultChoices = map[string][]string{
+	"Category": {
+		UNSPECIFIED_CHOICE,
+		"Relatives",
+		"Personal",
+		"Hospitality",  //"Hotel/Restaurant/Entertainment",
+		"Freelance",    //"Services by Individuals",
+		"Company",      //"Companies, Institutions, etc.",
+		"Professional", //"Business Relations",
+	},
+	"AddressType": {
+		UNSPECIFIED_CHOICE,
+		"Home",
+		"Business",
+	},
+	"ContactMethod": {
+		UNSPECIFIED_CHOICE,
+		"Personal",
+		"Business",
+	},
+	"ContactType": {
+		UNSPECIFIED_CHOICE,
+		"Voice",
+		"Data",
+		"Email",
+		"Mobile",
+		"URL",
+		"Facsimile",
+	},
+	"Frequency": {
+		"Annual",
+	},
+}
+
+// Admin edited options of one select field. Root entity, named after the field.
+type ChoiceList struct {
+	Key     *datastore.Key `datastore:"__key__"`
+	Values  []string       `datastore:"values,noindex"`
+	Updated time.Time      `datastore:"updated"`
+}
+
+// Names of the select fields, in `kinds` order.
+func choiceFields() []string {
+	var names []string
+	for _, kind := range kinds {
+		m, _ := newModel(datastore.IncompleteKey(kind, nil))
+		fields, _ := modelFields(m)
+		for _, field := range fields {
+			if field.Tag.Get("form") == "select" {
+				names = append(names, field.Name)
+			}
+		}
+	}
+	return names
+}
+
+// Kind and field of the named select field.
+func choiceField(name string) (string, reflect.StructField, bool) {
+	for _, kind := range kinds {
+		m, _ := newModel(datastore.IncompleteKey(kind, nil))
+		field, ok := reflect.TypeOf(m).Elem().FieldByName(name)
+		if ok && field.Tag.Get("form") == "select" {
+			return kind, field, true
+		}
+	}
+	return "", reflect.StructField{}, false
+}
+
+// Options of every select field, saved lists replacing the defaults.
+func fetchChoices(ctx context.Context, store Store) (map[string][]string, error) {
+	var lists []*ChoiceList
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "ChoiceList"}, &lists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch choice lists: %v", err)
+	}
+
+	choices := make(map[string][]string, len(defaultChoices))
+	for name, values := range defaultChoices {
+		choices[name] = values
+	}
+	for _, list := range lists {
+		if len(list.Values) > 0 {
+			choices[list.Key.Name] = list.Values
+		}
+	}
+	return choices, nil
+}
+
+func renameChoiceTask(field string, from string, to string, next *datastore.Key) *taskqueue.Task {
+	params := url.Values{"field": {field}, "from": {from}, "to": {to}}
+	if next != nil {
+		params.Set("next", next.Encode())
+	}
+	return taskqueue.NewPOSTTask("/task/choices/rename", params)
+}
+
+// Replaces the option `from` of a select field with `to` on a batch of
+// entities, continuing after the last one in a new task.
+func taskRenameChoiceHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	var buffer bytes.Buffer
+
+	name := getValue(r, "field")
+	from := getValue(r, "from")
+	to := getValue(r, "to")
+	kind, field, ok := choiceField(name)
+	if !ok {
+		return "", httpError(http.StatusBadRequest, "unknown select field %q", name)
+	}
+	if from == "" || to == "" {
+		return "", httpError(http.StatusBadRequest, "missing option to rename")
+	}
+
+	property, _, _ := strings.Cut(field.Tag.Get("datastore"), ",")
+	query := &storeQuery{
+		Kind:    kind,
+		Filters: map[string]any{property: from},
+		Limit:   RENAME_CHOICE_BATCH,
+	}
+	if next := getValue(r, "next"); next != "" {
+		key, err := datastore.DecodeKey(next)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode key %q: %v", next, err)
+		}
+		query.After = key
+	}
+
+	var props []datastore.PropertyList
+	keys, err := store.GetAll(ctx, query, &props)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch %s with %s %q: %v", query.Kind, name, from, err)
+	}
+	entities, err := loadModels(keys, props)
+	if err != nil {
+		return "", err
+	}
+
+	if len(entities) == RENAME_CHOICE_BATCH {
+		buffer.WriteString("Adding continuation task\n")
+		resp, err := addTask(ctx, renameChoiceTask(name, from, to, keys[len(keys)-1]))
+		if err != nil {
+			return "", fmt.Errorf("failed to add continuation task: %v", err)
+		}
+		buffer.WriteString(resp + "\n")
+	}
+
+	for i := range entities {
+		reflect.ValueOf(entities[i]).Elem().FieldByIndex(field.Index).SetString(to)
+		entities[i].fix()
+		buffer.WriteString(fmt.Sprintf("%4d: %v\n", i+1, keys[i]))
+	}
+	_, err = store.PutMulti(ctx, keys, entities)
+	if err != nil {
+		return "", fmt.Errorf("failed to put %d renamed entities: %v", len(entities), err)
+	}
+
+	buffer.WriteString(fmt.Sprintf("Renamed %s %q to %q on %d %s entities", name, from, to, len(entities), query.Kind))
+	return buffer.String(), nil
+}
+
+type choiceOption struct {
+	Value string
+	Order int
+}
+
+type choiceListRow struct {
+	Field   string
+	Options []choiceOption
+	Saved   bool // False while the defaults are in use.
+}
+
+type choicesData struct {
+	Message string
+	Lists   []choiceListRow
+	CSRF    string
+}
+
+// A rename of a saved option, migrated by `/task/choices/rename`.
+type choiceRename struct {
+	From string
+	To   string
+}
+
+// The options of a `/choices` form, ordered, without duplicates, and the
+// renamed ones. Options cleared of their value are dropped, without changing
+// the entities using them.
+func parseChoiceForm(r *http.Request) ([]string, []choiceRename, error) {
+	olds, values, orders := r.Form["old"], r.Form["value"], r.Form["order"]
+	if len(values) != len(olds) || len(orders) != len(olds) {
+		return nil, nil, httpError(http.StatusBadRequest, "mismatched option rows")
+	}
+
+	type row struct {
+		old   string
+		value string
+		order int
+	}
+	var rows []row
+	for i := range values {
+		order, err := strconv.Atoi(strings.TrimSpace(orders[i]))
+		if err != nil && strings.TrimSpace(orders[i]) != "" {
+			return nil, nil, httpError(http.StatusBadRequest, "invalid order %q: %v", orders[i], err)
+		}
+		if err != nil {
+			order = len(values) + i
+		}
+		rows = append(rows, row{old: olds[i], value: strings.Join(strings.Fields(values[i]), " "), order: order})
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].order < rows[j].order })
+
+	var options []string
+	var renames []choiceRename
+	for _, row := range rows {
+		if row.value == "" {
+			continue
+		}
+		if !slices.Contains(options, row.value) {
+			options = append(options, row.value)
+		}
+		if row.old != "" && row.old != row.value {
+			renames = append(renames, choiceRename{From: row.old, To: row.value})
+		}
+	}
+	if len(options) == 0 {
+		return nil, nil, httpError(http.StatusBadRequest, "at least one option is required")
+	}
+
+	// Renames run concurrently, so a chain like a swap would mix them up.
+	for _, rename := range renames {
+		if slices.ContainsFunc(renames, func(other choiceRename) bool { return other.From == rename.To }) {
+			return nil, nil, httpError(http.StatusBadRequest, "%q is renamed too, rename it in a separate save", rename.To)
+		}
+	}
+	return options, renames, nil
+}
+
+// Edits the options of the select fields: reordering, renaming, adding and
+// dropping them. Renames are migrated on existing entities in the background.
+func choicesHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	action := getValue(r, "action")
+	message := ""
+
+	if action != "" && r.Method != "POST" {
+		return "", httpError(http.StatusMethodNotAllowed, "action %q requires POST", action)
+	}
+
+	switch action {
+	case "":
+	case "save", "reset":
+		name := getValue(r, "field")
+		if !slices.Contains(choiceFields(), name) {
+			return "", httpError(http.StatusBadRequest, "unknown select field %q", name)
+		}
+		key := datastore.NameKey("ChoiceList", name, nil)
+
+		if action == "reset" {
+			err := store.Delete(ctx, key)
+			if err != nil {
+				return "", fmt.Errorf("failed to delete choice list %v: %v", key, err)
+			}
+			message = fmt.Sprintf("Restored the default %s options, existing entities are unchanged", name)
+			break
+		}
+
+		options, renames, err := parseChoiceForm(r)
+		if err != nil {
+			return "", err
+		}
+		_, err = store.Put(ctx, key, &ChoiceList{Values: options, Updated: time.Now()})
+		if err != nil {
+			return "", fmt.Errorf("failed to put choice list %v: %v", key, err)
+		}
+		message = fmt.Sprintf("Saved %s options", name)
+
+		if len(renames) > 0 {
+			tasks := make([]*taskqueue.Task, len(renames))
+			for i, rename := range renames {
+				tasks[i] = renameChoiceTask(name, rename.From, rename.To, nil)
+			}
+			resp, err := addTasks(ctx, tasks)
+			if err != nil {
+				return "", err
+			}
+			message += ". " + resp
+		}
+	default:
+		return "", fmt.Errorf("unknown choices action %q", action)
+	}
+
+	var lists []*ChoiceList
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "ChoiceList"}, &lists)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch choice lists: %v", err)
+	}
+	data := &choicesData{Message: message, CSRF: csrfToken(ctx)}
+	for _, name := range choiceFields() {
+		row := choiceListRow{Field: name}
+		values := defaultChoices[name]
+		if i := slices.IndexFunc(lists, func(l *ChoiceList) bool { return l.Key.Name == name }); i >= 0 && len(lists[i].Values) > 0 {
+			values = lists[i].Values
+			row.Saved = true
+		}
+		for i, v := range values {
+			row.Options = append(row.Options, choiceOption{Value: v, Order: (i + 1) * 10})
+		}
+		data.Lists = append(data.Lists, row)
+	}
+
+	return renderPage(ctx, "choices", data)
+}
@@ -1,41 +1,59 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
-	"html"
+	"html/template"
 	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
 )
 
-func contactView(contact *Entity) string {
-	var buffer bytes.Buffer
-
-	text := html.EscapeString(contact.ContactText)
-	if strings.HasPrefix(text, "http") {
-		text = fmt.Sprintf(`
-			<a href="%s" target="_blank">%s</a>
-		`, text, text)
-	}
-
-	buffer.WriteString(fmt.Sprintf(`
-		<div class="%s">
-			<a href="%s" class="edit-link">Edit</a>
-			<span class="thing %s">%s</span>
-	`,
-		contact.enabledClass(),
-		contact.editURL(),
-		contact.Key.Kind,
-		text))
-
-	buffer.WriteString(fmt.Sprintf(`
-			<span class="tag">(%s %s) [%s]</span><br>
-			<div class="comments">%s</div>
-		</div>
-	`, contact.ContactMethod,
-		contact.ContactType,
-		contact.enabledText(),
-		html.EscapeString(contact.Comments),
-	))
-
-	return buffer.String()
+// Email address, phone number or web address of its parent Person.
+type Contact struct {
+	Key           *datastore.Key `datastore:"__key__"`
+	ContactMethod string         `datastore:"contact_method,omitempty" form:"select"`
+	ContactType   string         `datastore:"contact_type,omitempty" form:"select"`
+	ContactText   string         `datastore:"contact_text,omitempty"`
+	BounceCount   int            `datastore:"bounce_count,omitempty"` // Updated by `/_ah/bounce`.
+	LastBounce    time.Time      `datastore:"last_bounce,omitempty" hint:"YYYY-MM-DD"`
+	Common
+}
+
+func (contact *Contact) key() *datastore.Key {
+	return contact.Key
+}
+
+func (contact *Contact) common() *Common {
+	return &contact.Common
+}
+
+func (contact *Contact) LoadKey(key *datastore.Key) error {
+	contact.Key = key
+	return nil
+}
+
+func (contact *Contact) Load(props []datastore.Property) error {
+	return loadModelProperties(contact, props)
+}
+
+func (contact *Contact) Save() ([]datastore.Property, error) {
+	return saveModelProperties(contact)
+}
+
+func (contact *Contact) words() []string {
+	return modelWords(contact)
+}
+
+func (contact *Contact) view() (template.HTML, error) {
+	return render("Contact", contact)
+}
+
+func (contact *Contact) fix() {
+	// After other fixes, lastly.
+	contact.Words = contact.words()
+}
+
+// Whether the contact text is a web address to be rendered as a link.
+func (contact *Contact) isLink() bool {
+	return strings.HasPrefix(contact.ContactText, "http")
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Browser session cookie holding the CSRF token, which every state-changing
+// form submits back in a hidden field of the same name.
+const CSRF_COOKIE = "csrf"
+const CSRF_FIELD = "csrf"
+
+type csrfContextKey struct{}
+
+// Returns a context carrying the session CSRF token, setting the cookie for a new session.
+func withCSRFToken(w http.ResponseWriter, r *http.Request, ctx context.Context) (context.Context, error) {
+	cookie, err := r.Cookie(CSRF_COOKIE)
+	if err == nil && cookie.Value != "" {
+		return context.WithValue(ctx, csrfContextKey{}, cookie.Value), nil
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate csrf token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRF_COOKIE,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   !isDev(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return context.WithValue(ctx, csrfContextKey{}, token), nil
+}
+
+func csrfToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfContextKey{}).(string)
+	return token
+}
+
+// Verifies that the submitted form token matches the session cookie.
+func checkCSRF(r *http.Request) error {
+	cookie, err := r.Cookie(CSRF_COOKIE)
+	if err != nil || cookie.Value == "" {
+		return fmt.Errorf("missing csrf cookie")
+	}
+	token := r.PostFormValue(CSRF_FIELD)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+		return fmt.Errorf("invalid csrf token")
+	}
+	return nil
+}
+
+// Middleware that verifies the CSRF token of browser POSTs, and adds the session
+// token to the request context. Cron and task queue requests have no session,
+// while users must POST to run a task.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isCronOrTaskQueue(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/task/") && r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, fmt.Sprintf("use POST to run task %q", r.URL.Path), http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == "POST" {
+			err := checkCSRF(r)
+			if err != nil {
+				errorPage(w, r, httpError(http.StatusForbidden, "failed to verify request %q: %v", r.URL.Path, err))
+				return
+			}
+		}
+
+		ctx, err := withCSRFToken(w, r, r.Context())
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
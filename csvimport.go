@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/appengine/v2/taskqueue"
+)
+
+// Rows per import chunk, each imported by one task.
+const IMPORT_CHUNK_ROWS = 100
+
+// Rows shown by the import preview.
+const IMPORT_PREVIEW_ROWS = 5
+
+// An uploaded CSV file. Each column maps to an import target, see `importTargets`.
+type Import struct {
+	Key     *datastore.Key `datastore:"__key__"`
+	Created time.Time      `datastore:"created"`
+	Name    string         `datastore:"name,noindex"`
+	Header  []string       `datastore:"header,noindex"`
+	Mapping []string       `datastore:"mapping,noindex"` // Target per column, empty to ignore.
+	Rows    int            `datastore:"rows,noindex"`
+	Chunks  int            `datastore:"chunks,noindex"`
+	Started time.Time      `datastore:"started,noindex"`
+}
+
+// Up to `IMPORT_CHUNK_ROWS` CSV rows of an import, keyed by 1-based index.
+type ImportChunk struct {
+	First   int      `datastore:"first,noindex"` // Row number of the first row, counting the header as row 1.
+	CSV     string   `datastore:"csv,noindex"`
+	Done    bool     `datastore:"done,noindex"`
+	Saved   int      `datastore:"saved,noindex"` // Records handled, where a retried task resumes.
+	Created int      `datastore:"created,noindex"`
+	Errors  []string `datastore:"errors,noindex"`
+}
+
+// Whether a CSV value can set the field: text, yes/no, date and tags fields
+// of the edit form, but not the key or hidden fields such as the location.
+func importable(field reflect.StructField) bool {
+	if field.Name == "Key" || field.Anonymous || field.Tag.Get("form") == "hidden" {
+		return false
+	}
+	switch {
+	case field.Type.Kind() == reflect.String, field.Type.Kind() == reflect.Bool:
+		return true
+	case field.Type == reflect.TypeFor[time.Time](), field.Tag.Get("form") == "tags":
+		return true
+	}
+	return false
+}
+
+// Import targets are `Kind.Field` for Person and Address fields, and
+// `Contact.<ContactType>` for a Contact of that type.
+func importTargets(choices map[string][]string) []string {
+	var targets []string
+	for _, m := range []model{&Person{}, &Address{}} {
+		t := reflect.TypeOf(m).Elem()
+		kind := t.Name()
+		for i := 0; i < t.NumField(); i++ {
+			if field := t.Field(i); importable(field) {
+				targets = append(targets, kind+"."+field.Name)
+			}
+		}
+		targets = append(targets, kind+".Comments")
+	}
+	for _, contactType := range choices["ContactType"] {
+		if contactType != UNSPECIFIED_CHOICE {
+			targets = append(targets, "Contact."+contactType)
+		}
+	}
+	return targets
+}
+
+// Header spellings commonly found in exported spreadsheets.
+var importSynonyms = map[string]string{
+	"first":        "Person.FirstName",
+	"givenname":    "Person.FirstName",
+	"last":         "Person.LastName",
+	"surname":      "Person.LastName",
+	"familyname":   "Person.LastName",
+	"company":      "Person.CompanyName",
+	"organization": "Person.CompanyName",
+	"notes":        "Person.Comments",
+	"address":      "Address.AddressLine1",
+	"street":       "Address.AddressLine1",
+	"street2":      "Address.AddressLine2",
+	"state":        "Address.StateProvince",
+	"province":     "Address.StateProvince",
+	"region":       "Address.StateProvince",
+	"zip":          "Address.PostalCode",
+	"zipcode":      "Address.PostalCode",
+	"postcode":     "Address.PostalCode",
+	"email":        "Contact.Email",
+	"emailaddress": "Contact.Email",
+	"phone":        "Contact.Voice",
+	"telephone":    "Contact.Voice",
+	"cell":         "Contact.Mobile",
+	"website":      "Contact.URL",
+	"fax":          "Contact.Facsimile",
+}
+
+// Guesses the target of a column from its header, or returns "".
+func guessImportTarget(header string, choices map[string][]string) string {
+	normalized := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, strings.ToLower(header))
+
+	if target, ok := importSynonyms[normalized]; ok {
+		return target
+	}
+	for _, target := range importTargets(choices) {
+		_, name, _ := strings.Cut(target, ".")
+		if strings.ToLower(name) == normalized {
+			return target
+		}
+	}
+	return ""
+}
+
+func parseImportBool(v string) (bool, error) {
+	switch strings.ToLower(v) {
+	case "", "0", "n", "no", "false":
+		return false, nil
+	case "1", "x", "y", "yes", "true":
+		return true, nil
+	}
+	return false, fmt.Errorf("not a yes/no value")
+}
+
+// Sets the named field from a CSV value.
+func setImportField(m model, name string, v string, choices map[string][]string) error {
+	field, ok := reflect.TypeOf(m).Elem().FieldByName(name)
+	if !ok || !importable(field) {
+		return fmt.Errorf("unknown field %s", name)
+	}
+	value := reflect.ValueOf(m).Elem().FieldByIndex(field.Index)
+
+	if field.Type.Kind() == reflect.Bool {
+		b, err := parseImportBool(v)
+		if err != nil {
+			return fmt.Errorf("%s %q: %v", name, v, err)
+		}
+		value.SetBool(b)
+	} else if field.Type == reflect.TypeFor[time.Time]() {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return fmt.Errorf("%s %q: expected YYYY-MM-DD", name, v)
+		}
+		value.Set(reflect.ValueOf(t))
+	} else if field.Tag.Get("form") == "tags" {
+		value.Set(reflect.ValueOf(parseTags(v)))
+	} else if field.Tag.Get("form") == "select" {
+		i := slices.IndexFunc(choices[name], func(c string) bool { return strings.EqualFold(c, v) })
+		if i < 0 {
+			return fmt.Errorf("%s %q: expected one of %q", name, v, choices[name])
+		}
+		value.SetString(choices[name][i])
+	} else {
+		value.SetString(v)
+	}
+	return nil
+}
+
+// One CSV row as the Person, Address and Contacts it creates.
+type importRow struct {
+	Row      int
+	Person   *Person
+	Address  *Address
+	Contacts []*Contact
+	Error    string
+}
+
+// Same defaults as the edit form.
+var importDefaults = Common{Enabled: true}
+
+// Spreadsheets often end with rows of empty cells.
+func isBlankRecord(record []string) bool {
+	return !slices.ContainsFunc(record, func(v string) bool { return strings.TrimSpace(v) != "" })
+}
+
+func mapImportRow(choices map[string][]string, mapping []string, row int, record []string) *importRow {
+	result := &importRow{Row: row, Person: &Person{Key: datastore.IncompleteKey("Person", nil), Common: importDefaults}}
+	var errors []string
+	for i, v := range record {
+		v = strings.TrimSpace(v)
+		if i >= len(mapping) || mapping[i] == "" || v == "" {
+			continue
+		}
+
+		kind, name, _ := strings.Cut(mapping[i], ".")
+		var err error
+		switch kind {
+		case "Person":
+			err = setImportField(result.Person, name, v, choices)
+		case "Address":
+			if result.Address == nil {
+				result.Address = &Address{Key: datastore.IncompleteKey("Address", nil), Common: importDefaults}
+			}
+			err = setImportField(result.Address, name, v, choices)
+		case "Contact":
+			result.Contacts = append(result.Contacts, &Contact{
+				Key:         datastore.IncompleteKey("Contact", nil),
+				ContactType: name,
+				ContactText: v,
+				Common:      importDefaults,
+			})
+		default:
+			err = fmt.Errorf("unknown target %q", mapping[i])
+		}
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if result.Person.displayName() == "" {
+		errors = append(errors, "no name")
+	}
+	result.Error = strings.Join(errors, "; ")
+	return result
+}
+
+// Saves the Person with its Address and Contacts, unless a retried task
+// already did, recording the record `i` of the chunk as handled in the same
+// transaction. Updates `chunk` to the stored progress.
+func (row *importRow) save(ctx context.Context, store Store, chunkKey *datastore.Key, chunk *ImportChunk, i int) error {
+	var models []model
+	if row.Error == "" {
+		row.Person.fix()
+		models = append(models, row.Person)
+		if row.Address != nil {
+			models = append(models, row.Address)
+		}
+		for _, contact := range row.Contacts {
+			models = append(models, contact)
+		}
+
+		// Transactions only write complete keys.
+		keys, err := store.AllocateIDs(ctx, []*datastore.Key{row.Person.Key})
+		if err != nil {
+			return fmt.Errorf("failed to allocate a key for row %d: %v", row.Row, err)
+		}
+		row.Person.Key = keys[0]
+		var childKeys []*datastore.Key
+		for _, child := range models[1:] {
+			childKeys = append(childKeys, datastore.IncompleteKey(child.key().Kind, row.Person.Key))
+		}
+		childKeys, err = store.AllocateIDs(ctx, childKeys)
+		if err != nil {
+			return fmt.Errorf("failed to allocate keys for row %d: %v", row.Row, err)
+		}
+		for j, child := range models[1:] {
+			child.LoadKey(childKeys[j])
+			child.fix()
+		}
+	}
+
+	var saved ImportChunk
+	err := store.RunInTransaction(ctx, func(tx Transaction) error {
+		saved = ImportChunk{}
+		err := tx.Get(chunkKey, &saved)
+		if err != nil {
+			return err
+		}
+		if saved.Saved > i {
+			return nil
+		}
+		for _, m := range models {
+			err = tx.Put(m.key(), m)
+			if err != nil {
+				return err
+			}
+		}
+		if row.Error != "" {
+			saved.Errors = append(saved.Errors, fmt.Sprintf("row %d: %s", row.Row, row.Error))
+		} else {
+			saved.Created++
+		}
+		saved.Saved = i + 1
+		return tx.Put(chunkKey, &saved)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save row %d: %v", row.Row, err)
+	}
+	*chunk = saved
+	return nil
+}
+
+func parseImportChunk(chunk *ImportChunk) ([][]string, error) {
+	reader := csv.NewReader(strings.NewReader(chunk.CSV))
+	reader.FieldsPerRecord = -1
+	return reader.ReadAll()
+}
+
+// Stores the uploaded CSV file as an Import with its rows in chunks.
+func uploadImport(ctx context.Context, store Store, name string, file io.Reader) (*Import, error) {
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, "failed to parse CSV: %v", err)
+	}
+	if len(records) < 2 {
+		return nil, httpError(http.StatusBadRequest, "expected a header row and at least one data row")
+	}
+
+	imp := &Import{
+		Created: time.Now(),
+		Name:    name,
+		Header:  records[0],
+		Rows:    len(records) - 1,
+		Chunks:  (len(records) - 1 + IMPORT_CHUNK_ROWS - 1) / IMPORT_CHUNK_ROWS,
+	}
+	choices, err := fetchChoices(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range imp.Header {
+		imp.Mapping = append(imp.Mapping, guessImportTarget(header, choices))
+	}
+	key, err := store.Put(ctx, datastore.IncompleteKey("Import", nil), imp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put import: %v", err)
+	}
+	imp.Key = key
+
+	var keys []*datastore.Key
+	var chunks []ImportChunk
+	for start := 1; start < len(records); start += IMPORT_CHUNK_ROWS {
+		var buffer bytes.Buffer
+		writer := csv.NewWriter(&buffer)
+		err = writer.WriteAll(records[start:min(start+IMPORT_CHUNK_ROWS, len(records))])
+		if err != nil {
+			return nil, fmt.Errorf("failed to write chunk: %v", err)
+		}
+		keys = append(keys, datastore.IDKey("ImportChunk", int64(len(keys)+1), key))
+		chunks = append(chunks, ImportChunk{First: start + 1, CSV: buffer.String()})
+	}
+	_, err = store.PutMulti(ctx, keys, chunks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put %d import chunks: %v", len(keys), err)
+	}
+	return imp, nil
+}
+
+func fetchImportChunks(ctx context.Context, store Store, imp *Import) ([]ImportChunk, error) {
+	var chunks []ImportChunk
+	_, err := store.QueryChildren(ctx, imp.Key, "ImportChunk", &chunks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chunks of import %v: %v", imp.Key, err)
+	}
+	return chunks, nil
+}
+
+// Saves the column mapping, and with `start` marks the import started, unless
+// it already was, in which case the mapping no longer changes.
+func updateImport(ctx context.Context, store Store, imp *Import, start bool) error {
+	var saved Import
+	started := false
+	err := store.RunInTransaction(ctx, func(tx Transaction) error {
+		saved = Import{}
+		err := tx.Get(imp.Key, &saved)
+		started = !saved.Started.IsZero()
+		if err != nil || started {
+			return err
+		}
+		saved.Mapping = imp.Mapping
+		if start {
+			saved.Started = time.Now()
+		}
+		return tx.Put(imp.Key, &saved)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update import %v: %v", imp.Key, err)
+	}
+	if started {
+		return httpError(http.StatusConflict, "import %q already started %s", saved.Name, saved.Started.Format("2006-01-02 15:04"))
+	}
+	*imp = saved
+	return nil
+}
+
+// Marks the import started and queues one task per chunk.
+func startImport(ctx context.Context, store Store, imp *Import) (string, error) {
+	var buffer bytes.Buffer
+
+	err := updateImport(ctx, store, imp, true)
+	if err != nil {
+		return "", err
+	}
+
+	// https://cloud.google.com/appengine/docs/standard/quotas#Task_Queue
+	MAX_TASKS_PER_BATCH := 100
+
+	var tasks []*taskqueue.Task
+	for chunk := 1; chunk <= imp.Chunks; chunk++ {
+		path, err := url.JoinPath("/task/import", imp.Key.Encode(), strconv.Itoa(chunk))
+		if err != nil {
+			return "", fmt.Errorf("failed to join path: %v", err)
+		}
+		tasks = append(tasks, taskqueue.NewPOSTTask(path, nil))
+	}
+	for batch := range slices.Chunk(tasks, MAX_TASKS_PER_BATCH) {
+		resp, err := addTasks(ctx, batch)
+		if err != nil {
+			return "", fmt.Errorf("failed to add import tasks: %v", err)
+		}
+		buffer.WriteString(resp + "\n")
+	}
+	return buffer.String(), nil
+}
+
+func taskImportHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	var buffer bytes.Buffer
+
+	importKey, err := datastore.DecodeKey(r.PathValue("import"))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode import key %q: %v", r.PathValue("import"), err)
+	}
+	id, err := strconv.ParseInt(r.PathValue("chunk"), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid chunk %q: %v", r.PathValue("chunk"), err)
+	}
+	chunkKey := datastore.IDKey("ImportChunk", id, importKey)
+
+	imp := &Import{}
+	err = store.Get(ctx, importKey, imp)
+	if err != nil {
+		return "", fmt.Errorf("failed to get import %v: %v", importKey, err)
+	}
+	chunk := &ImportChunk{}
+	err = store.Get(ctx, chunkKey, chunk)
+	if err != nil {
+		return "", fmt.Errorf("failed to get import chunk %v: %v", chunkKey, err)
+	}
+	if chunk.Done {
+		return fmt.Sprintf("Chunk %d already imported", chunkKey.ID), nil
+	}
+
+	records, err := parseImportChunk(chunk)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse import chunk %v: %v", chunkKey, err)
+	}
+	choices, err := fetchChoices(ctx, store)
+	if err != nil {
+		return "", err
+	}
+	for i, record := range records {
+		if i < chunk.Saved || isBlankRecord(record) {
+			continue
+		}
+		row := mapImportRow(choices, imp.Mapping, chunk.First+i, record)
+		// Failed writes are retried by the task queue, resuming after the saved rows.
+		err = row.save(ctx, store, chunkKey, chunk, i)
+		if err != nil {
+			return "", err
+		}
+		if row.Error == "" {
+			buffer.WriteString(fmt.Sprintf("%4d: %v %s\n", row.Row, row.Person.Key, row.Person.displayName()))
+		}
+	}
+
+	chunk.Done = true
+	_, err = store.Put(ctx, chunkKey, chunk)
+	if err != nil {
+		return "", fmt.Errorf("failed to put import chunk %v: %v", chunkKey, err)
+	}
+	buffer.WriteString(fmt.Sprintf("Created %d, %d errors\n", chunk.Created, len(chunk.Errors)))
+	return buffer.String(), nil
+}
+
+type importColumn struct {
+	Index   int
+	Header  string
+	Samples []string
+	Options []formOption
+}
+
+type importData struct {
+	Message string
+	Import  *Import
+	Columns []importColumn
+	Preview []*importRow
+	// Progress once started.
+	ChunksDone int
+	Created    int
+	Errors     []string
+	Imports    []*Import
+	CSRF       string
+}
+
+func importHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	data := &importData{CSRF: csrfToken(ctx)}
+
+	var imp *Import
+	if r.Method == "POST" && getValue(r, "action") == "upload" {
+		file, header, err := r.FormFile("csv")
+		if err != nil {
+			return "", httpError(http.StatusBadRequest, "failed to read uploaded file: %v", err)
+		}
+		defer file.Close()
+		imp, err = uploadImport(ctx, store, header.Filename, file)
+		if err != nil {
+			return "", err
+		}
+		data.Message = fmt.Sprintf("Uploaded %d rows, map the columns below", imp.Rows)
+	} else if key := getValue(r, "import"); key != "" {
+		dbkey, err := datastore.DecodeKey(key)
+		if err != nil {
+			return "", httpError(http.StatusBadRequest, "failed to decode import key %q: %v", key, err)
+		}
+		imp = &Import{}
+		err = store.Get(ctx, dbkey, imp)
+		if err != nil {
+			return "", fmt.Errorf("failed to get import %v: %v", dbkey, err)
+		}
+	}
+
+	if imp == nil {
+		_, err := store.GetAll(ctx, &storeQuery{Kind: "Import", Order: "-created", Limit: 10}, &data.Imports)
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch imports: %v", err)
+		}
+		return renderPage(ctx, "import", data)
+	}
+	data.Import = imp
+
+	if r.Method == "POST" && imp.Started.IsZero() {
+		action := getValue(r, "action")
+		if action == "preview" || action == "import" {
+			for i := range imp.Mapping {
+				imp.Mapping[i] = getValue(r, fmt.Sprintf("column%d", i))
+			}
+		}
+		if action == "preview" {
+			err := updateImport(ctx, store, imp, false)
+			if err != nil {
+				return "", err
+			}
+		}
+		if action == "import" {
+			resp, err := startImport(ctx, store, imp)
+			if err != nil {
+				return "", err
+			}
+			data.Message = resp
+		}
+	}
+
+	chunks, err := fetchImportChunks(ctx, store, imp)
+	if err != nil {
+		return "", err
+	}
+
+	if !imp.Started.IsZero() {
+		for _, chunk := range chunks {
+			if chunk.Done {
+				data.ChunksDone++
+			}
+			data.Created += chunk.Created
+			data.Errors = append(data.Errors, chunk.Errors...)
+		}
+		return renderPage(ctx, "import", data)
+	}
+
+	var records [][]string
+	if len(chunks) > 0 {
+		records, err = parseImportChunk(&chunks[0])
+		if err != nil {
+			return "", fmt.Errorf("failed to parse import chunk: %v", err)
+		}
+	}
+	records = records[:min(IMPORT_PREVIEW_ROWS, len(records))]
+
+	choices, err := fetchChoices(ctx, store)
+	if err != nil {
+		return "", err
+	}
+	targets := importTargets(choices)
+	for i, header := range imp.Header {
+		column := importColumn{Index: i, Header: header}
+		for _, record := range records {
+			if i < len(record) && record[i] != "" {
+				column.Samples = append(column.Samples, record[i])
+			}
+		}
+		column.Options = append(column.Options, formOption{Value: "", Selected: imp.Mapping[i] == ""})
+		for _, target := range targets {
+			column.Options = append(column.Options, formOption{Value: target, Selected: imp.Mapping[i] == target})
+		}
+		data.Columns = append(data.Columns, column)
+	}
+	for i, record := range records {
+		if isBlankRecord(record) {
+			continue
+		}
+		data.Preview = append(data.Preview, mapImportRow(choices, imp.Mapping, chunks[0].First+i, record))
+	}
+
+	return renderPage(ctx, "import", data)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testImportCSV = `First Name,Last Name,Email
+Jane,Doe,jane@example.com
+,,nobody@example.com
+Bob,Ray,bob@example.com
+`
+
+func importChunk(ctx context.Context, store Store, imp *Import, chunk string) (string, error) {
+	r := httptest.NewRequest("POST", "/task/import", nil)
+	r.SetPathValue("import", imp.Key.Encode())
+	r.SetPathValue("chunk", chunk)
+	return taskImportHandler(r, ctx, store)
+}
+
+func TestImportRetry(t *testing.T) {
+	ctx := context.Background()
+	store := &flakyStore{memoryStore: newMemoryStore()}
+	imp, err := uploadImport(ctx, store, "people.csv", strings.NewReader(testImportCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp.Mapping = []string{"Person.FirstName", "Person.LastName", "Contact.Email"}
+	_, err = startImport(ctx, store, imp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob fails to be saved, after Jane and the row without a name.
+	store.failAt = store.transactions + 3
+	_, err = importChunk(ctx, store, imp, "1")
+	if err == nil {
+		t.Fatal("failed write reported as done, so the queue won't retry it")
+	}
+	_, err = importChunk(ctx, store, imp, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var people []Person
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Person", Order: "first_name"}, &people)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 2 || people[0].FirstName != "Bob" || people[1].FirstName != "Jane" {
+		t.Errorf("imported %+v, want Bob and Jane once", people)
+	}
+	var contacts []Contact
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Contact"}, &contacts)
+	if err != nil || len(contacts) != 2 {
+		t.Errorf("imported %d contacts, %v, want 2", len(contacts), err)
+	}
+	chunks, err := fetchImportChunks(ctx, store, imp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chunks[0].Done || chunks[0].Created != 2 || len(chunks[0].Errors) != 1 {
+		t.Errorf("chunk %+v, want done with 2 created and 1 error", chunks[0])
+	}
+}
+
+func TestImportStartTwice(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	imp, err := uploadImport(ctx, store, "people.csv", strings.NewReader(testImportCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *imp
+
+	_, err = startImport(ctx, store, imp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = startImport(ctx, store, &stale)
+	if statusCode(err) != http.StatusConflict {
+		t.Errorf("second start = %v, want 409", err)
+	}
+	stale.Mapping = []string{"", "", ""}
+	err = updateImport(ctx, store, &stale, false)
+	if statusCode(err) != http.StatusConflict {
+		t.Errorf("mapping update after start = %v, want 409", err)
+	}
+}
+
+func TestImportPreviewHiddenFields(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	imp, err := uploadImport(ctx, store, "people.csv", strings.NewReader("First Name,Location,Geocoded\nJane,Springfield,yes\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.Mapping[0] != "Person.FirstName" || imp.Mapping[1] != "" || imp.Mapping[2] != "" {
+		t.Errorf("guessed mapping %q, want no hidden Address fields", imp.Mapping)
+	}
+	targets := importTargets(defaultChoices)
+	for _, hidden := range []string{"Address.Location", "Address.Geocoded", "Address.GeocodedBy", "Person.Words", "Person.Schema"} {
+		if slices.Contains(targets, hidden) {
+			t.Errorf("import targets include %s", hidden)
+		}
+	}
+
+	// A mapping posted by hand is refused per row.
+	r := postForm("/import", url.Values{"action": {"preview"}, "import": {imp.Key.Encode()}, "column0": {"Person.FirstName"}, "column1": {"Address.Location"}})
+	_, err = importHandler(r, ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := mapImportRow(defaultChoices, []string{"Person.FirstName", "Address.Location"}, 2, []string{"Jane", "Springfield"})
+	if !strings.Contains(row.Error, "unknown field Location") {
+		t.Errorf("row error %q, want the hidden field refused", row.Error)
+	}
+}
+
+func TestImportTargetsContactTypes(t *testing.T) {
+	for _, types := range [][]string{
+		{"Email", UNSPECIFIED_CHOICE, "Voice"},
+		{"Email"},
+		nil,
+	} {
+		targets := importTargets(map[string][]string{"ContactType": types})
+		var got []string
+		for _, target := range targets {
+			if contactType, ok := strings.CutPrefix(target, "Contact."); ok {
+				got = append(got, contactType)
+			}
+		}
+		want := slices.DeleteFunc(slices.Clone(types), func(v string) bool { return v == UNSPECIFIED_CHOICE })
+		if !slices.Equal(got, want) {
+			t.Errorf("contact targets of %q = %q, want %q", types, got, want)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/appengine/v2/taskqueue"
+)
+
+// Prefix of the Datastore properties holding `CustomField` values, which
+// keeps them apart from the fields of the kinds.
+const CUSTOM_PREFIX = "custom:"
+
+// Longest string Datastore indexes, in bytes.
+const MAX_INDEXED_BYTES = 1500
+
+// Entities examined by one `/task/custom/strip` request, before it continues in a new task.
+const STRIP_CUSTOM_BATCH = 100
+
+var customFieldTypes = []string{"text", "date", "bool", "select"}
+
+// An admin defined field of one kind, e.g. dietary restrictions of a Person.
+// Root entity. Values are saved as `custom:<Name>` properties of the entities.
+type CustomField struct {
+	Key     *datastore.Key `datastore:"__key__"`
+	Kind    string         `datastore:"kind"`
+	Name    string         `datastore:"name"`
+	Type    string         `datastore:"type"`
+	Options []string       `datastore:"options,noindex"` // For the select type.
+	Indexed bool           `datastore:"indexed"`         // Datastore indexed and searchable.
+	Created time.Time      `datastore:"created"`
+	Deleted bool           `datastore:"deleted,noindex"` // Its values are being removed by `/task/custom/strip`.
+}
+
+func (f *CustomField) property() string {
+	return CUSTOM_PREFIX + f.Name
+}
+
+// Value of the field from its form input, or nil when empty.
+func (f *CustomField) parse(v string) (any, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, nil
+	}
+	switch f.Type {
+	case "bool":
+		return true, nil
+	case "date":
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s date %q: %v", f.Name, v, err)
+		}
+		return t, nil
+	case "select":
+		if !slices.Contains(f.Options, v) {
+			return nil, fmt.Errorf("%s %q: expected one of %q", f.Name, v, f.Options)
+		}
+	}
+	return v, nil
+}
+
+// Custom fields of the kind, in the order they were defined, without the
+// deleted ones unless `withDeleted`.
+func queryCustomFields(ctx context.Context, store Store, kind string, withDeleted bool) ([]*CustomField, error) {
+	var fields []*CustomField
+	query := &storeQuery{Kind: "CustomField"}
+	if kind != "" {
+		query.Filters = map[string]any{"kind": kind}
+	}
+	_, err := store.GetAll(ctx, query, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch custom fields: %v", err)
+	}
+	if !withDeleted {
+		fields = slices.DeleteFunc(fields, func(f *CustomField) bool { return f.Deleted })
+	}
+	slices.SortStableFunc(fields, func(a, b *CustomField) int { return a.Created.Compare(b.Created) })
+	return fields, nil
+}
+
+func fetchCustomFields(ctx context.Context, store Store, kind string) ([]*CustomField, error) {
+	return queryCustomFields(ctx, store, kind, false)
+}
+
+func stripCustomFieldTask(field *datastore.Key, next *datastore.Key) *taskqueue.Task {
+	params := url.Values{"field": {field.Encode()}}
+	if next != nil {
+		params.Set("next", next.Encode())
+	}
+	return taskqueue.NewPOSTTask("/task/custom/strip", params)
+}
+
+// Removes the values of a deleted custom field, and their search words, from
+// a batch of entities, continuing after the last one in a new task. The field
+// itself is deleted after the last batch, so its name can't be added again
+// while old values remain.
+func taskStripCustomFieldHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	var buffer bytes.Buffer
+
+	key, err := datastore.DecodeKey(getValue(r, "field"))
+	if err != nil || key.Kind != "CustomField" {
+		return "", httpError(http.StatusBadRequest, "invalid custom field key %q", getValue(r, "field"))
+	}
+	f := &CustomField{}
+	err = store.Get(ctx, key, f)
+	if err == datastore.ErrNoSuchEntity {
+		return fmt.Sprintf("Custom field %v already removed", key), nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get custom field %v: %v", key, err)
+	}
+	if !f.Deleted {
+		return "", httpError(http.StatusBadRequest, "%s field %q isn't deleted", f.Kind, f.Name)
+	}
+
+	query := &storeQuery{Kind: f.Kind, Limit: STRIP_CUSTOM_BATCH}
+	if next := getValue(r, "next"); next != "" {
+		nextKey, err := datastore.DecodeKey(next)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode key %q: %v", next, err)
+		}
+		query.After = nextKey
+	}
+
+	var props []datastore.PropertyList
+	keys, err := store.GetAll(ctx, query, &props)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch %s entities: %v", f.Kind, err)
+	}
+	entities, err := loadModels(keys, props)
+	if err != nil {
+		return "", err
+	}
+
+	if len(entities) == STRIP_CUSTOM_BATCH {
+		buffer.WriteString("Adding continuation task\n")
+		resp, err := addTask(ctx, stripCustomFieldTask(key, keys[len(keys)-1]))
+		if err != nil {
+			return "", fmt.Errorf("failed to add continuation task: %v", err)
+		}
+		buffer.WriteString(resp + "\n")
+	}
+
+	var changedKeys []*datastore.Key
+	var changed []model
+	for i, m := range entities {
+		c := m.common()
+		if c.customValue(f.Name) == nil {
+			continue
+		}
+		c.Custom = slices.DeleteFunc(c.Custom, func(p datastore.Property) bool { return p.Name == f.property() })
+		m.fix()
+		changedKeys = append(changedKeys, keys[i])
+		changed = append(changed, m)
+		buffer.WriteString(fmt.Sprintf("%4d: %v\n", len(changed), keys[i]))
+	}
+	if len(changed) > 0 {
+		_, err = store.PutMulti(ctx, changedKeys, changed)
+		if err != nil {
+			return "", fmt.Errorf("failed to put %d stripped entities: %v", len(changed), err)
+		}
+	}
+	buffer.WriteString(fmt.Sprintf("Removed %s %q from %d of %d entities\n", f.Kind, f.Name, len(changed), len(entities)))
+
+	if len(entities) < STRIP_CUSTOM_BATCH {
+		err = store.Delete(ctx, key)
+		if err != nil {
+			return "", fmt.Errorf("failed to delete custom field %v: %v", key, err)
+		}
+		buffer.WriteString(fmt.Sprintf("Deleted %s field %q", f.Kind, f.Name))
+	}
+	return buffer.String(), nil
+}
+
+// Lowercase words of `s` joined by "_", usable as one search word.
+func searchSlug(s string) string {
+	return strings.Join(removeEmtpy(WORDS_RE.Split(strings.ToLower(s), -1)), "_")
+}
+
+// The stored value of a custom field, or nil.
+func (c *Common) customValue(name string) any {
+	for _, p := range c.Custom {
+		if p.Name == CUSTOM_PREFIX+name {
+			return p.Value
+		}
+	}
+	return nil
+}
+
+func formatCustomValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return formatDate(v)
+	case bool:
+		if v {
+			return "yes"
+		}
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+type customValue struct {
+	Name  string
+	Value string
+}
+
+// Custom values for views, by name.
+func (c *Common) customValues() []customValue {
+	var values []customValue
+	for _, p := range c.Custom {
+		if v := formatCustomValue(p.Value); v != "" {
+			values = append(values, customValue{Name: strings.TrimPrefix(p.Name, CUSTOM_PREFIX), Value: v})
+		}
+	}
+	slices.SortFunc(values, func(a, b customValue) int { return strings.Compare(a.Name, b.Name) })
+	return values
+}
+
+// Search words of the indexed custom values: the words of the value, and
+// `<name>=<value>` like select fields.
+func (c *Common) customWords() []string {
+	var words []string
+	for _, p := range c.Custom {
+		if p.NoIndex {
+			continue
+		}
+		name := searchSlug(strings.TrimPrefix(p.Name, CUSTOM_PREFIX))
+		switch v := p.Value.(type) {
+		case string:
+			words = append(words, WORDS_RE.Split(v, -1)...)
+			if word := name + "=" + searchSlug(v); len(word) <= MAX_INDEXED_BYTES {
+				words = append(words, word)
+			}
+		case bool:
+			if v {
+				words = append(words, name+"=true")
+			}
+		case time.Time:
+			words = append(words, v.Format("2006-01-02"))
+		}
+	}
+	return words
+}
+
+// Custom values of the entity from the edit form, for the given fields.
+func requestCustomValues(r *http.Request, fields []*CustomField) ([]datastore.Property, error) {
+	var props []datastore.Property
+	for _, f := range fields {
+		value, err := f.parse(r.Form.Get(f.property()))
+		if err != nil {
+			return nil, httpError(http.StatusBadRequest, "%v", err)
+		}
+		if value == nil {
+			continue
+		}
+		// Longer text is kept, but not searchable.
+		text, _ := value.(string)
+		noIndex := !f.Indexed || len(text) > MAX_INDEXED_BYTES
+		props = append(props, datastore.Property{Name: f.property(), Value: value, NoIndex: noIndex})
+	}
+	return props, nil
+}
+
+// Edit form inputs of the custom fields.
+func customFormFields(c *Common, fields []*CustomField) []formField {
+	var result []formField
+	for _, f := range fields {
+		value := c.customValue(f.Name)
+		ff := formField{Name: f.property(), Label: f.Name, Color: "blue"}
+		switch f.Type {
+		case "bool":
+			ff.Type = "checkbox"
+			ff.Checked = value == true
+		case "date":
+			ff.Type = "date"
+			ff.Value = formatCustomValue(value)
+			ff.Hint = "YYYY-MM-DD"
+		case "select":
+			ff.Type = "select"
+			current := formatCustomValue(value)
+			ff.Options = append(ff.Options, formOption{Value: "", Selected: current == ""})
+			for _, option := range f.Options {
+				ff.Options = append(ff.Options, formOption{Value: option, Selected: current == option})
+			}
+		default:
+			ff.Type = "text"
+			ff.Value = formatCustomValue(value)
+		}
+		result = append(result, ff)
+	}
+	return result
+}
+
+type customFieldsData struct {
+	Message string
+	Fields  []*CustomField
+	Kinds   []string
+	Types   []string
+	CSRF    string
+}
+
+// Defines custom fields per kind. Values of deleted fields are removed from
+// the entities in the background.
+func customFieldsHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	action := getValue(r, "action")
+	message := ""
+
+	if action != "" && r.Method != "POST" {
+		return "", httpError(http.StatusMethodNotAllowed, "action %q requires POST", action)
+	}
+
+	var options []string
+	for _, option := range strings.Split(getValue(r, "options"), ",") {
+		option = strings.Join(strings.Fields(option), " ")
+		if option != "" && !slices.Contains(options, option) {
+			options = append(options, option)
+		}
+	}
+
+	switch action {
+	case "":
+	case "add":
+		f := &CustomField{
+			Kind:    getValue(r, "kind"),
+			Name:    strings.Join(strings.Fields(getValue(r, "name")), " "),
+			Type:    getValue(r, "type"),
+			Options: options,
+			Indexed: getValue(r, "indexed") != "",
+			Created: time.Now(),
+		}
+		if !slices.Contains(kinds, f.Kind) {
+			return "", httpError(http.StatusBadRequest, "unknown kind %q, expected one of %q", f.Kind, kinds)
+		}
+		if !slices.Contains(customFieldTypes, f.Type) {
+			return "", httpError(http.StatusBadRequest, "unknown type %q, expected one of %q", f.Type, customFieldTypes)
+		}
+		if f.Name == "" {
+			return "", httpError(http.StatusBadRequest, "missing field name")
+		}
+		if f.Type == "select" && len(f.Options) == 0 {
+			return "", httpError(http.StatusBadRequest, "select fields need options")
+		}
+		existing, err := queryCustomFields(ctx, store, f.Kind, true)
+		if err != nil {
+			return "", err
+		}
+		if i := slices.IndexFunc(existing, func(e *CustomField) bool { return strings.EqualFold(e.Name, f.Name) }); i >= 0 && existing[i].Deleted {
+			return "", httpError(http.StatusBadRequest, "%s field %q is still being deleted", f.Kind, existing[i].Name)
+		} else if i >= 0 {
+			return "", httpError(http.StatusBadRequest, "%s already has a field %q", f.Kind, f.Name)
+		}
+		_, err = store.Put(ctx, datastore.IncompleteKey("CustomField", nil), f)
+		if err != nil {
+			return "", fmt.Errorf("failed to put custom field: %v", err)
+		}
+		message = fmt.Sprintf("Added %s field %q", f.Kind, f.Name)
+	case "save", "delete":
+		key, err := datastore.DecodeKey(getValue(r, "field"))
+		if err != nil || key.Kind != "CustomField" {
+			return "", httpError(http.StatusBadRequest, "invalid custom field key %q", getValue(r, "field"))
+		}
+		f := &CustomField{}
+		err = store.Get(ctx, key, f)
+		if err != nil {
+			return "", httpError(http.StatusNotFound, "failed to get custom field %v: %v", key, err)
+		}
+		if f.Deleted {
+			return "", httpError(http.StatusNotFound, "%s field %q is being deleted", f.Kind, f.Name)
+		}
+		if action == "delete" {
+			f.Deleted = true
+			_, err = store.Put(ctx, key, f)
+			if err != nil {
+				return "", fmt.Errorf("failed to put custom field %v: %v", key, err)
+			}
+			_, err = addTask(ctx, stripCustomFieldTask(key, nil))
+			if err != nil {
+				return "", err
+			}
+			message = fmt.Sprintf("Deleting %s field %q, its values are removed in the background", f.Kind, f.Name)
+			break
+		}
+		// Indexing changes apply as entities are saved again.
+		f.Indexed = getValue(r, "indexed") != ""
+		if f.Type == "select" {
+			if len(options) == 0 {
+				return "", httpError(http.StatusBadRequest, "select fields need options")
+			}
+			f.Options = options
+		}
+		_, err = store.Put(ctx, key, f)
+		if err != nil {
+			return "", fmt.Errorf("failed to put custom field %v: %v", key, err)
+		}
+		message = fmt.Sprintf("Saved %s field %q", f.Kind, f.Name)
+	default:
+		return "", httpError(http.StatusBadRequest, "unknown custom field action %q", action)
+	}
+
+	fields, err := fetchCustomFields(ctx, store, "")
+	if err != nil {
+		return "", err
+	}
+	slices.SortStableFunc(fields, func(a, b *CustomField) int {
+		return slices.Index(kinds, a.Kind) - slices.Index(kinds, b.Kind)
+	})
+
+	data := &customFieldsData{
+		Message: message,
+		Fields:  fields,
+		Kinds:   kinds,
+		Types:   customFieldTypes,
+		CSRF:    csrfToken(ctx),
+	}
+	return renderPage(ctx, "customfields", data)
+}
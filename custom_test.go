@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestRequestCustomValues(t *testing.T) {
+	fields := []*CustomField{
+		{Kind: "Person", Name: "Diet", Type: "text", Indexed: true},
+		{Kind: "Person", Name: "Story", Type: "text", Indexed: true},
+	}
+	r := postForm("/edit", url.Values{"custom:Diet": {"vegan"}, "custom:Story": {strings.Repeat("once upon a time ", 100)}})
+	props, err := requestCustomValues(r, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(props) != 2 || props[0].NoIndex || !props[1].NoIndex {
+		t.Errorf("custom values %+v, want the text over %d bytes unindexed", props, MAX_INDEXED_BYTES)
+	}
+	words := (&Common{Custom: props}).customWords()
+	if !slices.Contains(words, "diet=vegan") || slices.Contains(words, "upon") {
+		t.Errorf("custom words %q, want only the indexed value", words)
+	}
+}
+
+func TestDeleteCustomField(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	add := postForm("/customfields", url.Values{"action": {"add"}, "kind": {"Person"}, "name": {"Diet"}, "type": {"text"}, "indexed": {"on"}})
+	_, err := customFieldsHandler(add, ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := fetchCustomFields(ctx, store, "Person")
+	if err != nil || len(fields) != 1 {
+		t.Fatalf("fields %+v, %v, want the added one", fields, err)
+	}
+	person := &Person{Key: datastore.IncompleteKey("Person", nil), LastName: "Doe", Common: Common{
+		Enabled: true,
+		Custom:  []datastore.Property{{Name: "custom:Diet", Value: "vegan"}},
+	}}
+	person.fix()
+	personKey, err := saveModel(ctx, store, person)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = customFieldsHandler(postForm("/customfields", url.Values{"action": {"delete"}, "field": {fields[0].Key.Encode()}}), ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err = fetchCustomFields(ctx, store, "Person")
+	if err != nil || len(fields) != 0 {
+		t.Errorf("fields %+v, %v, want none after the delete", fields, err)
+	}
+	// The old values would show up as those of a new field of the name.
+	_, err = customFieldsHandler(add, ctx, store)
+	if statusCode(err) != http.StatusBadRequest {
+		t.Errorf("add while deleting = %v, want 400", err)
+	}
+
+	deleted, err := queryCustomFields(ctx, store, "Person", true)
+	if err != nil || len(deleted) != 1 {
+		t.Fatalf("fields %+v, %v, want the deleted one", deleted, err)
+	}
+	_, err = taskStripCustomFieldHandler(postForm("/task/custom/strip", url.Values{"field": {deleted[0].Key.Encode()}}), ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	person = &Person{}
+	err = store.Get(ctx, personKey, person)
+	if err != nil || person.customValue("Diet") != nil || slices.Contains(person.Words, "diet=vegan") || !slices.Contains(person.Words, "doe") {
+		t.Errorf("person %+v, %v, want the value and its words removed", person, err)
+	}
+	_, err = customFieldsHandler(add, ctx, store)
+	if err != nil {
+		t.Errorf("add after deleting = %v, want the name free again", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"slices"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Upcoming occasions within this many days are listed after today's.
+const DIGEST_DAYS = 7
+
+type digestEntry struct {
+	Date        time.Time // Next occurrence.
+	Days        int       // Days until the next occurrence.
+	Years       int       // Years since `FirstOccurrence`, or 0 when unknown.
+	Name        string
+	Event       Calendar
+	Person      Person
+	Phone       string
+	Email       string
+	Address     []string
+	ViewURL     string
+	EditURL     string
+	CardSentURL string
+}
+
+type digest struct {
+	Project  string
+	Date     time.Time
+	Today    []digestEntry
+	Upcoming []digestEntry
+}
+
+var digestFuncs = template.FuncMap{
+	"date": func(t time.Time) string { return t.Format("Mon Jan 2") },
+}
+
+// The page templates also parse `digest.html`, hence the prefixed "digest-entry".
+//
+//go:embed templates/digest.txt templates/digest.html
+var digestFS embed.FS
+
+var digestText = template.Must(template.New("digest.txt").Funcs(digestFuncs).ParseFS(digestFS, "templates/digest.txt"))
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("digest.html").Funcs(htmltemplate.FuncMap(digestFuncs)).ParseFS(digestFS, "templates/digest.html"))
+
+// Next annual occurrence of `first` on or after the date of `now`.
+func nextOccurrence(first time.Time, now time.Time) time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	next := time.Date(now.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.UTC)
+	if next.Before(today) {
+		next = next.AddDate(1, 0, 0)
+	}
+	return next
+}
+
+// Fills in the primary phone, email and address from the enabled children of the Person.
+func (entry *digestEntry) addContactDetails(ctx context.Context, store Store) error {
+	family, err := fetchFamily(ctx, store, entry.Person.Key)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range family {
+		if !m.common().Enabled {
+			continue
+		}
+		switch child := m.(type) {
+		case *Contact:
+			switch child.ContactType {
+			case "Mobile", "Voice":
+				if entry.Phone == "" {
+					entry.Phone = child.ContactText
+				}
+			case "Email":
+				if entry.Email == "" {
+					entry.Email = child.ContactText
+				}
+			}
+		case *Address:
+			if entry.Address == nil {
+				entry.Address = removeEmtpy(child.mailingLines())
+			}
+		}
+	}
+	return nil
+}
+
+func buildDigest(ctx context.Context, store Store, events []Calendar, now time.Time) (*digest, error) {
+	d := &digest{Project: projectID(), Date: now}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for _, event := range events {
+		if !event.Enabled || event.FirstOccurrence.IsZero() {
+			continue
+		}
+
+		next := nextOccurrence(event.FirstOccurrence, now)
+		days := int(next.Sub(today).Hours() / 24)
+		if days > DIGEST_DAYS {
+			continue
+		}
+
+		entry := digestEntry{Date: next, Days: days, Event: event}
+		if event.FirstOccurrence.Year() > 1 {
+			entry.Years = next.Year() - event.FirstOccurrence.Year()
+		}
+
+		err := store.Get(ctx, event.Key.Parent, &entry.Person)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get person for event %v: %v", event.Key, err)
+		}
+		err = entry.addContactDetails(ctx, store)
+		if err != nil {
+			return nil, err
+		}
+		entry.Name = entry.Person.displayName()
+		entry.ViewURL = entry.Person.viewURL()
+		entry.EditURL = editURL(&entry.Person)
+		entry.CardSentURL = actionURL(&event, "cardsent")
+
+		if days == 0 {
+			d.Today = append(d.Today, entry)
+		} else {
+			d.Upcoming = append(d.Upcoming, entry)
+		}
+	}
+
+	slices.SortStableFunc(d.Upcoming, func(a, b digestEntry) int { return a.Days - b.Days })
+	return d, nil
+}
+
+// Copy of the digest with only the entries for which `keep` returns true.
+func (d *digest) filter(keep func(entry *digestEntry) bool) *digest {
+	filtered := &digest{Project: d.Project, Date: d.Date}
+	for i := range d.Today {
+		if keep(&d.Today[i]) {
+			filtered.Today = append(filtered.Today, d.Today[i])
+		}
+	}
+	for i := range d.Upcoming {
+		if keep(&d.Upcoming[i]) {
+			filtered.Upcoming = append(filtered.Upcoming, d.Upcoming[i])
+		}
+	}
+	return filtered
+}
+
+func (d *digest) calendarKeys() []*datastore.Key {
+	var keys []*datastore.Key
+	for _, entry := range slices.Concat(d.Today, d.Upcoming) {
+		keys = append(keys, entry.Event.Key)
+	}
+	return keys
+}
+
+func (d *digest) empty() bool {
+	return len(d.Today) == 0 && len(d.Upcoming) == 0
+}
+
+func (d *digest) notification() (*Notification, error) {
+	var text, html bytes.Buffer
+	err := digestText.Execute(&text, d)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render text digest: %v", err)
+	}
+	err = digestHTML.Execute(&html, d)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render html digest: %v", err)
+	}
+
+	subject := fmt.Sprintf("%s %d today, %d upcoming", d.Project, len(d.Today), len(d.Upcoming))
+	if len(d.Today) > 0 {
+		subject = fmt.Sprintf("%s: %s %s", subject, d.Today[0].Name, d.Today[0].Event.Occasion)
+	}
+
+	return &Notification{
+		Subject:  subject,
+		Body:     text.String(),
+		HTMLBody: html.String(),
+	}, nil
+}
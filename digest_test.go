@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Compares `got` with the golden file `testdata/<name>`, rewriting it with -update.
+func checkGolden(t *testing.T, name string, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		err := os.WriteFile(path, []byte(got), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs, rerun with -update if intended:\n%s", name, got)
+	}
+}
+
+func TestDigestGolden(t *testing.T) {
+	t.Setenv(GOOGLE_CLOUD_PROJECT, "my-project")
+	t.Setenv(GAE_APPLICATION, "")
+	t.Setenv(PORT, "8080")
+	ctx := context.Background()
+	store := newMemoryStore()
+	now := time.Date(2024, 12, 1, 8, 0, 0, 0, time.UTC)
+	janeKey := addTestEvent(t, store, "Jane", "Doe", "Birthday", time.Date(1980, 12, 1, 0, 0, 0, 0, time.UTC))
+	addTestEvent(t, store, "Bob", "Ray", "Anniversary", time.Date(2010, 12, 5, 0, 0, 0, 0, time.UTC))
+	addTestEvent(t, store, "Ann", "Lee", "Name day", time.Date(1, 12, 3, 0, 0, 0, 0, time.UTC))
+
+	jane := &Calendar{}
+	err := store.Get(ctx, janeKey, jane)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jane.Comments = "Likes <b>tea</b> & cake"
+	_, err = saveModel(ctx, store, jane)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = saveModel(ctx, store, &Address{
+		Key:          datastore.IncompleteKey("Address", janeKey.Parent),
+		AddressLine1: "1 Main St",
+		City:         "Springfield",
+		PostalCode:   "12345",
+		Common:       Common{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Calendar
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Calendar"}, &events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := buildDigest(ctx, store, events, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification, err := d.notification()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "digest.golden.txt", notification.Body)
+	checkGolden(t, "digest.golden.html", notification.HTMLBody)
+}
+
+func TestNextOccurrence(t *testing.T) {
+	tests := []struct {
+		first time.Time
+		now   time.Time
+		want  time.Time
+	}{
+		{time.Date(1980, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 12, 1, 23, 0, 0, 0, time.UTC), time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(1980, 11, 30, 0, 0, 0, 0, time.UTC), time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 11, 30, 0, 0, 0, 0, time.UTC)},
+		// Feb 29 falls on Mar 1 outside leap years.
+		{time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		got := nextOccurrence(test.first, test.now)
+		if !got.Equal(test.want) {
+			t.Errorf("nextOccurrence(%v, %v) = %v, want %v", test.first, test.now, got, test.want)
+		}
+	}
+}
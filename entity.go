@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -17,110 +18,160 @@ import (
 
 var kinds = []string{"Person", "Address", "Contact", "Calendar"}
 
+// An entity of one of the `kinds`: a `Person` root entity, or one of its
+// `Address`, `Contact` and `Calendar` children. The edit form and the search
+// index are derived by reflection from the exported fields of the concrete
+// type, including the embedded `Common` ones.
 // https://cloud.google.com/go/docs/reference/cloud.google.com/go/datastore/latest
-type Entity struct {
-	Key *datastore.Key `forkind:"hidden" datastore:"__key__"`
-
-	// Person kind.
-	Category    string `forkind:"Person" datastore:"category,omitempty" form:"select"`
-	SendCard    bool   `forkind:"Person" datastore:"send_card,omitempty" default:"false"` // Default false.
-	Title       string `forkind:"Person" datastore:"title,omitempty"`
-	MailingName string `forkind:"Person" datastore:"mailing_name,omitempty"`
-	FirstName   string `forkind:"Person" datastore:"first_name,omitempty"`
-	LastName    string `forkind:"Person" datastore:"last_name,omitempty"`
-	CompanyName string `forkind:"Person" datastore:"company_name,omitempty"`
-
-	// Address kind.
-	AddressType   string `forkind:"Address" datastore:"address_type,omitempty" form:"select"`
-	AddressLine1  string `forkind:"Address" datastore:"address_line1,omitempty"`
-	AddressLine2  string `forkind:"Address" datastore:"address_line2,omitempty"`
-	City          string `forkind:"Address" datastore:"city,omitempty"`
-	StateProvince string `forkind:"Address" datastore:"state_province,omitempty"`
-	PostalCode    string `forkind:"Address" datastore:"postal_code,omitempty"`
-	Country       string `forkind:"Address" datastore:"country,omitempty"`
-
-	// Contact kind.
-	ContactMethod string `forkind:"Contact" datastore:"contact_method,omitempty" form:"select"`
-	ContactType   string `forkind:"Contact" datastore:"contact_type,omitempty" form:"select"`
-	ContactText   string `forkind:"Contact" datastore:"contact_text,omitempty"`
-
-	// Calendar kind.
-	FirstOccurrence time.Time `forkind:"Calendar" datastore:"first_occurrence,omitempty" hint:"YYYY-MM-DD"`
-	Frequency       string    `forkind:"Calendar" datastore:"frequency,omitempty" form:"select"`
-	Occasion        string    `forkind:"Calendar" datastore:"occasion,omitempty"`
-
-	// Common fields.
-	Comments string   `forkind:"" datastore:"comments,omitempty,noindex" form:"textarea"` // Not indexed.
-	Enabled  bool     `forkind:"" datastore:"enabled" default:"true"`                     // Default true.
-	Words    []string `forkind:"hidden" datastore:"words,omitempty"`
+type model interface {
+	datastore.KeyLoader
+	key() *datastore.Key
+	common() *Common
+	words() []string
+	fix()
+	view() (template.HTML, error) // Renders the template named after the kind.
 }
 
-func (entity *Entity) String() string {
-	jsonData, err := json.Marshal(entity)
+// Fields of every kind, embedded last so that they follow the kind's own
+// fields in the form. Datastore stores them as properties of the kind.
+type Common struct {
+	Custom   []datastore.Property `datastore:"-" form:"custom"`                            // Values of `CustomField`s, see `saveModelProperties`.
+	Comments string               `datastore:"comments,omitempty,noindex" form:"textarea"` // Not indexed.
+	Enabled  bool                 `datastore:"enabled" default:"true"`                     // Default true.
+	Words    []string             `datastore:"words,omitempty" form:"hidden"`
+	Schema   int                  `datastore:"schema,omitempty" form:"hidden"` // Version of the last applied `migration`, of the whole tree for a Person.
+}
+
+// An empty model of the key's kind, with the key.
+func newModel(key *datastore.Key) (model, error) {
+	switch key.Kind {
+	case "Person":
+		return &Person{Key: key}, nil
+	case "Address":
+		return &Address{Key: key}, nil
+	case "Contact":
+		return &Contact{Key: key}, nil
+	case "Calendar":
+		return &Calendar{Key: key}, nil
+	}
+	return nil, fmt.Errorf("unknown kind: %s", key.Kind)
+}
+
+// The `custom:` properties go to `Custom`, the others to the fields.
+func loadModelProperties(m model, props []datastore.Property) error {
+	c := m.common()
+	c.Custom = nil
+	var fields []datastore.Property
+	for _, p := range props {
+		if strings.HasPrefix(p.Name, CUSTOM_PREFIX) {
+			c.Custom = append(c.Custom, p)
+		} else {
+			fields = append(fields, p)
+		}
+	}
+	return datastore.LoadStruct(m, fields)
+}
+
+// Properties of the fields, followed by the `Custom` values.
+func saveModelProperties(m model) ([]datastore.Property, error) {
+	props, err := datastore.SaveStruct(m)
 	if err != nil {
-		log.Fatalf("Error entity to JSON: %v", err)
+		return nil, err
 	}
-	return string(jsonData)
+	props = slices.DeleteFunc(props, func(p datastore.Property) bool { return p.Name == "__key__" })
+	return append(props, m.common().Custom...), nil
 }
 
-var choices = map[string][]string{
-	"Category": {
-		"(Unspecified)",
-		"Relatives",
-		"Personal",
-		"Hospitality",  //"Hotel/Restaurant/Entertainment",
-		"Freelance",    //"Services by Individuals",
-		"Company",      //"Companies, Institutions, etc.",
-		"Professional", //"Business Relations",
-	},
-	"AddressType": {
-		"(Unspecified)",
-		"Home",
-		"Business",
-	},
-	"ContactMethod": {
-		"(Unspecified)",
-		"Personal",
-		"Business",
-	},
-	"ContactType": {
-		"(Unspecified)",
-		"Voice",
-		"Data",
-		"Email",
-		"Mobile",
-		"URL",
-		"Facsimile",
-	},
-	"Frequency": {
-		"Annual",
-	},
+// Loads the Person and all its descendants, the Person first.
+func fetchFamily(ctx context.Context, store Store, personKey *datastore.Key) ([]model, error) {
+	var props []datastore.PropertyList
+	keys, err := store.QueryChildren(ctx, personKey, "", &props)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all entities of %v: %v", personKey, err)
+	}
+	return loadModels(keys, props)
 }
 
-func requestToEntity(r *http.Request, ctx context.Context, client *datastore.Client) (entity *Entity, err error) {
+// Models of the kinds of the keys, for queries mixing kinds.
+func loadModels(keys []*datastore.Key, props []datastore.PropertyList) ([]model, error) {
+	var err error
+	models := make([]model, len(keys))
+	for i, key := range keys {
+		models[i], err = newModel(key)
+		if err != nil {
+			return nil, err
+		}
+		err = models[i].Load(props[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %v: %v", key, err)
+		}
+	}
+	return models, nil
+}
+
+// Fields of the model in declaration order, with the `Common` ones in place
+// of the embedded struct.
+func modelFields(m model) ([]reflect.StructField, reflect.Value) {
+	v := reflect.ValueOf(m).Elem()
+	var fields []reflect.StructField
+	for _, field := range reflect.VisibleFields(v.Type()) {
+		if !field.Anonymous {
+			fields = append(fields, field)
+		}
+	}
+	return fields, v
+}
+
+func modelString(m model) string {
+	jsonData, err := json.Marshal(m)
+	if err != nil {
+		log.Fatalf("Error entity to JSON: %v", err)
+	}
+	return string(jsonData)
+}
+
+func requestToModel(r *http.Request, ctx context.Context, store Store) (model, error) {
 	key := getValue(r, "key")
 	dbkey, err := datastore.DecodeKey(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode key %q: %v", key, err)
 	}
+	m, err := newModel(dbkey)
+	if err != nil {
+		return nil, err
+	}
 
 	if r.Method == "POST" {
-		e := &Entity{}
-
-		t := reflect.TypeFor[Entity]()
-		v := reflect.ValueOf(e).Elem()
-		for i := 0; i < t.NumField(); i++ {
-			field := t.Field(i)
-			value := v.Field(i)
+		fields, v := modelFields(m)
+		for _, field := range fields {
+			value := v.FieldByIndex(field.Index)
 
 			v := r.Form.Get(field.Name)
 			if field.Name == "Key" {
-				value.Set(reflect.ValueOf(dbkey))
-			} else if field.Tag.Get("forkind") == "hidden" {
+				continue
+			} else if field.Tag.Get("form") == "hidden" {
 				// Skip.
 				continue
+			} else if field.Tag.Get("form") == "custom" {
+				fields, err := fetchCustomFields(ctx, store, dbkey.Kind)
+				if err != nil {
+					return nil, err
+				}
+				m.common().Custom, err = requestCustomValues(r, fields)
+				if err != nil {
+					return nil, err
+				}
 			} else if field.Type.Kind() == reflect.Bool {
 				value.SetBool(v != "")
+			} else if field.Type.Kind() == reflect.Int {
+				n := 0
+				if v != "" {
+					n, err = strconv.Atoi(v)
+					if err != nil {
+						return nil, fmt.Errorf("failed to parse number %q: %v", v, err)
+					}
+				}
+				value.SetInt(int64(n))
 			} else if field.Type == reflect.TypeFor[time.Time]() {
 				t := time.Time{}
 				if v != "" {
@@ -131,39 +182,55 @@ func requestToEntity(r *http.Request, ctx context.Context, client *datastore.Cli
 				}
 				// log.Printf("DATE: %s == %v", field.Name, t)
 				value.Set(reflect.ValueOf(t))
+			} else if field.Tag.Get("form") == "tags" {
+				value.Set(reflect.ValueOf(parseTags(v)))
 			} else if field.Tag.Get("form") == "select" {
 				value.SetString(v)
 			} else {
 				value.SetString(v)
 			}
 		}
+		// Entered with the current code, so there is nothing to migrate. Not
+		// so the children of an existing Person, whose version stands for
+		// its tree, see `fixAllHandler`.
+		if dbkey.Kind != "Person" || dbkey.Incomplete() {
+			m.common().Schema = schemaVersion()
+		}
 
-		return e, nil
+		return m, nil
 	} else {
-		var e Entity
-		err = client.Get(ctx, dbkey, &e)
+		err = store.Get(ctx, dbkey, m)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get %s: %v", dbkey, err)
 		}
 
-		return &e, nil
+		return m, nil
 	}
 }
 
-func (entity *Entity) words() []string {
+func modelWords(m model) []string {
 	// Map prevents duplicate results.
 	results := make(map[string]struct{})
-	t := reflect.TypeFor[Entity]()
-	v := reflect.ValueOf(entity).Elem()
-	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
-		value := v.Field(i)
+	fields, v := modelFields(m)
+	for _, field := range fields {
+		value := v.FieldByIndex(field.Index)
 		if value.String() == "" {
 			// Skip.
 			continue
-		} else if field.Tag.Get("forkind") == "hidden" {
+		} else if field.Name == "Key" || field.Tag.Get("form") == "hidden" {
 			// Skip.
 			continue
+		} else if field.Tag.Get("form") == "custom" {
+			for _, word := range m.common().customWords() {
+				results[word] = struct{}{}
+			}
+		} else if field.Tag.Get("form") == "tags" {
+			for _, tag := range value.Interface().([]string) {
+				results[tagWord(tag)] = struct{}{}
+				for _, word := range WORDS_RE.Split(tag, -1) {
+					results[word] = struct{}{}
+				}
+			}
 		} else if field.Type.Kind() == reflect.Bool {
 			// Only act on true as unset fields will appear to be false.
 			if value.Bool() {
@@ -171,6 +238,12 @@ func (entity *Entity) words() []string {
 				// log.Printf("BOOL: %s == %v", field.Name, value)
 				results[word] = struct{}{}
 			}
+		} else if field.Type.Kind() == reflect.Int {
+			// Only act on non-zero as unset fields will appear to be zero.
+			if value.Int() != 0 {
+				word := fmt.Sprintf("%s=%d", field.Name, value.Int())
+				results[word] = struct{}{}
+			}
 		} else if field.Type == reflect.TypeFor[time.Time]() {
 			datevalue := value.Interface().(time.Time)
 			if !datevalue.IsZero() {
@@ -208,114 +281,81 @@ func (entity *Entity) words() []string {
 	return words
 }
 
-func (entity *Entity) fix() {
-	// After other fixes, lastly.
-	entity.Words = entity.words()
-}
-
-func (entity *Entity) save(ctx context.Context, client *datastore.Client) (*datastore.Key, error) {
-	key, err := client.Put(ctx, entity.Key, entity)
+func saveModel(ctx context.Context, store Store, m model) (*datastore.Key, error) {
+	key, err := store.Put(ctx, m.key(), m)
 	if err != nil {
-		return nil, fmt.Errorf("failed to put entity %v: %v", entity, err)
+		return nil, fmt.Errorf("failed to put entity %v: %v", modelString(m), err)
 	}
 
 	return key, nil
 }
 
-func (entity *Entity) enabledClass() string {
-	if entity.Enabled {
+func (c *Common) enabledClass() string {
+	if c.Enabled {
 		return ""
 	} else {
 		return "disabled"
 	}
 }
 
-func (entity *Entity) enabledText() string {
-	if entity.Enabled {
+func (c *Common) enabledText() string {
+	if c.Enabled {
 		return "Enabled"
 	} else {
 		return "DISABLED"
 	}
 }
 
-func (entity *Entity) sendCardText() string {
-	if entity.SendCard {
-		return "[SendCard]"
-	} else {
-		return ""
-	}
-}
-
-func (entity *Entity) actionURL(action string) string {
+func actionURL(m model, action string) string {
 	// Include origin for a fully qualified URL.
 	return fmt.Sprintf("%s/?action=%s&key=%s",
 		defaultVersionOrigin(),
 		action,
-		entity.Key.Encode(),
+		m.key().Encode(),
 	)
 }
 
-func (entity *Entity) viewURL() string {
-	return entity.actionURL("view")
+func editURL(m model) string {
+	return actionURL(m, "edit")
 }
 
-func (entity *Entity) editURL() string {
-	return entity.actionURL("edit")
+type formOption struct {
+	Value    string
+	Selected bool
 }
 
-func (person *Entity) displayName() string {
-	t := ""
-	if person.MailingName != "" {
-		t += fmt.Sprintf("[%s] ", person.MailingName)
-	}
-	if person.CompanyName != "" {
-		t += fmt.Sprintf("%s ", person.CompanyName)
-	}
-	if person.Title != "" {
-		t += person.Title + " "
-	}
-	if person.FirstName != "" {
-		t += person.FirstName + " "
-	}
-	if person.LastName != "" {
-		t += person.LastName
-	}
-	return strings.TrimSpace(t)
+// One row of the edit form. `Type` selects the input rendered by the `form` template.
+type formField struct {
+	Name    string
+	Label   string
+	Color   string
+	Type    string // One of `key`, `code`, `textarea`, `select`, `text`, `checkbox`, `number`, `date` or `other`.
+	Value   string
+	Hint    string
+	Checked bool
+	Options []formOption
+	Code    []string // Key details for admins.
 }
 
-func form(ctx context.Context, entity *Entity) string {
-	var buffer bytes.Buffer
-
-	buffer.WriteString(`
-		<hr>
-		<form name="myform" method="post" action=".">
-			<input type="hidden" name="action" value="edit">
-			<table>
-	`)
-	buffer.WriteString(formFields(ctx, entity))
-	buffer.WriteString(`
-				<tr><td></td><td><input type="submit" name="updated" value="Save" style="margin-top: 1em;"></td></tr>
-	`)
-	buffer.WriteString(`
-			</table>
-		</form>
-		<hr>
-	`)
-
-	if !entity.Key.Incomplete() && entity.Key.Kind == "Person" {
+type formData struct {
+	Fields     []formField
+	CreateKeys []*datastore.Key // Incomplete keys of children that can be created.
+	CSRF       string
+}
+
+func form(ctx context.Context, m model, choices map[string][]string, custom []*CustomField) (template.HTML, error) {
+	data := &formData{Fields: formFields(ctx, m, choices, custom), CSRF: csrfToken(ctx)}
+
+	key := m.key()
+	if !key.Incomplete() && key.Kind == "Person" {
 		for _, kind := range kinds {
-			if kind != entity.Key.Kind {
-				buffer.WriteString(createEntityLink(kind, entity.Key))
+			if kind != key.Kind {
+				data.CreateKeys = append(data.CreateKeys, datastore.IDKey(kind, 0, key))
 			}
 		}
 	}
 
-	return buffer.String()
-}
-
-func createEntityLink(kind string, parentKey *datastore.Key) string {
-	childkey := datastore.IDKey(kind, 0, parentKey)
-	return fmt.Sprintf(`<a href="?action=create&key=%s">[+%s]</a>&nbsp;`, childkey.Encode(), kind)
+	return render("form", data)
 }
 
 func keyLiteral(key *datastore.Key) string {
@@ -337,97 +377,95 @@ func keyLiteral(key *datastore.Key) string {
 	return fmt.Sprintf("Key(%s)", t)
 }
 
-func formFields(ctx context.Context, entity *Entity) string {
-	var buffer bytes.Buffer
-
-	t := reflect.TypeFor[Entity]()
-	v := reflect.ValueOf(entity).Elem()
-	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
-		value := v.Field(i)
-		label := field.Name
-		html := "?"
-		color := "blue"
+// Fields of the edit form, with the options of `fetchChoices` for selects and
+// an input per custom field of the kind.
+func formFields(ctx context.Context, m model, choices map[string][]string, custom []*CustomField) []formField {
+	var result []formField
+
+	key := m.key()
+	fields, v := modelFields(m)
+	for _, field := range fields {
+		value := v.FieldByIndex(field.Index)
+		f := formField{
+			Name:  field.Name,
+			Label: field.Name,
+			Color: "blue",
+			Type:  "other",
+			Hint:  field.Tag.Get("hint"),
+		}
 		if field.Name == "Words" {
-			color = "red"
+			f.Color = "red"
 		}
 
-		forkind := field.Tag.Get("forkind")
-		hint := field.Tag.Get("hint")
 		if field.Name == "Key" {
-			html = fmt.Sprintf(`<input type="hidden" name="key" value="%s">`,
-				entity.Key.Encode())
+			f.Type = "key"
+			f.Value = key.Encode()
 			if isAdmin(ctx) {
-				color = "gray"
-				html += fmt.Sprintf(`
-				<code>%s</code><br>
-				<code>%s</code><br>
-				<code>%s</code>
-				`,
-					value,
-					keyLiteral(entity.Key),
-					entity.Key.Encode(),
-				)
+				f.Color = "gray"
+				f.Code = []string{
+					fmt.Sprintf("%s", value),
+					keyLiteral(key),
+					key.Encode(),
+				}
 			}
-		} else if forkind == "hidden" {
+		} else if field.Tag.Get("form") == "hidden" {
 			if !isAdmin(ctx) {
 				continue
 			}
-			color = "gray"
-			html = fmt.Sprintf(`<code>%q</code>`, value)
-		} else if forkind != "" && forkind != entity.Key.Kind {
+			f.Color = "gray"
+			f.Type = "code"
+			f.Value = fmt.Sprintf("%v", value)
+			if field.Type.Kind() == reflect.Slice {
+				f.Value = fmt.Sprintf("%q", value)
+			}
+		} else if field.Tag.Get("form") == "custom" {
+			result = append(result, customFormFields(m.common(), custom)...)
 			continue
-			// color = "purple"
-			// html = fmt.Sprintf(`[SKIP] forkind=%s!=%s %s=%s`, forkind, entity.Key.Kind, field.Name, value)
 		} else if field.Tag.Get("form") == "textarea" {
-			html = fmt.Sprintf(`<textarea name="%s">%s</textarea>`, field.Name, value)
+			f.Type = "textarea"
+			f.Value = value.String()
+		} else if field.Tag.Get("form") == "tags" {
+			f.Type = "text"
+			f.Value = strings.Join(value.Interface().([]string), ", ")
 		} else if field.Tag.Get("form") == "select" {
-			values := choices[field.Name]
-			html = fmt.Sprintf(`<select name="%s" size="%d">`, field.Name, len(values))
-			for i, v := range values {
-				selected := ""
-				if value.String() == v {
-					selected = "selected"
-				} else if value.String() == "" && i == 0 {
-					selected = "selected"
-				}
-				html += fmt.Sprintf(`<option %s value="%s">%s</option>`, selected, v, v)
+			f.Type = "select"
+			for i, v := range choices[field.Name] {
+				selected := value.String() == v || (value.String() == "" && i == 0)
+				f.Options = append(f.Options, formOption{Value: v, Selected: selected})
+			}
+			// Keep an option dropped from the list, rather than losing it on save.
+			if value.String() != "" && !slices.Contains(choices[field.Name], value.String()) {
+				f.Options = append(f.Options, formOption{Value: value.String(), Selected: true})
 			}
-			html += `</select>`
 		} else if field.Type.Kind() == reflect.String {
-			html = fmt.Sprintf(`<input type="text" name="%s" value="%s" placeholder="%s">`, field.Name, value, hint)
+			f.Type = "text"
+			f.Value = value.String()
 		} else if field.Type.Kind() == reflect.Bool {
-			val := false
-			if !entity.Key.Incomplete() {
-				val = value.Bool()
+			f.Type = "checkbox"
+			if !key.Incomplete() {
+				f.Checked = value.Bool()
 			} else {
 				defval := field.Tag.Get("default")
 				v, err := strconv.ParseBool(defval)
 				if err != nil {
 					log.Fatalf("Failed to parse bool %q: %v", defval, err)
 				}
-				val = v
+				f.Checked = v
 			}
-
-			checked := ""
-			if val {
-				checked = "checked"
+		} else if field.Type.Kind() == reflect.Int {
+			f.Type = "number"
+			if value.Int() != 0 {
+				f.Value = strconv.FormatInt(value.Int(), 10)
 			}
-			html = fmt.Sprintf(`<input type="checkbox" name="%s" %s> %s`, field.Name, checked, label)
-			label = ""
 		} else if field.Type == reflect.TypeFor[time.Time]() {
-			datevalue := value.Interface().(time.Time)
-			date := ""
-			if !datevalue.IsZero() {
-				date = datevalue.Format("2006-01-02")
-			}
-			html = fmt.Sprintf(`<input type="text" style="width: 8em;" name="%s" value="%s" placeholder="%s">`, field.Name, date, hint)
+			f.Type = "date"
+			f.Value = formatDate(value.Interface().(time.Time))
 		} else {
-			html = fmt.Sprintf("<div>%v %v=%v</div>", field.Type, label, value)
+			f.Value = fmt.Sprintf("%v %v=%v", field.Type, f.Label, value)
 		}
 
-		buffer.WriteString(fmt.Sprintf(`<tr style="color: %s;"><td style="vertical-align: top; text-align: right;">%s</td><td>%s</td></tr>`, color, label, html))
+		result = append(result, f)
 	}
 
-	return buffer.String()
+	return result
 }
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/appengine/v2/taskqueue"
+)
+
+// Geocoder of the addresses: the URL of a Nominatim compatible search API,
+// e.g. `https://nominatim.openstreetmap.org/search`, or `stub` for the offline
+// stub in dev, where it is the default. Addresses aren't geocoded while unset.
+const GEOCODER = "GEOCODER"
+
+// Addresses geocoded per `/task/geocode/` batch.
+const GEOCODE_BATCH = 50
+
+// Search word prefix of the geohash of located addresses, e.g. `geo=9q9hvumnu`.
+// A prefix query on it finds the addresses in a geohash cell.
+const GEOHASH_WORD = "geo="
+const GEOHASH_PRECISION = 9 // Cells of about 5 m.
+
+const GEOHASH_BASE32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+const EARTH_RADIUS_KM = 6371.0
+
+type Geocoder interface {
+	// Location of the address, or nil when it can't be found.
+	Geocode(ctx context.Context, address *Address) (*datastore.GeoPoint, error)
+	// Stored with the locations, which another geocoder replaces.
+	Name() string
+}
+
+// Offline geocoder for dev and tests. Places the addresses of a postal code
+// and country at the same made up spot, with each address within about a
+// kilometer of it, so that nearby searches have something to find.
+type stubGeocoder struct{}
+
+// Queries the search API of `URL`, at most once per second as the usage
+// policy of the public Nominatim instance requires.
+// https://operations.osmfoundation.org/policies/nominatim/
+type httpGeocoder struct {
+	URL  string
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (g *stubGeocoder) Name() string {
+	return "stub"
+}
+
+func (g *stubGeocoder) Geocode(ctx context.Context, address *Address) (*datastore.GeoPoint, error) {
+	if address.PostalCode == "" && address.City == "" {
+		return nil, nil
+	}
+	area := stubFraction(address.PostalCode + "|" + address.City + "|" + address.Country)
+	spot := stubFraction(address.mapsQuery())
+	return &datastore.GeoPoint{
+		Lat: -50 + 110*area + 0.01*(spot-0.5),
+		Lng: -180 + 360*math.Mod(area*1000, 1) + 0.01*(math.Mod(spot*1000, 1)-0.5),
+	}, nil
+}
+
+// Fraction in [0, 1) derived from the hash of `s`.
+func stubFraction(s string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
+
+func (g *httpGeocoder) Name() string {
+	return g.URL
+}
+
+func (g *httpGeocoder) Geocode(ctx context.Context, address *Address) (*datastore.GeoPoint, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	time.Sleep(time.Until(g.last.Add(time.Second)))
+	g.last = time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	query := url.Values{"q": {address.mapsQuery()}, "format": {"jsonv2"}, "limit": {"1"}}
+	req, err := http.NewRequestWithContext(ctx, "GET", g.URL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create geocoder request: %v", err)
+	}
+	req.Header.Set("User-Agent", "PDA2GO "+projectID())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to GET geocoder %s: %v", g.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("geocoder %s responded %s", g.URL, resp.Status)
+	}
+
+	var places []struct {
+		Lat string `json:"lat"`
+		Lon string `json:"lon"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&places)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode geocoder response: %v", err)
+	}
+	if len(places) == 0 {
+		return nil, nil
+	}
+	lat, err := strconv.ParseFloat(places[0].Lat, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse latitude %q: %v", places[0].Lat, err)
+	}
+	lng, err := strconv.ParseFloat(places[0].Lon, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse longitude %q: %v", places[0].Lon, err)
+	}
+	return &datastore.GeoPoint{Lat: lat, Lng: lng}, nil
+}
+
+// Shared, so that the rate limit of the HTTP geocoder holds across requests.
+var geocoders sync.Map
+
+// The configured geocoder, or nil when addresses aren't geocoded.
+func newGeocoder() (Geocoder, error) {
+	config := os.Getenv(GEOCODER)
+	switch {
+	case (config == "" || config == "stub") && isDev():
+		return &stubGeocoder{}, nil
+	case config == "":
+		return nil, nil
+	case config == "stub":
+		return nil, fmt.Errorf("%s stub is only for dev, its locations are made up", GEOCODER)
+	case strings.HasPrefix(config, "http://") || strings.HasPrefix(config, "https://"):
+		geocoder, _ := geocoders.LoadOrStore(config, &httpGeocoder{URL: config})
+		return geocoder.(Geocoder), nil
+	default:
+		return nil, fmt.Errorf("invalid %s %q, expected stub or a URL", GEOCODER, config)
+	}
+}
+
+// Whether the address changed since it was last geocoded, or was geocoded by
+// another geocoder.
+func (address *Address) geocodeStale(geocoder Geocoder) bool {
+	return address.Geocoded != address.mapsQuery() || address.GeocodedBy != geocoder.Name()
+}
+
+// Geocodes the address when it changed. Not found addresses have no location
+// and aren't tried again until they change.
+func geocodeAddress(ctx context.Context, geocoder Geocoder, address *Address) error {
+	if !address.geocodeStale(geocoder) {
+		return nil
+	}
+	location, err := geocoder.Geocode(ctx, address)
+	if err != nil {
+		return fmt.Errorf("failed to geocode %q: %v", address.mapsQuery(), err)
+	}
+	address.Location = location
+	address.Geocoded = address.mapsQuery()
+	address.GeocodedBy = geocoder.Name()
+	return nil
+}
+
+// Geocodes an address saved from the edit form, which doesn't post the hidden
+// location fields, keeping the stored location while the address is unchanged.
+// A failed or unset geocoder leaves a changed address unlocated rather than
+// failing the save.
+func locateEditedAddress(ctx context.Context, store Store, address *Address) error {
+	if !address.Key.Incomplete() {
+		stored := &Address{}
+		err := store.Get(ctx, address.Key, stored)
+		if err != nil {
+			return fmt.Errorf("failed to get %v: %v", address.Key, err)
+		}
+		address.Location, address.Geocoded, address.GeocodedBy = stored.Location, stored.Geocoded, stored.GeocodedBy
+	}
+	geocoder, err := newGeocoder()
+	if err != nil {
+		return err
+	}
+	if geocoder == nil {
+		if address.Geocoded != address.mapsQuery() {
+			address.Location, address.Geocoded, address.GeocodedBy = nil, "", ""
+		}
+		return nil
+	}
+	err = geocodeAddress(ctx, geocoder, address)
+	if err != nil {
+		log.Printf("Not locating %v: %v", address.Key, err)
+		address.Location, address.Geocoded, address.GeocodedBy = nil, "", ""
+	}
+	return nil
+}
+
+// https://en.wikipedia.org/wiki/Geohash
+func geohash(lat float64, lng float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+	var hash strings.Builder
+	bits, ch, even := 0, 0, true
+	for hash.Len() < precision {
+		r, v := &latRange, lat
+		if even {
+			r, v = &lngRange, lng
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		bits++
+		if bits == 5 {
+			hash.WriteByte(GEOHASH_BASE32[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return hash.String()
+}
+
+// Size in degrees of the geohash cells of the precision.
+func geohashCell(precision int) (float64, float64) {
+	lngBits := (5*precision + 1) / 2
+	latBits := 5 * precision / 2
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lngBits))
+}
+
+// Longest geohash prefixes at the location whose cells are at least `km`
+// wide and high, so that the cell of the location and its eight neighbors
+// cover the circle of radius `km` around it.
+func geohashPrefixes(lat float64, lng float64, km float64) []string {
+	precision := GEOHASH_PRECISION
+	for ; precision > 1; precision-- {
+		height, width := geohashCell(precision)
+		if height*math.Pi/180*EARTH_RADIUS_KM >= km && width*math.Pi/180*EARTH_RADIUS_KM*math.Cos(lat*math.Pi/180) >= km {
+			break
+		}
+	}
+	height, width := geohashCell(precision)
+	var prefixes []string
+	for dy := -1.0; dy <= 1; dy++ {
+		for dx := -1.0; dx <= 1; dx++ {
+			y := max(-90, min(90, lat+dy*height))
+			x := math.Mod(lng+dx*width+540, 360) - 180
+			if prefix := geohash(y, x, precision); !slices.Contains(prefixes, prefix) {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	return prefixes
+}
+
+// Great circle distance.
+// https://en.wikipedia.org/wiki/Haversine_formula
+func distanceKM(a datastore.GeoPoint, b datastore.GeoPoint) float64 {
+	rad := math.Pi / 180
+	dlat := (b.Lat - a.Lat) * rad
+	dlng := (b.Lng - a.Lng) * rad
+	h := math.Pow(math.Sin(dlat/2), 2) + math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Pow(math.Sin(dlng/2), 2)
+	return 2 * EARTH_RADIUS_KM * math.Asin(math.Sqrt(h))
+}
+
+func geocodeTask(next *datastore.Key) *taskqueue.Task {
+	path := "/task/geocode/"
+	if next != nil {
+		path += next.Encode()
+	}
+	return taskqueue.NewPOSTTask(path, nil)
+}
+
+// Geocodes the addresses that changed since they were last geocoded, a batch
+// per task. Failures are listed and left for the next run, rather than
+// retrying the task.
+func taskGeocodeHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	var buffer bytes.Buffer
+
+	geocoder, err := newGeocoder()
+	if err != nil {
+		return "", err
+	}
+	if geocoder == nil {
+		return fmt.Sprintf("Not geocoding, %s is unset", GEOCODER), nil
+	}
+
+	query := &storeQuery{Kind: "Address", Limit: GEOCODE_BATCH}
+	if next := r.PathValue("next"); next != "" {
+		key, err := datastore.DecodeKey(next)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode address key %q: %v", next, err)
+		}
+		query.After = key
+	}
+
+	var addresses []*Address
+	keys, err := store.GetAll(ctx, query, &addresses)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch addresses: %v", err)
+	}
+
+	if len(addresses) == GEOCODE_BATCH {
+		buffer.WriteString("Adding continuation task\n")
+		resp, err := addTask(ctx, geocodeTask(keys[len(keys)-1]))
+		if err != nil {
+			return "", fmt.Errorf("failed to add continuation task: %v", err)
+		}
+		buffer.WriteString(resp + "\n")
+	}
+
+	var changed []*Address
+	var changedKeys []*datastore.Key
+	for i, address := range addresses {
+		if !address.geocodeStale(geocoder) {
+			continue
+		}
+		err := geocodeAddress(ctx, geocoder, address)
+		if err != nil {
+			buffer.WriteString(fmt.Sprintf("%4d: %v  Failed: %v\n", i+1, keys[i], err))
+			continue
+		}
+		buffer.WriteString(fmt.Sprintf("%4d: %v  %q at %v\n", i+1, keys[i], address.Geocoded, address.Location))
+		address.fix()
+		changed = append(changed, address)
+		changedKeys = append(changedKeys, keys[i])
+	}
+	_, err = store.PutMulti(ctx, changedKeys, changed)
+	if err != nil {
+		return "", fmt.Errorf("failed to put %d geocoded addresses: %v", len(changed), err)
+	}
+
+	buffer.WriteString(fmt.Sprintf("Geocoded %d of %d addresses", len(changed), len(addresses)))
+	return buffer.String(), nil
+}
+
+type mapMarker struct {
+	Lat      float64
+	Lng      float64
+	Name     string
+	Address  string
+	Category string
+	URL      string
+	Distance float64 // Kilometers from `Near`, when searching near it.
+}
+
+type mapData struct {
+	Message    string
+	Categories []string
+	Category   string
+	Near       *Address // Center of the radius search.
+	KM         float64
+	Markers    []mapMarker
+	Stale      int // Enabled addresses to geocode.
+	CSRF       string
+}
+
+// Shows the located enabled addresses on a map, optionally of one `category`,
+// or those within `km` of the `near` address, closest first.
+func mapHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	action := getValue(r, "action")
+	data := &mapData{Category: getValue(r, "category"), KM: 10, CSRF: csrfToken(ctx)}
+
+	if action != "" && r.Method != "POST" {
+		return "", httpError(http.StatusMethodNotAllowed, "action %q requires POST", action)
+	}
+
+	switch action {
+	case "":
+	case "geocode":
+		resp, err := addTask(ctx, geocodeTask(nil))
+		if err != nil {
+			return "", err
+		}
+		data.Message = fmt.Sprintf("Geocoding changed addresses. %s", resp)
+	default:
+		return "", fmt.Errorf("unknown map action %q", action)
+	}
+
+	choices, err := fetchChoices(ctx, store)
+	if err != nil {
+		return "", err
+	}
+	data.Categories = choices["Category"]
+	geocoder, err := newGeocoder()
+	if err != nil {
+		return "", err
+	}
+
+	if km := getValue(r, "km"); km != "" {
+		data.KM, err = strconv.ParseFloat(km, 64)
+		if err != nil || data.KM <= 0 {
+			return "", httpError(http.StatusBadRequest, "invalid distance %q", km)
+		}
+	}
+
+	var addresses []*Address
+	if near := getValue(r, "near"); near != "" {
+		key, err := datastore.DecodeKey(near)
+		if err != nil || key.Kind != "Address" {
+			return "", httpError(http.StatusBadRequest, "invalid address key %q", near)
+		}
+		data.Near = &Address{}
+		err = store.Get(ctx, key, data.Near)
+		if err != nil {
+			return "", httpError(http.StatusNotFound, "failed to get address %v: %v", key, err)
+		}
+		if data.Near.Location == nil {
+			return "", httpError(http.StatusBadRequest, "address %v has no location", key)
+		}
+		var keys []*datastore.Key
+		for _, prefix := range geohashPrefixes(data.Near.Location.Lat, data.Near.Location.Lng, data.KM) {
+			found, err := store.QueryByWord(ctx, "Address", GEOHASH_WORD+prefix)
+			if err != nil {
+				return "", fmt.Errorf("failed to query addresses near %v: %v", key, err)
+			}
+			keys = append(keys, found...)
+		}
+		addresses = make([]*Address, len(keys))
+		err = store.GetMulti(ctx, keys, addresses)
+		if err != nil {
+			return "", fmt.Errorf("failed to get %d addresses near %v: %v", len(keys), key, err)
+		}
+	} else {
+		_, err = store.GetAll(ctx, &storeQuery{Kind: "Address", Filters: map[string]any{"enabled": true}}, &addresses)
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch addresses: %v", err)
+		}
+	}
+
+	var located []*Address
+	for _, address := range addresses {
+		if !address.Enabled {
+			continue
+		}
+		if geocoder != nil && address.geocodeStale(geocoder) {
+			data.Stale++
+		}
+		// Households are shown at the addresses of their members.
+		if address.Location == nil || address.Key.Parent.Kind != "Person" {
+			continue
+		}
+		if data.Near != nil && distanceKM(*data.Near.Location, *address.Location) > data.KM {
+			continue
+		}
+		located = append(located, address)
+	}
+
+	keys := make([]*datastore.Key, len(located))
+	for i, address := range located {
+		keys[i] = address.Key.Parent
+	}
+	people := make([]Person, len(keys))
+	err = store.GetMulti(ctx, keys, people)
+	if err != nil {
+		return "", fmt.Errorf("failed to get people of %d addresses: %v", len(keys), err)
+	}
+
+	for i, address := range located {
+		person := &people[i]
+		if !person.Enabled || (data.Category != "" && person.Category != data.Category) {
+			continue
+		}
+		marker := mapMarker{
+			Lat:      address.Location.Lat,
+			Lng:      address.Location.Lng,
+			Name:     person.displayName(),
+			Address:  address.snippet(),
+			Category: person.Category,
+			URL:      "/person/" + person.Key.Encode(),
+		}
+		if data.Near != nil {
+			marker.Distance = distanceKM(*data.Near.Location, *address.Location)
+		}
+		data.Markers = append(data.Markers, marker)
+	}
+	if data.Near != nil {
+		slices.SortStableFunc(data.Markers, func(a, b mapMarker) int { return cmp.Compare(a.Distance, b.Distance) })
+	}
+
+	return renderPage(ctx, "map", data)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewGeocoder(t *testing.T) {
+	tests := []struct {
+		app      string
+		config   string
+		want     string
+		wantFail bool
+	}{
+		{"", "", "stub", false},
+		{"", "stub", "stub", false},
+		{"s~pda-test", "", "", false},
+		{"s~pda-test", "stub", "", true},
+		{"s~pda-test", "https://geocoder.example.com/search", "https://geocoder.example.com/search", false},
+		{"s~pda-test", "nominatim", "", true},
+	}
+	for _, test := range tests {
+		t.Setenv(GAE_APPLICATION, test.app)
+		t.Setenv(GEOCODER, test.config)
+		geocoder, err := newGeocoder()
+		name := ""
+		if geocoder != nil {
+			name = geocoder.Name()
+		}
+		if name != test.want || (err != nil) != test.wantFail {
+			t.Errorf("app %q, %s %q: geocoder %q, %v, want %q", test.app, GEOCODER, test.config, name, err, test.want)
+		}
+	}
+}
+
+func TestGeocodeStale(t *testing.T) {
+	ctx := context.Background()
+	stub := &stubGeocoder{}
+	address := &Address{City: "Springfield", Country: "United States"}
+	err := geocodeAddress(ctx, stub, address)
+	if err != nil || address.Location == nil || address.GeocodedBy != "stub" {
+		t.Fatalf("geocoded %+v, %v", address, err)
+	}
+	if address.geocodeStale(stub) {
+		t.Errorf("address stale right after geocoding")
+	}
+	if !address.geocodeStale(&httpGeocoder{URL: "https://geocoder.example.com/search"}) {
+		t.Errorf("stub location not stale for another geocoder")
+	}
+	address.City = "Shelbyville"
+	if !address.geocodeStale(stub) {
+		t.Errorf("changed address not stale")
+	}
+}
@@ -4,7 +4,7 @@ go 1.26.0
 
 require (
 	cloud.google.com/go/datastore v1.22.0
-	golang.org/x/net v0.50.0
+	golang.org/x/text v0.34.0
 	google.golang.org/appengine/v2 v2.0.6
 )
 
@@ -28,10 +28,10 @@ require (
 	go.opentelemetry.io/otel/metric v1.40.0 // indirect
 	go.opentelemetry.io/otel/trace v1.40.0 // indirect
 	golang.org/x/crypto v0.48.0 // indirect
+	golang.org/x/net v0.50.0 // indirect
 	golang.org/x/oauth2 v0.35.0 // indirect
 	golang.org/x/sync v0.19.0 // indirect
 	golang.org/x/sys v0.41.0 // indirect
-	golang.org/x/text v0.34.0 // indirect
 	golang.org/x/time v0.14.0 // indirect
 	google.golang.org/api v0.268.0 // indirect
 	google.golang.org/genproto v0.0.0-20260223185530-2f722ef697dc // indirect
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Ways of joining the names of several people on one envelope, see `joinNames`.
+var nameJoinStyles = []string{"ampersand", "and", "family", "full"}
+
+// People living together, who get one card. Root entity, with the shared
+// address as its Address child. A Person is a member of at most one household.
+type Household struct {
+	Key         *datastore.Key   `datastore:"__key__"`
+	MailingName string           `datastore:"mailing_name,omitempty"` // Joined from the members' names when empty.
+	Members     []*datastore.Key `datastore:"members"`
+	Created     time.Time        `datastore:"created"`
+}
+
+// The shared address, or nil when empty and the first member's addresses are
+// used.
+func householdAddress(ctx context.Context, store Store, h *Household) (*Address, error) {
+	var addresses []*Address
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "Address", Ancestor: h.Key, Limit: 1}, &addresses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch address of household %v: %v", h.Key, err)
+	}
+	if len(addresses) == 0 {
+		return nil, nil
+	}
+	return addresses[0], nil
+}
+
+// Names of the people for one envelope, e.g. for John and Jane Smith and Kim
+// Doe with the styles:
+//
+//	ampersand: John & Jane Smith & Kim Doe
+//	and:       John and Jane Smith and Kim Doe
+//	family:    The Smith and Doe Family
+//	full:      John Smith & Jane Smith & Kim Doe
+//
+// People without a first name are listed by their display name.
+func joinNames(people []*Person, style string) string {
+	type group struct {
+		last  string
+		names []string
+	}
+	var groups []*group
+	for _, p := range people {
+		i := slices.IndexFunc(groups, func(g *group) bool { return strings.EqualFold(g.last, p.LastName) })
+		if i < 0 || style == "full" || p.FirstName == "" {
+			groups = append(groups, &group{last: p.LastName})
+			i = len(groups) - 1
+		}
+		if p.FirstName == "" {
+			groups[i].names = append(groups[i].names, strings.TrimSpace(p.displayName()))
+			groups[i].last = ""
+		} else {
+			groups[i].names = append(groups[i].names, p.FirstName)
+		}
+	}
+
+	conjunction := " & "
+	if style == "and" || style == "family" {
+		conjunction = " and "
+	}
+
+	var parts []string
+	for _, g := range groups {
+		if style == "family" {
+			last := g.last
+			if last == "" {
+				last = strings.Join(g.names, conjunction)
+			}
+			if !slices.Contains(parts, last) {
+				parts = append(parts, last)
+			}
+			continue
+		}
+		parts = append(parts, strings.TrimSpace(strings.Join(g.names, conjunction)+" "+g.last))
+	}
+	if style == "family" {
+		return "The " + strings.Join(parts, conjunction) + " Family"
+	}
+	return strings.Join(parts, conjunction)
+}
+
+func fetchHouseholds(ctx context.Context, store Store) ([]*Household, error) {
+	var households []*Household
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "Household"}, &households)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch households: %v", err)
+	}
+	return households, nil
+}
+
+// The household of the Person, or nil.
+func personHousehold(ctx context.Context, store Store, personKey *datastore.Key) (*Household, error) {
+	var households []*Household
+	query := &storeQuery{Kind: "Household", Filters: map[string]any{"members": personKey}, Limit: 1}
+	_, err := store.GetAll(ctx, query, &households)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch household of %v: %v", personKey, err)
+	}
+	if len(households) == 0 {
+		return nil, nil
+	}
+	return households[0], nil
+}
+
+// One row per household, where its first member on the list appears, named
+// after the members on the list. The shared address replaces the members'
+// addresses when set.
+func combineHouseholds(ctx context.Context, store Store, mailings []mailing, style string) ([]mailing, error) {
+	households, err := fetchHouseholds(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	byMember := make(map[string]*Household)
+	for _, h := range households {
+		for _, member := range h.Members {
+			byMember[member.Encode()] = h
+		}
+	}
+
+	// Members on the list, in list order.
+	onList := make(map[*Household][]*Person)
+	for _, m := range mailings {
+		if h := byMember[m.Person.Key.Encode()]; h != nil && !slices.ContainsFunc(onList[h], func(p *Person) bool { return p.Key.Equal(m.Person.Key) }) {
+			onList[h] = append(onList[h], m.Person)
+		}
+	}
+
+	var combined []mailing
+	emitted := make(map[*Household]bool)
+	for _, m := range mailings {
+		h := byMember[m.Person.Key.Encode()]
+		if h == nil {
+			combined = append(combined, m)
+			continue
+		}
+		first := onList[h][0]
+		if !first.Key.Equal(m.Person.Key) {
+			continue
+		}
+		name := h.MailingName
+		if name == "" {
+			name = joinNames(onList[h], style)
+		}
+		address, err := householdAddress(ctx, store, h)
+		if err != nil {
+			return nil, err
+		}
+		if address == nil {
+			m.Name = name
+			combined = append(combined, m)
+		} else if !emitted[h] {
+			combined = append(combined, mailing{Person: first, Address: address, Name: name})
+		}
+		emitted[h] = true
+	}
+	return combined, nil
+}
+
+type householdRow struct {
+	Household *Household
+	Name      string
+	Members   []*Person
+	Address   *Address // Of the household shown, empty when not set.
+}
+
+type householdData struct {
+	Message    string
+	Households []householdRow
+	Household  *householdRow
+	Q          string
+	Candidates []*Person
+	CSRF       string
+}
+
+// Members that were deleted since they were added are left out.
+func householdMembers(ctx context.Context, store Store, h *Household) (*householdRow, error) {
+	members, err := getPeople(ctx, store, h.Members)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch members of household %v: %v", h.Key, err)
+	}
+	members = slices.DeleteFunc(members, func(p *Person) bool { return p == nil })
+	name := h.MailingName
+	if name == "" && len(members) > 0 {
+		name = joinNames(members, "ampersand")
+	}
+	if name == "" {
+		name = "(empty household)"
+	}
+	return &householdRow{Household: h, Name: name, Members: members}, nil
+}
+
+// Writes the shared address as the Address child of the household, or deletes
+// it when empty.
+func saveHouseholdAddress(ctx context.Context, store Store, h *Household, address *Address) error {
+	existing, err := householdAddress(ctx, store, h)
+	if err != nil {
+		return err
+	}
+	if len(removeEmtpy([]string{address.AddressLine1, address.AddressLine2, address.City, address.StateProvince, address.PostalCode, address.Country})) == 0 {
+		if existing != nil {
+			err = store.Delete(ctx, existing.Key)
+			if err != nil {
+				return fmt.Errorf("failed to delete address of household %v: %v", h.Key, err)
+			}
+		}
+		return nil
+	}
+
+	// Keeps the location while the address is the same.
+	if existing == nil {
+		existing = &Address{Key: datastore.IncompleteKey("Address", h.Key)}
+	}
+	existing.AddressLine1 = address.AddressLine1
+	existing.AddressLine2 = address.AddressLine2
+	existing.City = address.City
+	existing.StateProvince = address.StateProvince
+	existing.PostalCode = address.PostalCode
+	existing.Country = address.Country
+	existing.Enabled = true
+	existing.fix()
+	_, err = saveModel(ctx, store, existing)
+	if err != nil {
+		return fmt.Errorf("failed to put address of household %v: %v", h.Key, err)
+	}
+	return nil
+}
+
+func getHousehold(ctx context.Context, store Store, key string) (*Household, error) {
+	dbkey, err := datastore.DecodeKey(key)
+	if err != nil || dbkey.Kind != "Household" {
+		return nil, httpError(http.StatusBadRequest, "invalid household key %q", key)
+	}
+	h := &Household{}
+	err = store.Get(ctx, dbkey, h)
+	if err != nil {
+		return nil, httpError(http.StatusNotFound, "failed to get household %v: %v", dbkey, err)
+	}
+	return h, nil
+}
+
+func householdHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	key := getValue(r, "household")
+	action := getValue(r, "action")
+	message := ""
+
+	if action != "" && r.Method != "POST" {
+		return "", httpError(http.StatusMethodNotAllowed, "action %q requires POST", action)
+	}
+
+	var h *Household
+	if key != "" {
+		var err error
+		h, err = getHousehold(ctx, store, key)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	switch action {
+	case "":
+	case "create":
+		h = &Household{Created: time.Now()}
+		if person := getValue(r, "person"); person != "" {
+			personKey, err := datastore.DecodeKey(person)
+			if err != nil {
+				return "", httpError(http.StatusBadRequest, "failed to decode person key %q: %v", person, err)
+			}
+			existing, err := personHousehold(ctx, store, personKey)
+			if err != nil {
+				return "", err
+			}
+			if existing != nil {
+				h = existing
+				message = "Already in this household"
+				break
+			}
+			h.Members = []*datastore.Key{personKey}
+		}
+		dbkey, err := store.Put(ctx, datastore.IncompleteKey("Household", nil), h)
+		if err != nil {
+			return "", fmt.Errorf("failed to put household: %v", err)
+		}
+		h.Key = dbkey
+		message = "Created household"
+	case "save", "add", "remove":
+		if h == nil {
+			return "", httpError(http.StatusBadRequest, "missing household")
+		}
+		switch action {
+		case "save":
+			h.MailingName = strings.TrimSpace(getValue(r, "MailingName"))
+			err := saveHouseholdAddress(ctx, store, h, &Address{
+				AddressLine1:  getValue(r, "AddressLine1"),
+				AddressLine2:  getValue(r, "AddressLine2"),
+				City:          getValue(r, "City"),
+				StateProvince: getValue(r, "StateProvince"),
+				PostalCode:    getValue(r, "PostalCode"),
+				Country:       getValue(r, "Country"),
+			})
+			if err != nil {
+				return "", err
+			}
+			message = "Saved household"
+		case "add":
+			personKey, err := datastore.DecodeKey(getValue(r, "person"))
+			if err != nil || personKey.Kind != "Person" {
+				return "", httpError(http.StatusBadRequest, "invalid person key %q", getValue(r, "person"))
+			}
+			existing, err := personHousehold(ctx, store, personKey)
+			if err != nil {
+				return "", err
+			}
+			if existing != nil {
+				message = "Already in a household, remove them from it first"
+				break
+			}
+			h.Members = append(h.Members, personKey)
+			message = "Added member"
+		case "remove":
+			personKey, err := datastore.DecodeKey(getValue(r, "person"))
+			if err != nil {
+				return "", httpError(http.StatusBadRequest, "invalid person key %q", getValue(r, "person"))
+			}
+			h.Members = slices.DeleteFunc(h.Members, personKey.Equal)
+			message = "Removed member"
+		}
+		_, err := store.Put(ctx, h.Key, h)
+		if err != nil {
+			return "", fmt.Errorf("failed to put household %v: %v", h.Key, err)
+		}
+	case "delete":
+		if h == nil {
+			return "", httpError(http.StatusBadRequest, "missing household")
+		}
+		err := saveHouseholdAddress(ctx, store, h, &Address{})
+		if err != nil {
+			return "", err
+		}
+		err = store.Delete(ctx, h.Key)
+		if err != nil {
+			return "", fmt.Errorf("failed to delete household %v: %v", h.Key, err)
+		}
+		h = nil
+		message = "Deleted household"
+	default:
+		return "", fmt.Errorf("unknown household action %q", action)
+	}
+
+	data := &householdData{Message: message, Q: getValue(r, "q"), CSRF: csrfToken(ctx)}
+	if h == nil {
+		households, err := fetchHouseholds(ctx, store)
+		if err != nil {
+			return "", err
+		}
+		for _, h := range households {
+			row, err := householdMembers(ctx, store, h)
+			if err != nil {
+				return "", err
+			}
+			data.Households = append(data.Households, *row)
+		}
+	} else {
+		var err error
+		data.Household, err = householdMembers(ctx, store, h)
+		if err != nil {
+			return "", err
+		}
+		data.Household.Address, err = householdAddress(ctx, store, h)
+		if err != nil {
+			return "", err
+		}
+		if data.Household.Address == nil {
+			data.Household.Address = &Address{}
+		}
+
+		// People to add, found like the main search.
+		if words := removeEmtpy(WORDS_RE.Split(strings.ToLower(data.Q), -1)); len(words) > 0 {
+			keys, err := wordSearch(ctx, store, words)
+			if err != nil {
+				return "", err
+			}
+			keys = slices.DeleteFunc(keys, func(k *datastore.Key) bool { return slices.ContainsFunc(h.Members, k.Equal) })
+			people, err := getPeople(ctx, store, keys)
+			if err != nil {
+				return "", err
+			}
+			data.Candidates = slices.DeleteFunc(people, func(p *Person) bool { return p == nil })
+		}
+	}
+
+	return renderPage(ctx, "households", data)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestHouseholdAddress(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	var people []*datastore.Key
+	for _, name := range []string{"Jane", "John", "Gone"} {
+		key, err := saveModel(ctx, store, &Person{Key: datastore.IncompleteKey("Person", nil), FirstName: name, LastName: "Doe", Common: Common{Enabled: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, key)
+	}
+	h := &Household{Members: people, Created: time.Now()}
+	householdKey, err := store.Put(ctx, datastore.IncompleteKey("Household", nil), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Key = householdKey
+	err = store.Delete(ctx, people[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := householdMembers(ctx, store, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(row.Members) != 2 || row.Name != "Jane & John Doe" {
+		t.Errorf("household of %d members named %q, want the 2 not deleted", len(row.Members), row.Name)
+	}
+	address, err := householdAddress(ctx, store, h)
+	if err != nil || address != nil {
+		t.Fatalf("address %+v, %v, want none before it is saved", address, err)
+	}
+
+	_, err = householdHandler(postForm("/household", url.Values{"action": {"save"}, "household": {householdKey.Encode()}, "City": {"Springfield"}}), ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addresses []*Address
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Address", Ancestor: householdKey}, &addresses)
+	if err != nil || len(addresses) != 1 || addresses[0].City != "Springfield" || !addresses[0].Enabled {
+		t.Errorf("shared addresses %+v, %v, want one Address child", addresses, err)
+	}
+	mailings, err := combineHouseholds(ctx, store, []mailing{{Person: &Person{Key: people[0], FirstName: "Jane", LastName: "Doe"}}}, "ampersand")
+	if err != nil || len(mailings) != 1 || mailings[0].Address == nil || mailings[0].Address.City != "Springfield" {
+		t.Errorf("mailings %+v, %v, want one to the shared address", mailings, err)
+	}
+	keys, err := wordSearch(ctx, store, []string{"springfield"})
+	if err != nil || len(keys) != 0 {
+		t.Errorf("search found %v, %v, want no household as a person", keys, err)
+	}
+
+	_, err = householdHandler(postForm("/household", url.Values{"action": {"remove"}, "household": {householdKey.Encode()}, "person": {people[2].Encode()}}), ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restored with new IDs, the address stays below the household.
+	var backup bytes.Buffer
+	summary, err := exportBackup(ctx, store, &backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Kinds["Household"] != 1 {
+		t.Fatalf("backup of %v, want the household", summary.Kinds)
+	}
+	entities, summary, err := parseBackup(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newMemoryStore()
+	restore, err := startRestore(ctx, restored, entities, summary, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = restoreChunk(ctx, restored, restore.Key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var households []*Household
+	_, err = restored.GetAll(ctx, &storeQuery{Kind: "Household"}, &households)
+	if err != nil || len(households) != 1 {
+		t.Fatalf("restored %d households, %v, want 1", len(households), err)
+	}
+	address, err = householdAddress(ctx, restored, households[0])
+	if err != nil || address == nil || address.City != "Springfield" {
+		t.Errorf("restored shared address %+v, %v", address, err)
+	}
+	row, err = householdMembers(ctx, restored, households[0])
+	if err != nil || len(row.Members) != 2 || row.Members[0].Key.Equal(people[0]) {
+		t.Errorf("restored household %+v, %v, want the remapped members", row, err)
+	}
+}
@@ -3,18 +3,75 @@ package main
 import (
 	"bytes"
 	"context"
+	"embed"
 	"fmt"
+	"html/template"
 	"os"
 	"strings"
 
+	"cloud.google.com/go/datastore"
 	"google.golang.org/appengine/v2"
 	"google.golang.org/appengine/v2/user"
 )
 
-func preamble(ctx context.Context, q string) string {
+// Templates use contextual auto-escaping, so data must never be pre-escaped
+// or concatenated into markup. Rendered partials are passed on as `template.HTML`.
+//
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var templateFuncs = template.FuncMap{
+	"displayName":   (*Person).displayName,
+	"enabledClass":  func(m model) string { return m.common().enabledClass() },
+	"enabledText":   func(m model) string { return m.common().enabledText() },
+	"sendCardText":  (*Person).sendCardText,
+	"cardSentText":  (*Calendar).cardSentText,
+	"editURL":       editURL,
+	"viewURL":       (*Person).viewURL,
+	"view":          model.view,
+	"snippet":       (*Address).snippet,
+	"mapsQuery":     (*Address).mapsQuery,
+	"isLink":        (*Contact).isLink,
+	"date":          formatDate,
+	"encode":        (*datastore.Key).Encode,
+	"newKey":        func(kind string, parent *datastore.Key) *datastore.Key { return datastore.IDKey(kind, 0, parent) },
+	"statusDate":    (*CampaignStatus).dateText,
+	"restoreStatus": (*Restore).status,
+	"tagWord":       tagWord,
+	"custom":        func(m model) []customValue { return m.common().customValues() },
+}
+
+var templates = template.Must(template.New("").Funcs(templateFuncs).ParseFS(templateFS, "templates/*.html"))
+
+func render(name string, data any) (template.HTML, error) {
 	var buffer bytes.Buffer
+	err := templates.ExecuteTemplate(&buffer, name, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to render template %s: %v", name, err)
+	}
+	return template.HTML(buffer.String()), nil
+}
+
+type layoutData struct {
+	Email        string
+	AppIDClass   string
+	ProjectID    string
+	Q            string
+	Admin        bool
+	ConsoleURL   string
+	DatastoreURL string
+	LabelFormats []labelFormat
+	LabelSorts   []string
+	Version      string
+	Env          string
+	Runtime      string
+	CSRF         string
+	Content      template.HTML
+}
 
-	u := user.Current(ctx)
+// Wraps the rendered content in the shared page layout.
+func page(ctx context.Context, q string, content template.HTML) (string, error) {
+	u := currentUser(ctx)
 	if u == nil && isDev() {
 		u = &user.User{Email: "someone@gmail.com"}
 	}
@@ -24,69 +81,35 @@ func preamble(ctx context.Context, q string) string {
 		clazz = "warn"
 	}
 
-	buffer.WriteString(strings.TrimSpace(fmt.Sprintf(`
-<!DOCTYPE html>
-<html>
-	<head>
-		<meta name="viewport" content="width=device-width,initial-scale=1.0">
-		<title>PDA2GO</title>
-		<link rel="icon" href="favicon.ico" type="image/x-icon">
-		<link rel="stylesheet" href="/static/main.css">
-		<script src="/static/main.js"></script>
-	</head>
-	<body class="pda">
-		<span class="title">	
-			<a href="/">PDA2<span class="go">GO</span></a>
-			<span class="appid %s">%s</span></a>
-		</span>
-		<div class="email">%s</div>
-		<form name="searchform" method="get" onsubmit="spin()">
-			<input type="text" name="q" autocomplete="off" value="%s">
-			<input type="submit" id="submit" value="Search"><br>
-		</form>
-
-		<hr>
-	`,
-		clazz,
-		projectID(),
-		u.Email,
-		q)))
-
-	buffer.WriteString(createEntityLink("Person", nil))
-	buffer.WriteString(`<br><br>`)
+	data := &layoutData{
+		Email:        u.Email,
+		AppIDClass:   clazz,
+		ProjectID:    projectID(),
+		Q:            q,
+		Admin:        isAdmin(ctx),
+		ConsoleURL:   consoleURL(),
+		DatastoreURL: datastoreURL(),
+		LabelFormats: labelFormats,
+		LabelSorts:   labelSorts,
+		Version:      os.Getenv(GAE_VERSION),
+		Env:          os.Getenv(GAE_ENV),
+		Runtime:      os.Getenv(GAE_RUNTIME),
+		CSRF:         csrfToken(ctx),
+		Content:      content,
+	}
 
-	return buffer.String()
+	html, err := render("layout", data)
+	if err != nil {
+		return "", err
+	}
+	return string(html), nil
 }
 
-func postamble(ctx context.Context) string {
-	var buffer bytes.Buffer
-
-	if isAdmin(ctx) {
-
-		buffer.WriteString(fmt.Sprintf(`
-			<br>
-			<div class="admin"><a href="%s" target="_blank">Console</a>, <a href="%s" target="_blank">Datastore</a></div>
-			<div class="admin"><a href="/mailmerge">mailmerge.csv</a></div>
-			<div class="admin"><a href="/task/notify">/task/notify</a></div>
-			<div class="admin danger"><a href="/task/fix/all/" onclick="return prompt('Enter CONFIRM to continue:') == 'CONFIRM'">/task/fix/all/</a></div>
-		`,
-			consoleURL(),
-			datastoreURL(),
-		))
+// Renders the named template as the content of a full page.
+func renderPage(ctx context.Context, name string, data any) (string, error) {
+	content, err := render(name, data)
+	if err != nil {
+		return "", err
 	}
-
-	buffer.WriteString(fmt.Sprintf(`
-		<div class="powered">
-			version <span class="version">%s</span>,
-			powered by Go on App Engine
-			(%s %s)
-		</div>
-	</body>
-</html>
-    `,
-		os.Getenv(GAE_VERSION),
-		os.Getenv(GAE_ENV),
-		os.Getenv(GAE_RUNTIME)))
-
-	return buffer.String()
+	return page(ctx, "", content)
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+const testScript = `<script>alert(1)</script>`
+
+func TestPagesEscape(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	person := &Person{
+		Key:       datastore.IncompleteKey("Person", nil),
+		FirstName: testScript,
+		LastName:  `O"Neil 'x'`,
+		Common:    Common{Enabled: true},
+	}
+	// Computes the search words.
+	person.fix()
+	personKey, err := saveModel(ctx, store, person)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = saveModel(ctx, store, &Contact{
+		Key:         datastore.IncompleteKey("Contact", personKey),
+		ContactType: "Web",
+		ContactText: `http://example.com/"onmouseover="alert(1)`,
+		Common:      Common{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		page func() (string, error)
+		want []string
+	}{
+		{
+			"person",
+			func() (string, error) {
+				r := httptest.NewRequest("GET", "/person/"+personKey.Encode(), nil)
+				r.SetPathValue("key", personKey.Encode())
+				return personHandler(r, ctx, store)
+			},
+			[]string{
+				// Element content.
+				`&lt;script&gt;alert(1)&lt;/script&gt; O&#34;Neil &#39;x&#39;`,
+				// Attribute value.
+				`href="http://example.com/%22onmouseover=%22alert%281%29"`,
+			},
+		},
+		{
+			"search",
+			func() (string, error) {
+				return mainPageHandler(getRequest("/?q="+url.QueryEscape(`script "neil"`)), ctx, store)
+			},
+			[]string{
+				`&lt;script&gt;alert(1)&lt;/script&gt; O&#34;Neil &#39;x&#39;`,
+				`value="script &#34;neil&#34;"`,
+			},
+		},
+		{
+			"edit",
+			func() (string, error) {
+				return mainPageHandler(getRequest("/?action=edit&key="+personKey.Encode()), ctx, store)
+			},
+			[]string{
+				`value="&lt;script&gt;alert(1)&lt;/script&gt;"`,
+				`value="O&#34;Neil &#39;x&#39;"`,
+			},
+		},
+	}
+	for _, test := range tests {
+		html, err := test.page()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for _, raw := range []string{testScript, `O"Neil`, `"onmouseover`} {
+			if strings.Contains(html, raw) {
+				t.Errorf("%s: page contains unescaped %q", test.name, raw)
+			}
+		}
+		for _, want := range test.want {
+			if !strings.Contains(html, want) {
+				t.Errorf("%s: page lacks %q:\n%s", test.name, want, html)
+			}
+		}
+	}
+}
+
+func getRequest(target string) *http.Request {
+	r := httptest.NewRequest("GET", target, nil)
+	err := r.ParseForm()
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
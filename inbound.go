@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Stored message bodies are truncated to stay well below the 1 MiB entity limit.
+const MAX_INBOUND_BODY = 100 * 1024
+
+var FORWARDED_RE = regexp.MustCompile(`(?i)^(-+ ?forwarded message ?-+|begin forwarded message:)\s*$`)
+var PHONE_RE = regexp.MustCompile(`^(?:([A-Za-z]+)\.?:?\s*)?(\+?[\d(][\d\s().-]{5,}\d)$`)
+var EMAIL_RE = regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`)
+var URL_RE = regexp.MustCompile(`(https?://|www\.)\S+`)
+var STREET_RE = regexp.MustCompile(`^\d+[A-Za-z]?\s+\S+`)
+var US_LOCALITY_RE = regexp.MustCompile(`^(.+?),\s*([A-Z]{2})\s+(\d{5}(?:-\d{4})?)$`)
+var HTML_TAG_RE = regexp.MustCompile(`<[^>]*>`)
+
+// Local part of the address that queues forwarded contacts for review.
+const INBOUND_LOCAL_PART = "add"
+
+// An email received on `add@<project>.appspotmail.com`, pending review.
+type InboundMail struct {
+	Key         *datastore.Key `datastore:"__key__"`
+	Received    time.Time      `datastore:"received"`
+	To          string         `datastore:"to"`
+	FromName    string         `datastore:"from_name"`
+	FromAddress string         `datastore:"from_address"`
+	Subject     string         `datastore:"subject,noindex"`
+	Body        string         `datastore:"body,noindex"`
+	Person      *datastore.Key `datastore:"person"` // Existing Person with a matching Contact, if any.
+	Status      string         `datastore:"status"` // One of `pending`, `created`, `appended` or `discarded`.
+}
+
+// https://docs.cloud.google.com/appengine/docs/standard/services/mail/receiving-mail-with-mail-api?tab=go
+// Mail to `add@<project>.appspotmail.com` is POSTed to `/_ah/mail/add@<project>.appspotmail.com`.
+func inboundMailHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	to := strings.TrimPrefix(r.URL.Path, "/_ah/mail/")
+	if local, _, _ := strings.Cut(to, "@"); !strings.EqualFold(local, INBOUND_LOCAL_PART) {
+		log.Printf("Dropped inbound mail to %q", to)
+		return "", httpError(http.StatusNotFound, "no inbound mail address %q", to)
+	}
+
+	defer r.Body.Close()
+	inbound, err := parseInboundMail(r.Body)
+	if err != nil {
+		return "", err
+	}
+	inbound.To = to
+	inbound.Received = time.Now()
+	inbound.Status = "pending"
+
+	if inbound.FromAddress != "" {
+		contacts, err := contactsForAddress(ctx, store, inbound.FromAddress)
+		if err != nil {
+			return "", err
+		}
+		if len(contacts) > 0 {
+			inbound.Person = contacts[0].Key.Parent
+		}
+	}
+
+	key, err := store.Put(ctx, datastore.IncompleteKey("InboundMail", nil), inbound)
+	if err != nil {
+		return "", fmt.Errorf("failed to put inbound mail from %q: %v", inbound.FromAddress, err)
+	}
+
+	log.Printf("Queued inbound mail %v to %q from %q <%s>: %q", key, to, inbound.FromName, inbound.FromAddress, inbound.Subject)
+	return fmt.Sprintf("Queued %v\n", key), nil
+}
+
+func parseInboundMail(r io.Reader) (*InboundMail, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+
+	inbound := &InboundMail{}
+	decoder := &mime.WordDecoder{CharsetReader: charsetReader}
+	inbound.Subject, err = decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		inbound.Subject = msg.Header.Get("Subject")
+	}
+	inbound.Subject = strings.ToValidUTF8(inbound.Subject, "\uFFFD")
+
+	from, err := (&mail.AddressParser{WordDecoder: decoder}).ParseList(msg.Header.Get("From"))
+	if err == nil && len(from) > 0 {
+		inbound.FromName = strings.ToValidUTF8(from[0].Name, "\uFFFD")
+		inbound.FromAddress = from[0].Address
+	}
+
+	body, err := messageText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message body: %v", err)
+	}
+
+	// Prefer the original sender of a forwarded message over whoever forwarded it.
+	if name, address, ok := forwardedSender(body); ok {
+		inbound.FromName = name
+		inbound.FromAddress = address
+	}
+
+	if len(body) > MAX_INBOUND_BODY {
+		// On a rune boundary, as Datastore only stores valid UTF-8.
+		n := MAX_INBOUND_BODY
+		for n > 0 && !utf8.RuneStart(body[n]) {
+			n--
+		}
+		body = body[:n]
+	}
+	inbound.Body = body
+
+	return inbound, nil
+}
+
+// Returns the plain text of a message part, descending into multipart bodies.
+func messageText(contentType string, encoding string, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var htmlText string
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return "", fmt.Errorf("failed to read multipart: %v", err)
+			}
+			text, err := messageText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", err
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if partType == "text/html" {
+				htmlText = text
+			} else if text != "" {
+				return text, nil
+			}
+		}
+		return htmlText, nil
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	switch mediaType {
+	case "text/plain":
+		return decodeCharset(data, params["charset"]), nil
+	case "text/html":
+		return html.UnescapeString(HTML_TAG_RE.ReplaceAllString(decodeCharset(data, params["charset"]), "")), nil
+	default:
+		// Attachments.
+		return "", nil
+	}
+}
+
+// UTF-8 text of `data` in the declared charset, with invalid sequences
+// replaced. Unknown charsets are read as UTF-8.
+func decodeCharset(data []byte, charset string) string {
+	if enc, err := htmlindex.Get(charset); err == nil {
+		decoded, err := enc.NewDecoder().Bytes(data)
+		if err == nil {
+			data = decoded
+		}
+	}
+	return strings.ToValidUTF8(string(data), "\uFFFD")
+}
+
+// Decodes encoded words of header charsets beyond the UTF-8 and ISO-8859-1 of
+// `mime.WordDecoder`.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %q: %v", charset, err)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// Finds the `From:` line of a forwarded message block.
+func forwardedSender(body string) (name string, address string, ok bool) {
+	forwarded := false
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimLeft(scanner.Text(), "> "))
+		if FORWARDED_RE.MatchString(line) {
+			forwarded = true
+		} else if forwarded && strings.HasPrefix(strings.ToLower(line), "from:") {
+			a, err := mail.ParseAddress(strings.TrimSpace(line[len("from:"):]))
+			if err != nil {
+				return "", "", false
+			}
+			return a.Name, a.Address, true
+		}
+	}
+	return "", "", false
+}
+
+// Lines after the last `-- ` separator, or else the last paragraph.
+func signatureLines(body string) []string {
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+
+	start := -1
+	for i, line := range lines {
+		if strings.TrimRight(line, " ") == "--" {
+			start = i + 1
+		}
+	}
+	if start < 0 {
+		// Last paragraph, skipping trailing blank lines.
+		end := len(lines)
+		for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+			end--
+		}
+		start = end
+		for start > 0 && strings.TrimSpace(lines[start-1]) != "" {
+			start--
+		}
+		lines = lines[:end]
+	}
+
+	var signature []string
+	for _, line := range lines[start:] {
+		line = strings.TrimSpace(strings.TrimLeft(line, ">"))
+		if line != "" {
+			signature = append(signature, line)
+		}
+	}
+	return signature
+}
+
+// Builds an unsaved Person with Contact and Address children from the sender and signature.
+func (inbound *InboundMail) draft() (*Person, []*Contact, *Address) {
+	person := &Person{Common: Common{Enabled: true}}
+	name := strings.TrimSpace(inbound.FromName)
+	if i := strings.LastIndex(name, " "); i > 0 {
+		person.FirstName = name[:i]
+		person.LastName = name[i+1:]
+	} else {
+		person.FirstName = name
+	}
+	person.Comments = fmt.Sprintf("%s %s\n%s", inbound.Received.Format("2006-01-02"), inbound.Subject, strings.TrimSpace(inbound.Body))
+
+	var contacts []*Contact
+	contact := func(contactType string, text string) {
+		if !slices.ContainsFunc(contacts, func(c *Contact) bool { return c.ContactText == text }) {
+			contacts = append(contacts, &Contact{ContactType: contactType, ContactText: text, Common: Common{Enabled: true}})
+		}
+	}
+
+	if inbound.FromAddress != "" {
+		contact("Email", inbound.FromAddress)
+	}
+
+	var address *Address
+	for _, line := range signatureLines(inbound.Body) {
+		if m := PHONE_RE.FindStringSubmatch(line); m != nil {
+			switch strings.ToLower(m[1]) {
+			case "m", "mobile", "cell", "c":
+				contact("Mobile", m[2])
+			case "f", "fax":
+				contact("Facsimile", m[2])
+			default:
+				contact("Voice", m[2])
+			}
+		} else if email := EMAIL_RE.FindString(line); email != "" {
+			contact("Email", email)
+		} else if u := URL_RE.FindString(line); u != "" {
+			contact("URL", u)
+		} else if STREET_RE.MatchString(line) && address == nil {
+			address = &Address{AddressLine1: line, Common: Common{Enabled: true}}
+		} else if m := US_LOCALITY_RE.FindStringSubmatch(line); m != nil && address != nil {
+			address.City = m[1]
+			address.StateProvince = m[2]
+			address.PostalCode = m[3]
+			address.Country = "United States"
+		} else if address != nil && address.City == "" && address.AddressLine2 == "" {
+			address.AddressLine2 = line
+		}
+	}
+
+	return person, contacts, address
+}
+
+// Saves the draft as a new Person tree.
+func (inbound *InboundMail) create(ctx context.Context, store Store) (*datastore.Key, error) {
+	person, contacts, address := inbound.draft()
+	person.Key = datastore.IncompleteKey("Person", nil)
+	person.fix()
+	personKey, err := saveModel(ctx, store, person)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []model
+	for _, contact := range contacts {
+		contact.Key = datastore.IncompleteKey("Contact", personKey)
+		children = append(children, contact)
+	}
+	if address != nil {
+		address.Key = datastore.IncompleteKey("Address", personKey)
+		children = append(children, address)
+	}
+	keys := make([]*datastore.Key, len(children))
+	for i, child := range children {
+		child.fix()
+		keys[i] = child.key()
+	}
+	_, err = store.PutMulti(ctx, keys, children)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put %d children of %v: %v", len(children), personKey, err)
+	}
+
+	return personKey, nil
+}
+
+// Appends the message to the Comments of the matched Person.
+func (inbound *InboundMail) appendTo(ctx context.Context, store Store) error {
+	if inbound.Person == nil {
+		return fmt.Errorf("no matching person for inbound mail %v", inbound.Key)
+	}
+	person := &Person{}
+	err := store.Get(ctx, inbound.Person, person)
+	if err != nil {
+		return fmt.Errorf("failed to get person %v: %v", inbound.Person, err)
+	}
+
+	person.Comments = strings.TrimSpace(fmt.Sprintf("%s\n\n%s %s\n%s",
+		person.Comments,
+		inbound.Received.Format("2006-01-02"),
+		inbound.Subject,
+		strings.TrimSpace(inbound.Body)))
+	person.fix()
+	_, err = saveModel(ctx, store, person)
+	return err
+}
+
+// Moves the pending mail to the status in one write, so that a double submit
+// can't act on it twice.
+func claimInboundMail(ctx context.Context, store Store, key *datastore.Key, status string) (*InboundMail, error) {
+	inbound := &InboundMail{}
+	err := store.RunInTransaction(ctx, func(tx Transaction) error {
+		err := tx.Get(key, inbound)
+		if err == datastore.ErrNoSuchEntity {
+			return httpError(http.StatusNotFound, "no inbound mail %v", key)
+		} else if err != nil {
+			return fmt.Errorf("failed to get inbound mail %v: %v", key, err)
+		}
+		if inbound.Status != "pending" {
+			return httpError(http.StatusConflict, "inbound mail %v was already %s", key, inbound.Status)
+		}
+		inbound.Status = status
+		return tx.Put(key, inbound)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inbound, nil
+}
+
+func inboundHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	message := ""
+	if r.Method == "POST" {
+		key := getValue(r, "key")
+		dbkey, err := datastore.DecodeKey(key)
+		if err != nil || dbkey.Kind != "InboundMail" {
+			return "", httpError(http.StatusBadRequest, "invalid inbound mail key %q", key)
+		}
+		action := getValue(r, "action")
+		statuses := map[string]string{"create": "created", "append": "appended", "discard": "discarded"}
+		if statuses[action] == "" {
+			return "", httpError(http.StatusBadRequest, "unknown inbound action %q", action)
+		}
+
+		inbound, err := claimInboundMail(ctx, store, dbkey, statuses[action])
+		if err != nil {
+			return "", err
+		}
+
+		switch action {
+		case "create":
+			inbound.Person, err = inbound.create(ctx, store)
+			if err != nil {
+				err = fmt.Errorf("failed to create person: %v", err)
+			}
+		case "append":
+			err = inbound.appendTo(ctx, store)
+			if err != nil {
+				err = fmt.Errorf("failed to append to person: %v", err)
+			}
+		}
+		if err != nil {
+			// Back to pending, so that it can be tried again.
+			inbound.Status = "pending"
+		}
+		if action == "create" || err != nil {
+			_, perr := store.Put(ctx, dbkey, inbound)
+			if perr != nil {
+				log.Printf("Failed to put inbound mail %v: %v", dbkey, perr)
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		message = fmt.Sprintf("Inbound mail from %s %s", inbound.FromAddress, inbound.Status)
+	}
+
+	query := &storeQuery{Kind: "InboundMail", Filters: map[string]any{"status": "pending"}}
+	var pending []InboundMail
+	_, err := store.GetAll(ctx, query, &pending)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch pending inbound mail: %v", err)
+	}
+	slices.SortFunc(pending, func(a, b InboundMail) int { return a.Received.Compare(b.Received) })
+
+	data := &inboundData{Message: message, Address: fmt.Sprintf("%s@%s.appspotmail.com", INBOUND_LOCAL_PART, projectID()), CSRF: csrfToken(ctx)}
+	for i := range pending {
+		person, contacts, address := pending[i].draft()
+		data.Pending = append(data.Pending, inboundEntry{Mail: &pending[i], Person: person, Contacts: contacts, Address: address})
+	}
+
+	return renderPage(ctx, "inbound", data)
+}
+
+type inboundEntry struct {
+	Mail     *InboundMail
+	Person   *Person
+	Contacts []*Contact
+	Address  *Address
+}
+
+type inboundData struct {
+	Message string
+	Address string
+	Pending []inboundEntry
+	CSRF    string
+}
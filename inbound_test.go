@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"cloud.google.com/go/datastore"
+)
+
+const testInboundMail = `From: Jane Doe <jane@example.com>
+To: add@my-app-id.appspotmail.com
+Subject: New contact
+
+Jane Doe
+jane@example.com
+`
+
+func inboundMailRequest(to string) *http.Request {
+	r := httptest.NewRequest("POST", "/_ah/mail/"+to, strings.NewReader(testInboundMail))
+	r.SetPathValue("to", to)
+	return r
+}
+
+func postForm(path string, values url.Values) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err := r.ParseForm()
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func statusCode(err error) int {
+	var serr *statusError
+	if errors.As(err, &serr) {
+		return serr.Code
+	}
+	return http.StatusInternalServerError
+}
+
+func TestInboundMailRecipient(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+
+	_, err := inboundMailHandler(inboundMailRequest("someone@my-app-id.appspotmail.com"), ctx, store)
+	if statusCode(err) != http.StatusNotFound {
+		t.Errorf("mail to someone@ = %v, want 404", err)
+	}
+	_, err = inboundMailHandler(inboundMailRequest("add@my-app-id.appspotmail.com"), ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var queued []InboundMail
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "InboundMail"}, &queued)
+	if err != nil || len(queued) != 1 {
+		t.Errorf("queued %d mails, %v, want only the one to add@", len(queued), err)
+	}
+}
+
+func TestInboundCreateTwice(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	_, err := inboundMailHandler(inboundMailRequest("add@my-app-id.appspotmail.com"), ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := store.GetAll(ctx, &storeQuery{Kind: "InboundMail", KeysOnly: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := url.Values{"action": {"create"}, "key": {keys[0].Encode()}}
+	_, err = inboundHandler(postForm("/inbound", create), ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = inboundHandler(postForm("/inbound", create), ctx, store)
+	if statusCode(err) != http.StatusConflict {
+		t.Errorf("second create = %v, want 409", err)
+	}
+	_, err = inboundHandler(postForm("/inbound", url.Values{"action": {"append"}, "key": {keys[0].Encode()}}), ctx, store)
+	if statusCode(err) != http.StatusConflict {
+		t.Errorf("append after create = %v, want 409", err)
+	}
+
+	people, err := store.GetAll(ctx, &storeQuery{Kind: "Person", KeysOnly: true}, nil)
+	if err != nil || len(people) != 1 {
+		t.Errorf("created %d people, %v, want 1", len(people), err)
+	}
+	inbound := &InboundMail{}
+	err = store.Get(ctx, keys[0], inbound)
+	if err != nil || inbound.Status != "created" || !inbound.Person.Equal(people[0]) {
+		t.Errorf("inbound mail %+v, %v, want created with the person", inbound, err)
+	}
+}
+
+func TestInboundAppendFailureStaysPending(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	key, err := store.Put(ctx, datastore.IncompleteKey("InboundMail", nil), &InboundMail{Status: "pending"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No matching person to append to.
+	_, err = inboundHandler(postForm("/inbound", url.Values{"action": {"append"}, "key": {key.Encode()}}), ctx, store)
+	if err == nil {
+		t.Fatal("append without a person succeeded")
+	}
+	inbound := &InboundMail{}
+	err = store.Get(ctx, key, inbound)
+	if err != nil || inbound.Status != "pending" {
+		t.Errorf("status %q, %v, want pending after the failed append", inbound.Status, err)
+	}
+}
+
+func TestParseInboundMailCharset(t *testing.T) {
+	msg := "From: =?windows-1252?Q?Jos=E9?= <jose@example.com>\r\n" +
+		"Subject: =?windows-1252?Q?Caf=E9_M=FCller?=\r\n" +
+		"Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n\r\n" +
+		"Jos\xe9 M\xfcller\r\nCaf\xe9 \x80 Stra\xdfe 1\r\n"
+	inbound, err := parseInboundMail(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inbound.Subject != "Café Müller" || inbound.FromName != "José" {
+		t.Errorf("headers %q from %q, want them decoded", inbound.Subject, inbound.FromName)
+	}
+	if !strings.Contains(inbound.Body, "José Müller\r\nCafé € Straße 1") {
+		t.Errorf("body %q, want it decoded from latin-1", inbound.Body)
+	}
+	if !utf8.ValidString(inbound.Body) {
+		t.Errorf("body %q is not valid UTF-8, which Datastore refuses", inbound.Body)
+	}
+}
+
+func TestParseInboundMailLong(t *testing.T) {
+	// The limit falls in the middle of a two byte rune.
+	body := "a" + strings.Repeat("é", MAX_INBOUND_BODY)
+	inbound, err := parseInboundMail(strings.NewReader("From: jane@example.com\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inbound.Body) != MAX_INBOUND_BODY-1 || !utf8.ValidString(inbound.Body) {
+		t.Errorf("body of %d bytes, valid UTF-8 %v, want it cut before the split rune", len(inbound.Body), utf8.ValidString(inbound.Body))
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Page geometry in points, measured from the top left of the page.
+type labelFormat struct {
+	Name        string
+	Description string
+	PageWidth   float64
+	PageHeight  float64
+	Columns     int
+	Rows        int
+	LabelWidth  float64
+	LabelHeight float64
+	MarginLeft  float64
+	MarginTop   float64
+	PitchX      float64 // Distance between the left edges of adjacent labels.
+	PitchY      float64 // Distance between the top edges of adjacent labels.
+	Envelope    bool    // One addressee per page, with optional return address.
+}
+
+var labelFormats = []labelFormat{
+	{
+		Name: "5160", Description: "Avery 5160 (Letter, 30 per sheet)",
+		PageWidth: 8.5 * POINTS_PER_INCH, PageHeight: 11 * POINTS_PER_INCH,
+		Columns: 3, Rows: 10,
+		LabelWidth: 2.625 * POINTS_PER_INCH, LabelHeight: 1 * POINTS_PER_INCH,
+		MarginLeft: 0.1875 * POINTS_PER_INCH, MarginTop: 0.5 * POINTS_PER_INCH,
+		PitchX: 2.75 * POINTS_PER_INCH, PitchY: 1 * POINTS_PER_INCH,
+	},
+	{
+		Name: "5161", Description: "Avery 5161 (Letter, 20 per sheet)",
+		PageWidth: 8.5 * POINTS_PER_INCH, PageHeight: 11 * POINTS_PER_INCH,
+		Columns: 2, Rows: 10,
+		LabelWidth: 4 * POINTS_PER_INCH, LabelHeight: 1 * POINTS_PER_INCH,
+		MarginLeft: 0.15625 * POINTS_PER_INCH, MarginTop: 0.5 * POINTS_PER_INCH,
+		PitchX: 4.1875 * POINTS_PER_INCH, PitchY: 1 * POINTS_PER_INCH,
+	},
+	{
+		Name: "5163", Description: "Avery 5163 (Letter, 10 per sheet)",
+		PageWidth: 8.5 * POINTS_PER_INCH, PageHeight: 11 * POINTS_PER_INCH,
+		Columns: 2, Rows: 5,
+		LabelWidth: 4 * POINTS_PER_INCH, LabelHeight: 2 * POINTS_PER_INCH,
+		MarginLeft: 0.15625 * POINTS_PER_INCH, MarginTop: 0.5 * POINTS_PER_INCH,
+		PitchX: 4.1875 * POINTS_PER_INCH, PitchY: 2 * POINTS_PER_INCH,
+	},
+	{
+		Name: "L7160", Description: "Avery L7160 (A4, 21 per sheet)",
+		PageWidth: 210 * POINTS_PER_MM, PageHeight: 297 * POINTS_PER_MM,
+		Columns: 3, Rows: 7,
+		LabelWidth: 63.5 * POINTS_PER_MM, LabelHeight: 38.1 * POINTS_PER_MM,
+		MarginLeft: 7.2 * POINTS_PER_MM, MarginTop: 15.15 * POINTS_PER_MM,
+		PitchX: 66.04 * POINTS_PER_MM, PitchY: 38.1 * POINTS_PER_MM,
+	},
+	{
+		Name: "L7163", Description: "Avery L7163 (A4, 14 per sheet)",
+		PageWidth: 210 * POINTS_PER_MM, PageHeight: 297 * POINTS_PER_MM,
+		Columns: 2, Rows: 7,
+		LabelWidth: 99.1 * POINTS_PER_MM, LabelHeight: 38.1 * POINTS_PER_MM,
+		MarginLeft: 4.65 * POINTS_PER_MM, MarginTop: 15.15 * POINTS_PER_MM,
+		PitchX: 101.6 * POINTS_PER_MM, PitchY: 38.1 * POINTS_PER_MM,
+	},
+	{
+		Name: "envelope10", Description: "#10 envelope",
+		PageWidth: 9.5 * POINTS_PER_INCH, PageHeight: 4.125 * POINTS_PER_INCH,
+		Columns: 1, Rows: 1, Envelope: true,
+	},
+	{
+		Name: "C6", Description: "C6 envelope",
+		PageWidth: 162 * POINTS_PER_MM, PageHeight: 114 * POINTS_PER_MM,
+		Columns: 1, Rows: 1, Envelope: true,
+	},
+	{
+		Name: "DL", Description: "DL envelope",
+		PageWidth: 220 * POINTS_PER_MM, PageHeight: 110 * POINTS_PER_MM,
+		Columns: 1, Rows: 1, Envelope: true,
+	},
+}
+
+var labelSorts = []string{"", "name", "last", "postal", "country"}
+
+func findLabelFormat(name string) (labelFormat, bool) {
+	for _, format := range labelFormats {
+		if strings.EqualFold(format.Name, name) {
+			return format, true
+		}
+	}
+	return labelFormat{}, false
+}
+
+func sortMailings(mailings []mailing, order string) error {
+	var key func(m *mailing) string
+	switch order {
+	case "":
+		// Datastore key order, same as mailmerge.csv.
+		return nil
+	case "name":
+		key = func(m *mailing) string { return m.Name }
+	case "last":
+		key = func(m *mailing) string { return m.Person.LastName + " " + m.Person.FirstName + " " + m.Name }
+	case "postal":
+		key = func(m *mailing) string {
+			if m.Address == nil {
+				return ""
+			}
+			return m.Address.Country + " " + m.Address.PostalCode
+		}
+	case "country":
+		key = func(m *mailing) string {
+			if m.Address == nil {
+				return ""
+			}
+			return m.Address.Country + " " + m.Name
+		}
+	default:
+		return httpError(http.StatusBadRequest, "unknown sort order %q, expected one of %q", order, labelSorts)
+	}
+
+	slices.SortStableFunc(mailings, func(a, b mailing) int {
+		return strings.Compare(strings.ToLower(key(&a)), strings.ToLower(key(&b)))
+	})
+	return nil
+}
+
+// Name followed by the non-empty address lines.
+func (m *mailing) labelLines() []string {
+	lines := []string{m.Name}
+	for _, line := range m.lines() {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Draws `lines` inside the box, shrinking the font so that every line fits.
+func drawTextBlock(page *pdfPage, x, y, width, height, size float64, lines []string) {
+	const MIN_FONT_SIZE = 6.0
+	const LINE_SPACING = 1.2
+
+	for size > MIN_FONT_SIZE {
+		fits := float64(len(lines))*size*LINE_SPACING <= height
+		for _, line := range lines {
+			fits = fits && pdfTextWidth(line, size) <= width
+		}
+		if fits {
+			break
+		}
+		size -= 0.5
+	}
+
+	for i, line := range lines {
+		// Truncate what still doesn't fit at the minimum size.
+		for line != "" && pdfTextWidth(line, size) > width {
+			runes := []rune(line)
+			line = string(runes[:len(runes)-1])
+		}
+		page.text(x, y+float64(i+1)*size*LINE_SPACING-size*(LINE_SPACING-1), size, line)
+	}
+}
+
+func renderLabels(format labelFormat, mailings []mailing, returnLines []string, skip int) []byte {
+	doc := &pdfDocument{}
+
+	if format.Envelope {
+		for _, m := range mailings {
+			page := doc.addPage(format.PageWidth, format.PageHeight)
+			margin := 0.25 * POINTS_PER_INCH
+			if returnLines != nil {
+				drawTextBlock(page, margin, margin, format.PageWidth*0.45, format.PageHeight*0.35, 9, returnLines)
+			}
+			// Recipient block roughly centered, slightly right and below the middle.
+			drawTextBlock(page, format.PageWidth*0.4, format.PageHeight*0.45,
+				format.PageWidth*0.6-margin, format.PageHeight*0.55-margin, 12, m.labelLines())
+		}
+	} else {
+		// Inset text from the die-cut edge of each label.
+		padding := 0.1 * POINTS_PER_INCH
+		perPage := format.Columns * format.Rows
+		var page *pdfPage
+		for i, m := range mailings {
+			slot := (i + skip) % perPage
+			if page == nil || slot == 0 {
+				page = doc.addPage(format.PageWidth, format.PageHeight)
+			}
+			// Fill across rows, top to bottom.
+			row := slot / format.Columns
+			col := slot % format.Columns
+			x := format.MarginLeft + float64(col)*format.PitchX
+			y := format.MarginTop + float64(row)*format.PitchY
+			drawTextBlock(page, x+padding, y+padding,
+				format.LabelWidth-2*padding, format.LabelHeight-2*padding, 10, m.labelLines())
+		}
+	}
+
+	// A PDF needs at least one page.
+	if len(doc.pages) == 0 {
+		doc.addPage(format.PageWidth, format.PageHeight)
+	}
+
+	return doc.bytes()
+}
+
+func labelsHandler(r *http.Request, ctx context.Context, store Store) ([]byte, error) {
+	name := getValue(r, "format")
+	format, ok := findLabelFormat(name)
+	if !ok {
+		return nil, httpError(http.StatusBadRequest, "unknown label format %q", name)
+	}
+
+	skip := 0
+	if s := getValue(r, "skip"); s != "" {
+		var err error
+		skip, err = strconv.Atoi(s)
+		if err != nil || skip < 0 {
+			return nil, httpError(http.StatusBadRequest, "invalid skip %q, expected a number of labels", s)
+		}
+	}
+
+	mailings, err := requestMailingList(r, ctx, store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch mailing list: %v", err)
+	}
+
+	// Labels are useless without an address.
+	mailings = slices.DeleteFunc(mailings, func(m mailing) bool { return m.Address == nil })
+
+	err = sortMailings(mailings, getValue(r, "sort"))
+	if err != nil {
+		return nil, err
+	}
+
+	var returnLines []string
+	if key := getValue(r, "from"); key != "" {
+		returnLines, err = returnAddressLines(ctx, store, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return renderLabels(format, mailings, returnLines, skip), nil
+}
+
+// Uses the first enabled address of the Person with the given key.
+func returnAddressLines(ctx context.Context, store Store, key string) ([]string, error) {
+	dbkey, err := datastore.DecodeKey(key)
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, "invalid return address person key %q", key)
+	}
+
+	person := &Person{}
+	err = store.Get(ctx, dbkey, person)
+	if err != nil {
+		return nil, httpError(http.StatusNotFound, "failed to get return address person %v: %v", dbkey, err)
+	}
+
+	mailings, err := personMailings(ctx, store, person)
+	if err != nil {
+		return nil, err
+	}
+	if mailings[0].Address == nil {
+		return nil, httpError(http.StatusBadRequest, "return address person %v has no enabled address", dbkey)
+	}
+
+	return mailings[0].labelLines(), nil
+}
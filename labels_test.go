@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func testMailings(n int) []mailing {
+	mailings := make([]mailing, n)
+	for i := range mailings {
+		mailings[i] = mailing{
+			Name:    fmt.Sprintf("Jane (%d) Doe", i+1),
+			Address: &Address{AddressLine1: "1 Main St", City: "Springfield", PostalCode: "12345"},
+		}
+	}
+	return mailings
+}
+
+func TestRenderLabelsPages(t *testing.T) {
+	sheet, _ := findLabelFormat("5160")
+	envelope, _ := findLabelFormat("DL")
+	for _, test := range []struct {
+		format   labelFormat
+		mailings int
+		skip     int
+		pages    int
+	}{
+		{sheet, 0, 0, 1},
+		{sheet, 30, 0, 1},
+		{sheet, 31, 0, 2},
+		{sheet, 61, 0, 3},
+		{sheet, 29, 1, 1},
+		{sheet, 30, 1, 2},
+		{envelope, 3, 0, 3},
+	} {
+		data := renderLabels(test.format, testMailings(test.mailings), nil, test.skip)
+		if pages := checkPDF(t, data); pages != test.pages {
+			t.Errorf("%d %s labels skipping %d on %d pages, want %d", test.mailings, test.format.Name, test.skip, pages, test.pages)
+		}
+		if test.mailings > 0 && !bytes.Contains(data, fmt.Appendf(nil, `(Jane \(%d\) Doe) Tj`, test.mailings)) {
+			t.Errorf("%d %s labels without the escaped last name", test.mailings, test.format.Name)
+		}
+	}
+}
+
+// Skipped labels leave their slots of the first sheet empty.
+func TestRenderLabelsSkip(t *testing.T) {
+	format, _ := findLabelFormat("5160")
+	data := renderLabels(format, testMailings(2), nil, 2)
+	padding := 0.1 * POINTS_PER_INCH
+	for i, slot := range []struct{ row, col int }{{0, 2}, {1, 0}} {
+		x := format.MarginLeft + float64(slot.col)*format.PitchX + padding
+		top := format.PageHeight - format.MarginTop - float64(slot.row)*format.PitchY - padding
+		// The name is the first line, one line below the top of the label.
+		want := fmt.Sprintf("%.2f %.2f Td (Jane \\(%d\\) Doe)", x, top-10, i+1)
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("label %d not in row %d column %d, want %q in\n%s", i+1, slot.row, slot.col, want, data)
+		}
+	}
+}
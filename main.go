@@ -4,10 +4,9 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"io"
+	"html/template"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"regexp"
 	"slices"
@@ -16,7 +15,6 @@ import (
 
 	"cloud.google.com/go/datastore"
 	"google.golang.org/appengine/v2"
-	"google.golang.org/appengine/v2/mail"
 	"google.golang.org/appengine/v2/taskqueue"
 	"google.golang.org/appengine/v2/user"
 )
@@ -29,16 +27,11 @@ const GAE_ENV = "GAE_ENV"                           // `standard` in production.
 const GAE_RUNTIME = "GAE_RUNTIME"                   // Runtime in `app.yaml`.
 const GAE_VERSION = "GAE_VERSION"                   // App version.
 const DUMMY_APP_ID = "my-app-id"
+const MEMORY_STORE = "MEMORY_STORE" // Set in development to run without Datastore.
 
 var ADMINS_FREDSA = []string{"fredsa@gmail.com"}
 var WORDS_RE = regexp.MustCompile(`[^\w=]+`)
 
-func init() {
-	// Register handlers in init() per `appengine.Main()` documentation.
-	http.HandleFunc("/", indexHandler)
-	http.Handle("/static/", http.StripPrefix("/static", http.FileServer(http.Dir("static"))))
-}
-
 func main() {
 	if isDev() {
 		_ = os.Setenv(GAE_APPLICATION, DUMMY_APP_ID)
@@ -49,6 +42,23 @@ func main() {
 		log.Printf("appengine.Main() will listen: %s", defaultVersionOrigin())
 	}
 
+	a := &app{}
+	if isDev() && os.Getenv(MEMORY_STORE) != "" {
+		log.Printf("Using an empty in-memory store")
+		a.store = newMemoryStore()
+	} else {
+		// One client for the lifetime of the instance, shared by all requests.
+		client, err := datastore.NewClient(context.Background(), projectID())
+		if err != nil {
+			log.Fatalf("Failed to create datastore client: %v", err)
+		}
+		defer client.Close()
+		a.store = &datastoreStore{client: client}
+	}
+
+	// `appengine.Main()` serves the default mux.
+	http.Handle("/", a.routes())
+
 	// Standard App Engine APIs require `appengine.Main` to have been called.
 	appengine.Main()
 }
@@ -78,8 +88,15 @@ func datastoreURL() string {
 	return fmt.Sprintf(`https://console.cloud.google.com/datastore/databases/-default-?project=%s`, projectID())
 }
 
+// The signed-in user, replaced in tests that lack an App Engine request context.
+var currentUser = user.Current
+
 func isAdmin(ctx context.Context) bool {
-	return isDev() || slices.Contains(ADMINS_FREDSA, user.Current(ctx).Email)
+	if isDev() {
+		return true
+	}
+	u := currentUser(ctx)
+	return u != nil && slices.Contains(ADMINS_FREDSA, u.Email)
 }
 
 func getValue(r *http.Request, name string) string {
@@ -90,150 +107,279 @@ func getValue(r *http.Request, name string) string {
 	return value
 }
 
-func mailmergeHandler(ctx context.Context, client *datastore.Client) (string, error) {
-	var buffer bytes.Buffer
+// A mailing is one addressee of the card list: a Person and one of its
+// enabled addresses, or no address when none is on file.
+type mailing struct {
+	Person  *Person
+	Address *Address
+	Name    string
+}
 
-	lineFormat := "%q,%q,%q,%q,%q\n"
-	buffer.WriteString(fmt.Sprintf(lineFormat, "Name", "AddressLine1", "AddressLine2", "AddressLine3", "AddressLine4"))
+func (m *mailing) lines() []string {
+	if m.Address == nil {
+		return nil
+	}
+	return m.Address.mailingLines()
+}
+
+func personMailings(ctx context.Context, store Store, person *Person) ([]mailing, error) {
+	name := person.MailingName
+	if name == "" {
+		name = person.displayName()
+	}
 
-	query := datastore.NewQuery("Person")
-	query = query.FilterField("send_card", "=", true)
-	query = query.FilterField("enabled", "=", true)
-	var people []Entity
-	_, err := client.GetAll(ctx, query, &people)
+	aquery := &storeQuery{Kind: "Address", Ancestor: person.Key, After: person.Key, Filters: map[string]any{"enabled": true}, Limit: 2}
+	var addresses []Address
+	_, err := store.GetAll(ctx, aquery, &addresses)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch people: %v", err)
+		return nil, fmt.Errorf("failed to fetch addresses: %v", err)
 	}
 
-	for _, person := range people {
-		name := person.MailingName
-		if name == "" {
-			name = person.displayName()
+	if len(addresses) == 0 {
+		return []mailing{{Person: person, Name: name}}, nil
+	}
+
+	mailings := make([]mailing, len(addresses))
+	for i := range addresses {
+		mailings[i] = mailing{Person: person, Address: &addresses[i], Name: name}
+	}
+	return mailings, nil
+}
+
+func mailingList(ctx context.Context, store Store) ([]mailing, error) {
+	query := &storeQuery{Kind: "Person", Filters: map[string]any{"send_card": true, "enabled": true}}
+	var people []Person
+	_, err := store.GetAll(ctx, query, &people)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch people: %v", err)
+	}
+
+	return peopleMailings(ctx, store, people)
+}
+
+func peopleMailings(ctx context.Context, store Store, people []Person) ([]mailing, error) {
+	var mailings []mailing
+	for i := range people {
+		if !people[i].Enabled {
+			continue
 		}
+		m, err := personMailings(ctx, store, &people[i])
+		if err != nil {
+			return nil, err
+		}
+		mailings = append(mailings, m...)
+	}
 
-		aquery := datastore.NewQuery("Address").Ancestor(person.Key).Limit(2)
-		aquery = aquery.FilterField("__key__", ">", person.Key)
-		aquery = aquery.FilterField("enabled", "=", true)
-		var addresses []Entity
-		_, err = client.GetAll(ctx, aquery, &addresses)
+	return mailings, nil
+}
+
+// Mailing list for the `campaign` and optional `status` request parameters,
+// otherwise everyone with `SendCard`.
+func requestMailingList(r *http.Request, ctx context.Context, store Store) ([]mailing, error) {
+	key := getValue(r, "campaign")
+	if key == "" {
+		return mailingList(ctx, store)
+	}
+
+	campaign, err := getCampaign(ctx, store, key)
+	if err != nil {
+		return nil, err
+	}
+	people, err := campaignPeople(ctx, store, campaign.Key, getValue(r, "status"))
+	if err != nil {
+		return nil, err
+	}
+	return peopleMailings(ctx, store, people)
+}
+
+func mailmergeHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	var buffer bytes.Buffer
+
+	writeRow := func(cells []string) {
+		for i, cell := range cells {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			buffer.WriteString(fmt.Sprintf("%q", cell))
+		}
+		buffer.WriteString("\n")
+	}
+
+	// Custom fields of people and addresses follow the address lines.
+	personFields, err := fetchCustomFields(ctx, store, "Person")
+	if err != nil {
+		return "", err
+	}
+	addressFields, err := fetchCustomFields(ctx, store, "Address")
+	if err != nil {
+		return "", err
+	}
+	header := []string{"Name", "AddressLine1", "AddressLine2", "AddressLine3", "AddressLine4"}
+	for _, f := range slices.Concat(personFields, addressFields) {
+		header = append(header, f.Name)
+	}
+	writeRow(header)
+
+	mailings, err := requestMailingList(r, ctx, store)
+	if err != nil {
+		return "", err
+	}
+	mailings = filterTagged(mailings, parseTags(strings.Join(r.Form["tag"], ",")))
+	style := getValue(r, "join")
+	if style == "" {
+		style = nameJoinStyles[0]
+	} else if !slices.Contains(nameJoinStyles, style) {
+		return "", httpError(http.StatusBadRequest, "unknown join %q, expected one of %q", style, nameJoinStyles)
+	}
+	switch combine := getValue(r, "combine"); combine {
+	case "":
+	case "spouses":
+		mailings, err = combineSpouses(ctx, store, mailings, style)
 		if err != nil {
-			return "", fmt.Errorf("failed to fetch addresses: %v", err)
-		}
-
-		if len(addresses) == 0 {
-			buffer.WriteString(fmt.Sprintf(lineFormat, name,
-				"___________",
-				"___________",
-				"___________",
-				"___________",
-			))
-		}
-
-		for _, a := range addresses {
-			// United States
-			line3 := a.City + ", " + a.StateProvince + " " + a.PostalCode
-			switch a.Country {
-			case "The Netherlands":
-				line3 = a.PostalCode + "  " + a.City
-				if a.StateProvince != "" {
-					line3 = line3 + ", " + a.StateProvince
-				}
-			case "Portugal":
-				line3 = a.PostalCode + "  " + a.City
-				if a.StateProvince != "" {
-					line3 = line3 + ", " + a.StateProvince
-				}
-			case "Canada":
-				line3 = a.City + " " + a.StateProvince + "  " + a.PostalCode
+			return "", err
+		}
+	case "households":
+		mailings, err = combineHouseholds(ctx, store, mailings, style)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", httpError(http.StatusBadRequest, "unknown combine %q, expected spouses or households", combine)
+	}
+
+	for _, m := range mailings {
+		lines := m.lines()
+		if lines == nil {
+			lines = []string{"___________", "___________", "___________", "___________"}
+		}
+		row := append([]string{m.Name}, lines...)
+		for _, f := range personFields {
+			row = append(row, formatCustomValue(m.Person.customValue(f.Name)))
+		}
+		for _, f := range addressFields {
+			value := ""
+			if m.Address != nil {
+				value = formatCustomValue(m.Address.customValue(f.Name))
 			}
-			buffer.WriteString(fmt.Sprintf(lineFormat, name,
-				a.AddressLine1,
-				a.AddressLine2,
-				strings.TrimSpace(line3),
-				a.Country,
-			))
+			row = append(row, value)
 		}
+		writeRow(row)
 	}
 
 	return buffer.String(), nil
 }
 
-func tasknotifyHandler(ctx context.Context, client *datastore.Client) (string, error) {
-	var buffer bytes.Buffer
+func tasknotifyHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	subscribers, err := notifySubscribers()
+	if err != nil {
+		return "", fmt.Errorf("failed to get subscribers: %v", err)
+	}
 
-	// https://cloud.google.com/appengine/docs/standard/services/mail?tab=go#who_can_send_mail
-	// - The Gmail or Google Workspace Account of the user who is currently signed in
-	// - Any email address of the form anything@[MY_PROJECT_ID].appspotmail.com or anything@[MY_PROJECT_NUMBER].appspotmail.com
-	// - Any email address listed in the Google Cloud console under Email API Authorized Senders:
-	sender := fmt.Sprintf("pda@%s.appspotmail.com", projectID())
+	dryRun := getValue(r, "dryrun") != ""
+	return notifyEvents(ctx, store, subscribers, time.Now(), dryRun)
+}
 
-	emailTo := []string{"fredsa@gmail.com", "ambersa@gmail.com"}
+// Notifies every subscriber with one digest of the enabled calendar entries
+// occurring today or within the next `DIGEST_DAYS` days. Entries already sent
+// to a subscriber today are left out, and a failing subscriber doesn't stop
+// the others. With `dryRun` nothing is sent or logged.
+func notifyEvents(ctx context.Context, store Store, subscribers []subscriber, now time.Time, dryRun bool) (string, error) {
+	var buffer bytes.Buffer
 
 	// loc, err := time.LoadLocation("America/Los_Angeles")
 	// if err != nil {
 	// 	log.Fatalf("Failed to load time location: %v", err)
 	// }
-	nowmmdd := time.Now().Format("01-02")
-	query := datastore.NewQuery("Calendar")
-	query = query.FilterEntity(datastore.PropertyFilter{FieldName: "enabled", Operator: "=", Value: true})
-	var events []Entity
-	_, err := client.GetAll(ctx, query, &events)
+	query := &storeQuery{Kind: "Calendar", Filters: map[string]any{"enabled": true}}
+	var events []Calendar
+	_, err := store.GetAll(ctx, query, &events)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch calendar entries: %v", err)
 	}
 
-	buffer.WriteString(fmt.Sprintf("Comparing %d enabled calendar entries ragainst today's date: %v\n", len(events), nowmmdd))
-	for _, event := range events {
-		if !event.Enabled {
+	date := now.Format("2006-01-02")
+	if dryRun {
+		buffer.WriteString("*** dry run *** Nothing will be sent\n")
+	}
+	buffer.WriteString(fmt.Sprintf("Comparing %d enabled calendar entries against today's date: %v\n", len(events), date))
+	d, err := buildDigest(ctx, store, events, now)
+	if err != nil {
+		return "", fmt.Errorf("failed to build digest: %v", err)
+	}
+	for _, entry := range d.Today {
+		buffer.WriteString(fmt.Sprintf("\n>>> MATCH %s %s %s\n", entry.Event.FirstOccurrence.Format("2006-01-02"), entry.Event.Occasion, entry.Name))
+	}
+	for _, entry := range d.Upcoming {
+		buffer.WriteString(fmt.Sprintf("\n>>> UPCOMING %s %s %s\n", entry.Date.Format("2006-01-02"), entry.Event.Occasion, entry.Name))
+	}
+	if d.empty() {
+		buffer.WriteString("\nNothing to notify\n")
+		return buffer.String(), nil
+	}
+
+	failures := 0
+	for _, s := range subscribers {
+		var unsent *digest
+		if dryRun {
+			unsent, err = unsentNotifications(ctx, store, d, s.Name)
+		} else {
+			unsent, err = claimNotifications(ctx, store, d, s.Name, now)
+		}
+		if err != nil {
+			failures++
+			log.Print(err)
+			buffer.WriteString(fmt.Sprintf("\nFAILED to notify %s: %v\n", s.Name, err))
+			continue
+		}
+		if unsent.empty() {
+			buffer.WriteString(fmt.Sprintf("\nAlready notified %s\n", s.Name))
 			continue
 		}
 
-		mmdd := event.FirstOccurrence.Format("01-02")
-		if mmdd == nowmmdd {
-			person := &Entity{}
-			err = client.Get(ctx, event.Key.Parent, person)
-			if err != nil {
-				return "", fmt.Errorf("failed to get person for event: %v", err)
-			}
-
-			event := fmt.Sprintf("%s %s %s", event.FirstOccurrence.Format("2006-01-02"), event.Occasion, event.Comments)
-			body := fmt.Sprintf("%s\n\n%s\n", person.displayName(), person.viewURL())
-			subject := fmt.Sprintf("%s %s", projectID(), event)
-			buffer.WriteString(fmt.Sprintf("\n>>> MATCH %v\n", event))
-
-			msg := &mail.Message{
-				Sender:  sender,
-				To:      emailTo,
-				Subject: subject,
-				Body:    body,
+		notification, err := unsent.notification()
+		if err == nil && dryRun {
+			buffer.WriteString(fmt.Sprintf("\nWould notify %s\nSubject: %s\n%s\n", s.Name, notification.Subject, notification.Body))
+			continue
+		}
+		if err == nil {
+			err = s.Notifier.Notify(ctx, notification)
+		}
+		if err != nil {
+			failures++
+			log.Printf("Failed to notify %s: %v", s.Name, err)
+			buffer.WriteString(fmt.Sprintf("\nFAILED to notify %s: %v\n", s.Name, err))
+			if dryRun {
+				continue
 			}
-			err := mail.Send(ctx, msg)
+			err = releaseNotifications(ctx, store, unsent, s.Name)
 			if err != nil {
-				return "", fmt.Errorf("Failed to send email for %q: %v", event, err)
+				log.Print(err)
+				buffer.WriteString(fmt.Sprintf("%v\n", err))
 			}
-
-			log.Printf("Sent email for event: %q\n", event)
-			log.Printf("- Sender: %s", sender)
-			log.Printf("- To: %s", emailTo)
-			log.Printf("- Subject: %s", subject)
-			log.Printf("- Body: %s", body)
+			continue
 		}
+
+		log.Printf("Notified %s", s.Name)
+		log.Printf("- Subject: %s", notification.Subject)
+		log.Printf("- Body: %s", notification.Body)
+		buffer.WriteString(fmt.Sprintf("\nNotified %s\n", s.Name))
+	}
+
+	// Fail the request so that cron retries, which skips what was already sent.
+	if failures > 0 {
+		return "", fmt.Errorf("failed to notify %d of %d subscribers:\n%s", failures, len(subscribers), buffer.String())
 	}
 
 	return buffer.String(), nil
 }
 
-func wordSearch(ctx context.Context, client *datastore.Client, words []string) ([]*datastore.Key, error) {
+func wordSearch(ctx context.Context, store Store, words []string) ([]*datastore.Key, error) {
 	// Map prevents duplicate results.
 	keymap := make(map[string]*datastore.Key)
 	for _, word := range words {
 		// Kindless queries aren't supported with property filters.
 		for _, kind := range kinds {
-			query := datastore.NewQuery(kind)
-			query = query.FilterEntity(datastore.PropertyFilter{FieldName: "words", Operator: ">=", Value: word})
-			query = query.FilterEntity(datastore.PropertyFilter{FieldName: "words", Operator: "<=", Value: word + "~"})
-			query = query.KeysOnly()
-			keys, err := client.GetAll(ctx, query, Entity{})
+			keys, err := store.QueryByWord(ctx, kind, word)
 			if err != nil {
 				return nil, fmt.Errorf("failed to fetch keys for kind %s, word %s: %v", kind, word, err)
 			}
@@ -244,6 +390,10 @@ func wordSearch(ctx context.Context, client *datastore.Client, words []string) (
 				for key.Parent != nil {
 					key = key.Parent
 				}
+				if key.Kind != "Person" {
+					// E.g. the address of a Household.
+					continue
+				}
 				keymap[key.Encode()] = key
 			}
 		}
@@ -267,50 +417,77 @@ func removeEmtpy(words []string) []string {
 	return result
 }
 
-func searchHandler(ctx context.Context, client *datastore.Client, q string) (string, error) {
-	var buffer bytes.Buffer
+type searchData struct {
+	Words  []string
+	People []template.HTML
+}
 
+func searchHandler(ctx context.Context, store Store, q string) (string, error) {
 	q = strings.TrimSpace(strings.ToLower(q))
-	words := WORDS_RE.Split(q, -1)
+
+	// `rel:<type>` terms find people with a relation of that type.
+	var rels, rest []string
+	for _, term := range strings.Fields(q) {
+		if t, ok := strings.CutPrefix(term, "rel:"); ok {
+			rels = append(rels, t)
+		} else {
+			rest = append(rest, term)
+		}
+	}
+	words := WORDS_RE.Split(strings.Join(rest, " "), -1)
 	words = removeEmtpy(words)
 
-	keys, err := wordSearch(ctx, client, words)
+	keys, err := wordSearch(ctx, store, words)
 	if err != nil {
 		return "", fmt.Errorf("failed to get people keys from query: %v", err)
 	}
-
-	var entities = make([]Entity, len(keys))
-	err = client.GetMulti(ctx, keys, entities)
-	if err != nil {
-		if merr, ok := err.(datastore.MultiError); ok {
-			for i, err := range merr {
-				if err != nil {
-					return "", fmt.Errorf("key[%d]=%q => err=%v", i, keys[i], err)
-				}
+	for _, t := range rels {
+		relKeys, err := relationSearch(ctx, store, t)
+		if err != nil {
+			return "", err
+		}
+		for _, key := range relKeys {
+			if !slices.ContainsFunc(keys, key.Equal) {
+				keys = append(keys, key)
 			}
 		}
-		return "", fmt.Errorf("failed to fetch entities with keys %q: %v", keys, err)
+		words = append(words, "rel:"+t)
+	}
+
+	// Relationships may refer to deleted people.
+	people, err := getPeople(ctx, store, keys)
+	if err != nil {
+		return "", err
 	}
 
-	buffer.WriteString(preamble(ctx, q))
-	buffer.WriteString(fmt.Sprintf("<div>%d result(s) for: %q</div>", len(entities), words))
-	for _, entity := range entities {
-		resp, err := renderPersonView(ctx, client, &entity)
+	data := &searchData{Words: words}
+	for _, person := range people {
+		if person == nil {
+			continue
+		}
+		resp, err := renderPersonView(ctx, store, person)
 		if err != nil {
 			return "", fmt.Errorf("failed to render person view: %v", err)
 		}
-		buffer.WriteString(resp)
+		data.People = append(data.People, resp)
 	}
-	buffer.WriteString(postamble(ctx))
 
-	return buffer.String(), nil
+	content, err := render("search", data)
+	if err != nil {
+		return "", err
+	}
+	return page(ctx, q, content)
 }
 
+// Tasks already added by name count as added, for retried handlers.
 func addTask(ctx context.Context, task *taskqueue.Task) (string, error) {
 	if isDev() {
 		return fmt.Sprintf("*** dev mode *** Not adding task: %s", task.Path), nil
 	} else {
-		task, err := taskqueue.Add(ctx, task, "")
+		_, err := taskqueue.Add(ctx, task, "")
+		if err == taskqueue.ErrTaskAlreadyAdded {
+			return fmt.Sprintf("Already added task: %s", task.Path), nil
+		}
 		if err != nil {
 			return "", fmt.Errorf("failed to add task %v: %v", task.Path, err)
 		}
@@ -323,7 +500,16 @@ func addTasks(ctx context.Context, tasks []*taskqueue.Task) (string, error) {
 	if isDev() {
 		return fmt.Sprintf("*** dev mode *** Not adding %d tasks", len(tasks)), nil
 	} else {
-		tasks, err := taskqueue.AddMulti(ctx, tasks, "")
+		_, err := taskqueue.AddMulti(ctx, tasks, "")
+		if merr, ok := err.(appengine.MultiError); ok {
+			err = nil
+			for i, e := range merr {
+				if e != nil && e != taskqueue.ErrTaskAlreadyAdded {
+					err = fmt.Errorf("task %v: %v", tasks[i].Path, e)
+					break
+				}
+			}
+		}
 		if err != nil {
 			return "", fmt.Errorf("failed to add %v tasks: %v", len(tasks), err)
 		}
@@ -332,153 +518,263 @@ func addTasks(ctx context.Context, tasks []*taskqueue.Task) (string, error) {
 	}
 }
 
-func fixPersonHandler(ctx context.Context, client *datastore.Client, key string) (string, error) {
+// Migrates the Person and its descendants, recording the result in the
+// migration run, if any. Failures of a run are recorded for a retry from its
+// status page, rather than retried by the queue.
+func fixPersonHandler(ctx context.Context, store Store, key string, runKey string) (string, error) {
 	var buffer bytes.Buffer
 
 	dbkey, err := datastore.DecodeKey(key)
 	if err != nil {
 		return "", fmt.Errorf("failed to decode person key %q: %v", key, err)
 	}
+	if runKey == "" {
+		err = migratePerson(ctx, store, dbkey, false, &MigrationResult{}, &buffer)
+		if err != nil {
+			return "", err
+		}
+		buffer.WriteString("Done")
+		return buffer.String(), nil
+	}
+
+	run, err := getMigrationRun(ctx, store, runKey)
+	if err != nil {
+		return "", err
+	}
+	result := &MigrationResult{Person: dbkey}
+	err = migratePerson(ctx, store, dbkey, run.DryRun, result, &buffer)
+	if err != nil {
+		result.Error = err.Error()
+		buffer.WriteString(fmt.Sprintf("Failed: %v\n", err))
+	}
+	result.Done = time.Now()
+	resultKey := migrationResultKey(run, dbkey)
+	_, err = store.Put(ctx, resultKey, result)
+	if err != nil {
+		return "", fmt.Errorf("failed to put migration result %v: %v", resultKey, err)
+	}
 
+	// Fresh, the fan-out may have finished since.
+	run, err = getMigrationRun(ctx, store, runKey)
+	if err != nil {
+		return "", err
+	}
+	err = finishMigrationRun(ctx, store, run)
+	if err != nil {
+		return "", err
+	}
+
+	buffer.WriteString("Done")
+	return buffer.String(), nil
+}
+
+func migratePerson(ctx context.Context, store Store, key *datastore.Key, dryRun bool, result *MigrationResult, buffer *bytes.Buffer) error {
 	// Results include ancestor Person and all descendents.
-	query := datastore.NewQuery("").Ancestor(dbkey)
-	var entities []Entity
-	_, err = client.GetAll(ctx, query, &entities)
+	entities, err := fetchFamily(ctx, store, key)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch all to be fixed entities: %v", err)
+		return fmt.Errorf("failed to fetch all to be fixed entities: %v", err)
 	}
 
+	result.Entities = len(entities)
 	buffer.WriteString(fmt.Sprintf("Fixing %d entities:\n", len(entities)))
 	keys := make([]*datastore.Key, len(entities))
 	for i, e := range entities {
-		keys[i] = e.Key
-		buffer.WriteString(fmt.Sprintf("%4d: %v\n", i+1, e.Key))
-		before := fmt.Sprintf("%v", e)
-		e.fix()
+		keys[i] = e.key()
+		buffer.WriteString(fmt.Sprintf("%4d: %v\n", i+1, e.key()))
+		before := modelString(e)
+		applied := migrate(e)
 
-		after := fmt.Sprintf("%v", e)
+		after := modelString(e)
 		if before == after {
 			buffer.WriteString("Same")
 		} else {
-			buffer.WriteString(fmt.Sprintf("Before: %v\n", before))
-			buffer.WriteString(fmt.Sprintf("After : %v\n", after))
+			diff := fmt.Sprintf("%v %q\nBefore: %v\nAfter : %v\n", e.key(), applied, before, after)
+			buffer.WriteString(diff)
+			result.Changed++
+			if dryRun {
+				result.Diff += diff
+			}
 		}
 		buffer.WriteString(fmt.Sprint(strings.Repeat("\n", 10)))
-
-		entities[i] = e
 	}
-	_, err = client.PutMulti(ctx, keys, entities)
+	if dryRun {
+		buffer.WriteString("*** dry run *** Nothing was saved\n")
+		return nil
+	}
+	_, err = store.PutMulti(ctx, keys, entities)
 	if err != nil {
-		return "", fmt.Errorf("failed to put %d fixed entities: %v", len(entities), err)
+		return fmt.Errorf("failed to put %d fixed entities: %v", len(entities), err)
 	}
-
-	buffer.WriteString("Done")
-	return buffer.String(), nil
+	return nil
 }
 
-func fixAllHandler(ctx context.Context, client *datastore.Client, next string) (string, error) {
+// Queues a `/task/fix/person/` task for each Person in a batch that is below
+// the target version of the run, continuing after the batch in a new
+// task. Without a run, as from the admin form, starts one.
+func fixAllHandler(ctx context.Context, store Store, next string, runKey string) (string, error) {
 	var buffer bytes.Buffer
 
 	// https://cloud.google.com/appengine/docs/standard/quotas#Task_Queue
 	MAX_TASKS_PER_BATCH := 100
 
-	query := datastore.NewQuery("Person")
-	query = query.Limit(MAX_TASKS_PER_BATCH)
+	var run *MigrationRun
+	var err error
+	if runKey == "" {
+		run, err = newMigrationRun(ctx, store, false)
+		if err != nil {
+			return "", err
+		}
+		buffer.WriteString(fmt.Sprintf("Started migration run %v to version %d\n", run.Key, run.Target))
+	} else {
+		run, err = getMigrationRun(ctx, store, runKey)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	query := &storeQuery{Kind: "Person", Limit: MAX_TASKS_PER_BATCH}
 
 	if next != "" {
 		key, err := datastore.DecodeKey(next)
 		if err != nil {
 			return "", fmt.Errorf("failed to decode person key %q: %v", next, err)
 		}
-		query = query.FilterField("__key__", ">", key)
+		query.After = key
+	}
+	// A retried task doesn't count its batch twice.
+	if run.FannedOut || !query.After.Equal(run.Cursor) {
+		return "Batch already queued", nil
 	}
 
-	var people []Entity
-	_, err := client.GetAll(ctx, query, &people)
+	var people []Person
+	_, err = store.GetAll(ctx, query, &people)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch person entities: %v", err)
 	}
 
-	if len(people) == MAX_TASKS_PER_BATCH {
-		next := people[MAX_TASKS_PER_BATCH-1].Key
-		path, err := url.JoinPath("/task/fix", "all", next.Encode())
+	// People of a retried batch whose task already ran are counted again.
+	resultKeys := make([]*datastore.Key, len(people))
+	for i := range people {
+		resultKeys[i] = migrationResultKey(run, people[i].Key)
+	}
+	results := make([]MigrationResult, len(people))
+	err = store.GetMulti(ctx, resultKeys, results)
+	merr, _ := err.(datastore.MultiError)
+	if err != nil && merr == nil {
+		return "", fmt.Errorf("failed to get migration results of %d people: %v", len(people), err)
+	}
+
+	var tasks []*taskqueue.Task
+	for i := range people {
+		person := &people[i]
+		if merr != nil && merr[i] != nil && merr[i] != datastore.ErrNoSuchEntity {
+			return "", fmt.Errorf("failed to get migration result %v: %v", resultKeys[i], merr[i])
+		}
+		done := merr == nil || merr[i] == nil
+		// A tree is migrated as a whole, so the Person's version stands for
+		// its children, which aren't read here.
+		if !done && person.Schema >= run.Target {
+			continue
+		}
+		tasks = append(tasks, fixPersonTask(run, person.Key))
+	}
+
+	// Queued before the run advances, so a failure here retries the batch,
+	// whose named tasks aren't added twice.
+	if len(tasks) > 0 {
+		resp, err := addTasks(ctx, tasks)
 		if err != nil {
-			return "", fmt.Errorf("failed to join path: %v", err)
+			return "", fmt.Errorf("failed to add tasks: %v", err)
 		}
-		buffer.WriteString(fmt.Sprintf("Adding continuation task: %v\n", path))
-		task := taskqueue.NewPOSTTask(path, nil)
-		resp, err := addTask(ctx, task)
+		buffer.WriteString(resp + "\n")
+	}
+	fannedOut := len(people) < MAX_TASKS_PER_BATCH
+	if !fannedOut {
+		cursor := people[MAX_TASKS_PER_BATCH-1].Key
+		buffer.WriteString(fmt.Sprintf("Adding continuation task after %v\n", cursor))
+		resp, err := addTask(ctx, fixAllTask(run, cursor))
 		if err != nil {
-			return "", fmt.Errorf("failed to add continuation task with key %v: %v", next, err)
+			return "", fmt.Errorf("failed to add continuation task with key %v: %v", cursor, err)
 		}
-		buffer.WriteString(resp)
+		buffer.WriteString(resp + "\n")
+		run.Cursor = cursor
 	}
 
-	buffer.WriteString(fmt.Sprintf("\n\nCreating %d tasks:\n", len(people)))
-	tasks := make([]*taskqueue.Task, len(people))
-	for i, person := range people {
-		path, err := url.JoinPath("/task/fix", "Person", person.Key.Encode())
+	run.Checked += len(people)
+	run.Queued += len(tasks)
+	run.FannedOut = fannedOut
+	_, err = store.Put(ctx, run.Key, run)
+	if err != nil {
+		return "", fmt.Errorf("failed to put migration run %v: %v", run.Key, err)
+	}
+	if run.FannedOut {
+		err = finishMigrationRun(ctx, store, run)
 		if err != nil {
-			return "", fmt.Errorf("failed to join person path: %v", err)
+			return "", err
 		}
-		tasks[i] = taskqueue.NewPOSTTask(path, nil)
-		buffer.WriteString(fmt.Sprintf("%4d: %v => %v  %v\n", i+1, tasks[i].Path, person.Key, person.displayName()))
 	}
-	resp, err := addTasks(ctx, tasks)
-	if err != nil {
-		return "", fmt.Errorf("failed to add tasks: %v", err)
+
+	buffer.WriteString(fmt.Sprintf("\n\nCreated %d tasks for %d people:\n", len(tasks), len(people)))
+	for i, task := range tasks {
+		buffer.WriteString(fmt.Sprintf("%4d: %v\n", i+1, task.Path))
 	}
-	buffer.WriteString(resp)
 
 	return buffer.String(), nil
 }
 
-func fixHandler(r *http.Request, ctx context.Context, client *datastore.Client) (string, error) {
-	// Expect one of:
-	// - `/task/fix/all/`         => []string{ "" "task" "fix" "all" "" }
-	// - `/task/fix/all/<key>`    => []string{ "" "task" "fix" "Person" "<key>" }
-	// - `/task/fix/Person/<key>` => []string{ "" "task" "fix" "Person" "<key>" }
-	segments := strings.Split(r.URL.Path, "/")
-
-	if len(segments) != 5 {
-		return "", fmt.Errorf("invalid segments: %q", segments)
+// Renders the Person of the entity, the root entity being always displayed.
+func viewEntity(ctx context.Context, store Store, m model) (string, error) {
+	person, ok := m.(*Person)
+	if !ok {
+		// Prevent stale data in un-updated fields.
+		person = &Person{}
+		err := store.Get(ctx, m.key().Parent, person)
+		if err != nil {
+			return "", fmt.Errorf("failed to get parent entity: %v", err)
+		}
 	}
-
-	switch segments[3] {
-	case "Person":
-		return fixPersonHandler(ctx, client, segments[4])
-	case "all":
-		return fixAllHandler(ctx, client, segments[4])
-	default:
-		return "", fmt.Errorf("unhandled path segment %s for path: %s", segments[1], r.URL.Path)
+	personview, err := renderPersonView(ctx, store, person)
+	if err != nil {
+		return "", fmt.Errorf("failed to render person view: %v", err)
 	}
+	return page(ctx, "", personview)
 }
 
-func viewEntity(ctx context.Context, client *datastore.Client, entity *Entity) (string, error) {
-	var buffer bytes.Buffer
-
-	buffer.WriteString(preamble(ctx, ""))
-	personview, err := renderPersonView(ctx, client, entity)
+func personHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	key := r.PathValue("key")
+	dbkey, err := datastore.DecodeKey(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to render person view: %v", err)
+		return "", httpError(http.StatusBadRequest, "failed to decode key %q: %v", key, err)
 	}
-	buffer.WriteString(personview)
-	buffer.WriteString(postamble(ctx))
 
-	return buffer.String(), nil
+	person := &Person{}
+	err = store.Get(ctx, dbkey, person)
+	if err == datastore.ErrNoSuchEntity {
+		return "", httpError(http.StatusNotFound, "no such person %v", dbkey)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get %v: %v", dbkey, err)
+	}
+	return viewEntity(ctx, store, person)
 }
 
-func editEntity(ctx context.Context, entity *Entity) string {
-	var buffer bytes.Buffer
-
-	buffer.WriteString(preamble(ctx, ""))
-	buffer.WriteString(form(ctx, entity))
-	buffer.WriteString(postamble(ctx))
-
-	return buffer.String()
+func editEntity(ctx context.Context, store Store, m model) (string, error) {
+	choices, err := fetchChoices(ctx, store)
+	if err != nil {
+		return "", err
+	}
+	custom, err := fetchCustomFields(ctx, store, m.key().Kind)
+	if err != nil {
+		return "", err
+	}
+	content, err := form(ctx, m, choices, custom)
+	if err != nil {
+		return "", err
+	}
+	return page(ctx, "", content)
 }
 
-func mainPageHandler(r *http.Request, ctx context.Context, client *datastore.Client) (string, error) {
+func mainPageHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
 	var buffer bytes.Buffer
 
 	q := getValue(r, "q")
@@ -486,7 +782,7 @@ func mainPageHandler(r *http.Request, ctx context.Context, client *datastore.Cli
 	key := getValue(r, "key")
 
 	if q != "" {
-		resp, err := searchHandler(ctx, client, q)
+		resp, err := searchHandler(ctx, store, q)
 		if err != nil {
 			return "", fmt.Errorf("failed to search: %v", err)
 		}
@@ -498,138 +794,99 @@ func mainPageHandler(r *http.Request, ctx context.Context, client *datastore.Cli
 			if err != nil {
 				return "", fmt.Errorf("failed to decode key %q: %v", key, err)
 			}
-			entity := Entity{
-				// Key: &datastore.Key{
-				// Kind: kind,
-				// },
-				Key: dbkey,
+			entity, err := newModel(dbkey)
+			if err != nil {
+				return "", httpError(http.StatusBadRequest, "%v", err)
+			}
+			resp, err := editEntity(ctx, store, entity)
+			if err != nil {
+				return "", err
+			}
+			buffer.WriteString(resp)
+		case "cardsent":
+			dbkey, err := datastore.DecodeKey(key)
+			if err != nil {
+				return "", fmt.Errorf("failed to decode key %q: %v", key, err)
+			}
+			if dbkey.Kind != "Calendar" {
+				return "", httpError(http.StatusBadRequest, "not a calendar entry: %v", dbkey)
+			}
+			event := &Calendar{}
+			err = store.Get(ctx, dbkey, event)
+			if err != nil {
+				return "", fmt.Errorf("failed to get %s: %v", dbkey, err)
+			}
+
+			// Only confirm on GET, so that following an email link changes nothing.
+			if r.Method == "POST" {
+				event.CardSent = time.Now()
+				event.fix()
+				_, err = saveModel(ctx, store, event)
+				if err != nil {
+					return "", fmt.Errorf("unable to save entity: %v", err)
+				}
+				resp, err := viewEntity(ctx, store, event)
+				if err != nil {
+					return "", fmt.Errorf("failed to view entity: %v", err)
+				}
+				buffer.WriteString(resp)
+			} else {
+				resp, err := renderPage(ctx, "cardsent", &cardSentData{Event: event, CSRF: csrfToken(ctx)})
+				if err != nil {
+					return "", err
+				}
+				buffer.WriteString(resp)
 			}
-			buffer.WriteString(editEntity(ctx, &entity))
 		case "view":
-			entity, err := requestToEntity(r, ctx, client)
+			entity, err := requestToModel(r, ctx, store)
 			if err != nil {
 				return "", fmt.Errorf("unable to convert request to person: %v", err)
 			}
-			buffer.WriteString(preamble(ctx, q))
-			personview, err := renderPersonView(ctx, client, entity)
+			resp, err := viewEntity(ctx, store, entity)
 			if err != nil {
-				return "", fmt.Errorf("failed to render person view: %v", err)
+				return "", fmt.Errorf("failed to view entity: %v", err)
 			}
-			buffer.WriteString(personview)
-			buffer.WriteString(postamble(ctx))
+			buffer.WriteString(resp)
 		case "edit":
-			entity, err := requestToEntity(r, ctx, client)
+			entity, err := requestToModel(r, ctx, store)
 			if err != nil {
 				return "", fmt.Errorf("unable to convert request to entity: %v", err)
 			}
 
 			if r.Method == "POST" {
+				if address, ok := entity.(*Address); ok {
+					err = locateEditedAddress(ctx, store, address)
+					if err != nil {
+						return "", err
+					}
+				}
 				entity.fix()
-				dbkey, err := entity.save(ctx, client)
+				dbkey, err := saveModel(ctx, store, entity)
 				if err != nil {
 					return "", fmt.Errorf("unable to save entity: %v", err)
 				}
-				entity.Key = dbkey
-
-				// Always display root entity.
-				if dbkey.Parent != nil {
-					dbkey = dbkey.Parent
-					// Prevent stale data in un-updated fields.
-					entity = &Entity{}
-					err = client.Get(ctx, dbkey, entity)
-					if err != nil {
-						return "", fmt.Errorf("failed to get parent entity: %v", err)
-					}
-				}
-				resp, err := viewEntity(ctx, client, entity)
+				entity.LoadKey(dbkey)
+
+				resp, err := viewEntity(ctx, store, entity)
 				if err != nil {
 					return "", fmt.Errorf("failed to view entity: %v", err)
 				}
 				buffer.WriteString(resp)
 			} else {
-				buffer.WriteString(editEntity(ctx, entity))
+				resp, err := editEntity(ctx, store, entity)
+				if err != nil {
+					return "", err
+				}
+				buffer.WriteString(resp)
 			}
 		default:
-			buffer.WriteString(preamble(ctx, q))
-			buffer.WriteString(postamble(ctx))
+			resp, err := page(ctx, q, "")
+			if err != nil {
+				return "", err
+			}
+			buffer.WriteString(resp)
 		}
 	}
 
 	return buffer.String(), nil
 }
-
-func indexHandler(w http.ResponseWriter, r *http.Request) {
-	// App Engine context for the in-flight HTTP request.
-	ctx := appengine.NewContext(r)
-
-	client, err := datastore.NewClient(ctx, projectID())
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to create client: %v", err), http.StatusInternalServerError)
-		return
-	}
-	defer client.Close()
-
-	if r.URL.Path == "/_ah/bounce" {
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusInternalServerError)
-			return
-		}
-		defer r.Body.Close()
-
-		fmt.Fprintf(w, "Received bounced email:\n%s", body)
-		return
-	}
-
-	if r.URL.Path == "/mailmerge" {
-		resp, err := mailmergeHandler(ctx, client)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to json export %q: %v", r.URL.Path, err), http.StatusInternalServerError)
-			return
-		}
-		fmt.Fprint(w, resp)
-		return
-	}
-
-	// Runs daily from `cron.yaml`, or manually from admin link.
-	if r.URL.Path == "/task/notify" {
-		resp, err := tasknotifyHandler(ctx, client)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to handle task %q: %v", r.URL.Path, err), http.StatusInternalServerError)
-			return
-		}
-		fmt.Fprint(w, resp)
-		return
-	}
-
-	// Fix entities.
-	if strings.HasPrefix(r.URL.Path, "/task/fix") {
-		resp, err := fixHandler(r, ctx, client)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed fix handler: %v", err), http.StatusInternalServerError)
-			return
-		}
-		fmt.Fprint(w, resp)
-		return
-	}
-
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
-		return
-	}
-
-	if r.Method == "POST" {
-		err := r.ParseForm()
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to parse form: %v", err), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	resp, err := mainPageHandler(r, ctx, client)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to render main page: %v", err), http.StatusInternalServerError)
-		return
-	}
-	fmt.Fprint(w, resp)
-}
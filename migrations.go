@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/appengine/v2/taskqueue"
+)
+
+// A change of the stored entities of some kinds, applied once to each entity
+// whose `Schema` is below `Version`. Migrations run in `fixPersonHandler`
+// before `fix()`, and must leave an already migrated entity unchanged.
+type migration struct {
+	Version int
+	Name    string
+	Kinds   []string // Empty for every kind.
+	Migrate func(m model)
+}
+
+// In version order. Append new migrations with the next version, never
+// renumber or remove one that has run.
+var migrations = []migration{
+	{Version: 1, Name: "Trim whitespace of text fields", Migrate: trimTextFields},
+	{Version: 2, Name: "Split full names", Kinds: []string{"Person"}, Migrate: splitFullName},
+}
+
+// Version of entities saved with the current code.
+func schemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Applies the migrations above the entity's `Schema`, then `fix()`. Returns
+// the names of the applied migrations.
+func migrate(m model) []string {
+	var applied []string
+	c := m.common()
+	for _, mig := range migrations {
+		if mig.Version <= c.Schema || (len(mig.Kinds) > 0 && !slices.Contains(mig.Kinds, m.key().Kind)) {
+			continue
+		}
+		mig.Migrate(m)
+		applied = append(applied, mig.Name)
+	}
+	c.Schema = max(c.Schema, schemaVersion())
+	m.fix()
+	return applied
+}
+
+func trimTextFields(m model) {
+	fields, v := modelFields(m)
+	for _, field := range fields {
+		if field.Type.Kind() == reflect.String && field.Tag.Get("form") != "textarea" {
+			value := v.FieldByIndex(field.Index)
+			value.SetString(strings.Join(strings.Fields(value.String()), " "))
+		}
+	}
+}
+
+// People entered with the full name as the last name, e.g. "Jane Doe", get
+// the last word as last name and the others as first name.
+func splitFullName(m model) {
+	person := m.(*Person)
+	if person.FirstName != "" || person.CompanyName != "" {
+		return
+	}
+	if i := strings.LastIndex(person.LastName, " "); i > 0 {
+		person.FirstName, person.LastName = person.LastName[:i], person.LastName[i+1:]
+	}
+}
+
+// One run of `/task/fix/all/`, migrating every Person tree below `Target`.
+// Root entity, with a `MigrationResult` child per migrated Person.
+type MigrationRun struct {
+	Key       *datastore.Key `datastore:"__key__"`
+	Created   time.Time      `datastore:"created"`
+	Target    int            `datastore:"target,noindex"`
+	DryRun    bool           `datastore:"dry_run,noindex"`    // Only records the diffs.
+	Checked   int            `datastore:"checked,noindex"`    // People examined so far.
+	Queued    int            `datastore:"queued,noindex"`     // People below `Target`, with a task each.
+	Cursor    *datastore.Key `datastore:"cursor,noindex"`     // Last Person examined, where the next batch starts.
+	FannedOut bool           `datastore:"fanned_out,noindex"` // Every Person was examined.
+	Finished  time.Time      `datastore:"finished,noindex"`   // Every queued Person has a result.
+	Retried   time.Time      `datastore:"retried,noindex"`    // Last retry of the failed people.
+}
+
+// The migration of one Person tree, named after the encoded Person key.
+type MigrationResult struct {
+	Person   *datastore.Key `datastore:"person,noindex"`
+	Entities int            `datastore:"entities,noindex"`
+	Changed  int            `datastore:"changed,noindex"`
+	Diff     string         `datastore:"diff,noindex"` // Before and after of the changed entities, for dry runs.
+	Error    string         `datastore:"error,noindex"`
+	Done     time.Time      `datastore:"done,noindex"`
+}
+
+func newMigrationRun(ctx context.Context, store Store, dryRun bool) (*MigrationRun, error) {
+	run := &MigrationRun{Created: time.Now(), Target: schemaVersion(), DryRun: dryRun}
+	key, err := store.Put(ctx, datastore.IncompleteKey("MigrationRun", nil), run)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put migration run: %v", err)
+	}
+	run.Key = key
+	return run, nil
+}
+
+func getMigrationRun(ctx context.Context, store Store, key string) (*MigrationRun, error) {
+	dbkey, err := datastore.DecodeKey(key)
+	if err != nil || dbkey.Kind != "MigrationRun" {
+		return nil, httpError(http.StatusBadRequest, "invalid migration run key %q", key)
+	}
+	run := &MigrationRun{}
+	err = store.Get(ctx, dbkey, run)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get migration run %v: %v", dbkey, err)
+	}
+	return run, nil
+}
+
+func fetchMigrationResults(ctx context.Context, store Store, run *MigrationRun) ([]*MigrationResult, error) {
+	var results []*MigrationResult
+	_, err := store.QueryChildren(ctx, run.Key, "MigrationResult", &results)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch results of migration run %v: %v", run.Key, err)
+	}
+	return results, nil
+}
+
+// Task of the fan-out of the run, starting after the `next` Person.
+// Named after the run and the batch, so a retried batch queues its
+// continuation once.
+func fixAllTask(run *MigrationRun, next *datastore.Key) *taskqueue.Task {
+	path := "/task/fix/all/"
+	name := "fixall-" + run.Key.Encode() + "-start"
+	if next != nil {
+		path += next.Encode()
+		name = "fixall-" + run.Key.Encode() + "-" + next.Encode()
+	}
+	task := taskqueue.NewPOSTTask(path, url.Values{"run": {run.Key.Encode()}})
+	task.Name = name
+	return task
+}
+
+// Named after the run, the Person and the last retry of the run, so a
+// retried batch queues each Person once.
+func fixPersonTask(run *MigrationRun, person *datastore.Key) *taskqueue.Task {
+	task := taskqueue.NewPOSTTask("/task/fix/person/"+person.Encode(), url.Values{"run": {run.Key.Encode()}})
+	task.Name = fmt.Sprintf("fix-%s-%s-%d", run.Key.Encode(), person.Encode(), run.Retried.Unix())
+	return task
+}
+
+func migrationResultKey(run *MigrationRun, person *datastore.Key) *datastore.Key {
+	return datastore.NameKey("MigrationResult", person.Encode(), run.Key)
+}
+
+// Records the end time once every queued Person has a result. Only called
+// after the fan-out, which would otherwise overwrite the run.
+func finishMigrationRun(ctx context.Context, store Store, run *MigrationRun) error {
+	if !run.FannedOut || !run.Finished.IsZero() {
+		return nil
+	}
+	results, err := fetchMigrationResults(ctx, store, run)
+	if err != nil {
+		return err
+	}
+	if len(results) < run.Queued || slices.ContainsFunc(results, run.retrying) {
+		return nil
+	}
+	run.Finished = time.Now()
+	_, err = store.Put(ctx, run.Key, run)
+	if err != nil {
+		return fmt.Errorf("failed to put migration run %v: %v", run.Key, err)
+	}
+	return nil
+}
+
+// Whether the failed result awaits its retry.
+func (run *MigrationRun) retrying(result *MigrationResult) bool {
+	return result.Error != "" && result.Done.Before(run.Retried)
+}
+
+type migrationRunRow struct {
+	Run     *MigrationRun
+	Done    int
+	Failed  int
+	Changed int
+	Status  string
+}
+
+func migrationRunStatus(ctx context.Context, store Store, run *MigrationRun) (*migrationRunRow, []*MigrationResult, error) {
+	results, err := fetchMigrationResults(ctx, store, run)
+	if err != nil {
+		return nil, nil, err
+	}
+	row := &migrationRunRow{Run: run}
+	for _, result := range results {
+		if result.Error != "" {
+			row.Failed++
+			continue
+		}
+		row.Done++
+		row.Changed += result.Changed
+	}
+	switch {
+	case !run.FannedOut:
+		row.Status = fmt.Sprintf("queuing, %d people examined", run.Checked)
+	case row.Done+row.Failed < run.Queued:
+		row.Status = fmt.Sprintf("%d of %d people migrated", row.Done+row.Failed, run.Queued)
+	case slices.ContainsFunc(results, run.retrying):
+		row.Status = fmt.Sprintf("retrying %d failed", row.Failed)
+	case row.Failed > 0:
+		row.Status = fmt.Sprintf("%d failed", row.Failed)
+	default:
+		row.Status = "done"
+	}
+	return row, results, nil
+}
+
+type migrationsData struct {
+	Message    string
+	Version    int
+	Migrations []migration
+	Runs       []*migrationRunRow
+	Run        *migrationRunRow
+	Results    []*MigrationResult // Of `Run`, those failed or with changes.
+	CSRF       string
+}
+
+// Lists the migrations and the recent runs, and starts runs, dry or not.
+func migrationsHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	action := getValue(r, "action")
+	data := &migrationsData{Version: schemaVersion(), Migrations: migrations, CSRF: csrfToken(ctx)}
+
+	if action != "" && r.Method != "POST" {
+		return "", httpError(http.StatusMethodNotAllowed, "action %q requires POST", action)
+	}
+
+	switch action {
+	case "":
+	case "retry":
+		run, err := getMigrationRun(ctx, store, getValue(r, "run"))
+		if err != nil {
+			return "", err
+		}
+		if !run.FannedOut {
+			return "", httpError(http.StatusConflict, "migration run %v is still queuing", run.Key)
+		}
+		results, err := fetchMigrationResults(ctx, store, run)
+		if err != nil {
+			return "", err
+		}
+		run.Retried = time.Now()
+		var tasks []*taskqueue.Task
+		for _, result := range results {
+			if result.Error != "" {
+				tasks = append(tasks, fixPersonTask(run, result.Person))
+			}
+		}
+		if len(tasks) == 0 {
+			data.Message = "No failed people to retry"
+			break
+		}
+		run.Finished = time.Time{}
+		_, err = store.Put(ctx, run.Key, run)
+		if err != nil {
+			return "", fmt.Errorf("failed to put migration run %v: %v", run.Key, err)
+		}
+		resp, err := addTasks(ctx, tasks)
+		if err != nil {
+			return "", err
+		}
+		data.Message = fmt.Sprintf("Retrying %d failed people. %s", len(tasks), resp)
+	case "start", "dryrun":
+		run, err := newMigrationRun(ctx, store, action == "dryrun")
+		if err != nil {
+			return "", err
+		}
+		resp, err := addTask(ctx, fixAllTask(run, nil))
+		if err != nil {
+			return "", err
+		}
+		data.Message = fmt.Sprintf("Started migration run to version %d. %s", run.Target, resp)
+	default:
+		return "", fmt.Errorf("unknown migrations action %q", action)
+	}
+
+	if key := getValue(r, "run"); key != "" {
+		run, err := getMigrationRun(ctx, store, key)
+		if err != nil {
+			return "", err
+		}
+		row, results, err := migrationRunStatus(ctx, store, run)
+		if err != nil {
+			return "", err
+		}
+		data.Run = row
+		for _, result := range results {
+			if result.Error != "" || result.Changed > 0 {
+				data.Results = append(data.Results, result)
+			}
+		}
+	}
+
+	var runs []*MigrationRun
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "MigrationRun", Order: "-created", Limit: 10}, &runs)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch migration runs: %v", err)
+	}
+	for _, run := range runs {
+		row, _, err := migrationRunStatus(ctx, store, run)
+		if err != nil {
+			return "", err
+		}
+		data.Runs = append(data.Runs, row)
+	}
+
+	return renderPage(ctx, "migrations", data)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestMigrate(t *testing.T) {
+	key := datastore.IDKey("Person", 1, nil)
+	for _, test := range []struct {
+		schema      int
+		applied     []string
+		first, last string
+	}{
+		{0, []string{"Trim whitespace of text fields", "Split full names"}, "Jane", "Doe"},
+		{1, []string{"Split full names"}, " Jane", "Doe"},
+		{schemaVersion(), nil, "", " Jane Doe"},
+	} {
+		person := &Person{Key: key, LastName: " Jane Doe", Common: Common{Schema: test.schema}}
+		applied := migrate(person)
+		if !slices.Equal(applied, test.applied) || person.FirstName != test.first || person.LastName != test.last || person.Schema != schemaVersion() {
+			t.Errorf("schema %d: applied %q to %+v, want %q with %q %q", test.schema, applied, person, test.applied, test.first, test.last)
+		}
+	}
+}
+
+// Only people below the target are queued, without reading their children.
+func TestFixAllBelowTarget(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	var key *datastore.Key
+	for _, schema := range []int{0, schemaVersion()} {
+		var err error
+		key, err = saveModel(ctx, store, &Person{Key: datastore.IncompleteKey("Person", nil), LastName: "Doe", Common: Common{Enabled: true, Schema: schema}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The version of a migrated Person stands for its tree.
+	_, err := saveModel(ctx, store, &Address{Key: datastore.IncompleteKey("Address", key), City: "Springfield"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := newMigrationRun(ctx, store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fixAllHandler(ctx, store, "", run.Key.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err = getMigrationRun(ctx, store, run.Key.Encode())
+	if err != nil || run.Checked != 2 || run.Queued != 1 {
+		t.Errorf("run %+v, %v, want one of two people queued", run, err)
+	}
+}
+
+func TestFixAllRetry(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	var people []*datastore.Key
+	for _, name := range []string{"Jane Doe", "John Doe"} {
+		key, err := saveModel(ctx, store, &Person{Key: datastore.IncompleteKey("Person", nil), LastName: name, Common: Common{Enabled: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, key)
+	}
+	run, err := newMigrationRun(ctx, store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fixAllHandler(ctx, store, "", run.Key.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch is retried after its tasks were added, one of which already
+	// migrated its Person.
+	_, err = fixPersonHandler(ctx, store, people[0].Encode(), run.Key.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Put(ctx, run.Key, &MigrationRun{Created: run.Created, Target: run.Target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fixAllHandler(ctx, store, "", run.Key.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err = getMigrationRun(ctx, store, run.Key.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Checked != 2 || run.Queued != 2 || !run.FannedOut || !run.Finished.IsZero() {
+		t.Errorf("run %+v, want both people queued and the run pending the second", run)
+	}
+
+	_, err = fixPersonHandler(ctx, store, people[1].Encode(), run.Key.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	person := &Person{}
+	err = store.Get(ctx, people[1], person)
+	if err != nil || person.FirstName != "John" || person.LastName != "Doe" || person.Schema != schemaVersion() {
+		t.Errorf("migrated person %+v, %v", person, err)
+	}
+	run, err = getMigrationRun(ctx, store, run.Key.Encode())
+	if err != nil || run.Finished.IsZero() {
+		t.Errorf("run %+v, %v, want it finished", run, err)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/appengine/v2/mail"
+)
+
+// Comma separated `<channel>:<target>` subscribers for `/task/notify`, e.g.
+// `mail:someone@gmail.com,webhook:https://chat.example.com/hook,log:`.
+// Channels are `mail`, `smtp`, `webhook`, `log` and `file`.
+const NOTIFY_SUBSCRIBERS = "NOTIFY_SUBSCRIBERS"
+
+// SMTP server settings for the `smtp` channel.
+const SMTP_ADDR = "SMTP_ADDR" // host:port
+const SMTP_USERNAME = "SMTP_USERNAME"
+const SMTP_PASSWORD = "SMTP_PASSWORD"
+const SMTP_FROM = "SMTP_FROM"
+
+const DEFAULT_SUBSCRIBERS = "mail:fredsa@gmail.com,mail:ambersa@gmail.com"
+
+type Notification struct {
+	Subject  string
+	Body     string
+	HTMLBody string // Optional alternative to the plain text `Body`.
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+type subscriber struct {
+	Name     string // Config entry, e.g. `mail:someone@gmail.com`.
+	Notifier Notifier
+}
+
+// Sends with the App Engine mail API.
+type mailNotifier struct {
+	To []string
+}
+
+// Sends through the SMTP server configured by `SMTP_*` environment variables.
+type smtpNotifier struct {
+	To []string
+}
+
+// POSTs the notification as JSON. The `text` field suits chat tool incoming webhooks.
+type webhookNotifier struct {
+	URL string
+}
+
+// Appends to a local file, or writes to the log when `Path` is empty.
+type logNotifier struct {
+	Path string
+}
+
+func (n *mailNotifier) Notify(ctx context.Context, notification *Notification) error {
+	// https://cloud.google.com/appengine/docs/standard/services/mail?tab=go#who_can_send_mail
+	// - The Gmail or Google Workspace Account of the user who is currently signed in
+	// - Any email address of the form anything@[MY_PROJECT_ID].appspotmail.com or anything@[MY_PROJECT_NUMBER].appspotmail.com
+	// - Any email address listed in the Google Cloud console under Email API Authorized Senders:
+	sender := fmt.Sprintf("pda@%s.appspotmail.com", projectID())
+
+	if isDev() {
+		// The mail API isn't available in dev mode.
+		log.Printf("*** dev mode *** Not mailing %q from %s, subject: %s\n%s", n.To, sender, notification.Subject, notification.Body)
+		return nil
+	}
+
+	msg := &mail.Message{
+		Sender:   sender,
+		To:       n.To,
+		Subject:  notification.Subject,
+		Body:     notification.Body,
+		HTMLBody: notification.HTMLBody,
+	}
+	err := mail.Send(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("failed to send email to %q: %v", n.To, err)
+	}
+	return nil
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, notification *Notification) error {
+	addr := os.Getenv(SMTP_ADDR)
+	if addr == "" {
+		return fmt.Errorf("%s is not set", SMTP_ADDR)
+	}
+	from := os.Getenv(SMTP_FROM)
+	host, _, _ := strings.Cut(addr, ":")
+
+	var auth smtp.Auth
+	if username := os.Getenv(SMTP_USERNAME); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv(SMTP_PASSWORD), host)
+	}
+
+	var msg bytes.Buffer
+	msg.WriteString(fmt.Sprintf("From: %s\r\n", from))
+	msg.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(n.To, ", ")))
+	msg.WriteString(fmt.Sprintf("Subject: %s\r\n", mime.QEncoding.Encode("utf-8", notification.Subject)))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	if notification.HTMLBody == "" {
+		msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+		msg.WriteString(strings.ReplaceAll(notification.Body, "\n", "\r\n"))
+	} else {
+		parts := multipart.NewWriter(&msg)
+		msg.WriteString(fmt.Sprintf("Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary()))
+		for _, part := range []struct{ contentType, body string }{
+			{"text/plain; charset=UTF-8", notification.Body},
+			{"text/html; charset=UTF-8", notification.HTMLBody},
+		} {
+			w, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+			if err != nil {
+				return fmt.Errorf("failed to create message part: %v", err)
+			}
+			_, _ = w.Write([]byte(strings.ReplaceAll(part.body, "\n", "\r\n")))
+		}
+		parts.Close()
+	}
+
+	err := smtp.SendMail(addr, auth, from, n.To, msg.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to send email via %s to %q: %v", addr, n.To, err)
+	}
+	return nil
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, notification *Notification) error {
+	payload, err := json.Marshal(map[string]string{
+		"subject": notification.Subject,
+		"body":    notification.Body,
+		"text":    notification.Subject + "\n" + notification.Body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", n.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to POST webhook %s: %v", n.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s returned %s", n.URL, resp.Status)
+	}
+	return nil
+}
+
+func (n *logNotifier) Notify(ctx context.Context, notification *Notification) error {
+	text := fmt.Sprintf("%s Subject: %s\n%s\n\n", time.Now().Format(time.RFC3339), notification.Subject, notification.Body)
+	if n.Path == "" {
+		log.Printf("Notification: %s", text)
+		return nil
+	}
+
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", n.Path, err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(text)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", n.Path, err)
+	}
+	return nil
+}
+
+func newNotifier(channel string, target string) (Notifier, error) {
+	switch channel {
+	case "mail":
+		return &mailNotifier{To: []string{target}}, nil
+	case "smtp":
+		return &smtpNotifier{To: []string{target}}, nil
+	case "webhook":
+		return &webhookNotifier{URL: target}, nil
+	case "log":
+		return &logNotifier{}, nil
+	case "file":
+		return &logNotifier{Path: target}, nil
+	default:
+		return nil, fmt.Errorf("unknown notification channel %q", channel)
+	}
+}
+
+func parseSubscribers(config string) ([]subscriber, error) {
+	var subscribers []subscriber
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		channel, target, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid subscriber %q, expected <channel>:<target>", entry)
+		}
+		notifier, err := newNotifier(channel, target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subscriber %q: %v", entry, err)
+		}
+		subscribers = append(subscribers, subscriber{Name: entry, Notifier: notifier})
+	}
+	return subscribers, nil
+}
+
+func notifySubscribers() ([]subscriber, error) {
+	config := os.Getenv(NOTIFY_SUBSCRIBERS)
+	if config == "" {
+		config = DEFAULT_SUBSCRIBERS
+	}
+	return parseSubscribers(config)
+}
+
+// Records an occurrence of a calendar entry included in a notification, so
+// that retried or repeated runs don't notify the same recipient again. Today's
+// and upcoming occurrences are logged apart, as both are notified.
+type NotificationLog struct {
+	Key       *datastore.Key `datastore:"__key__"`
+	Calendar  *datastore.Key `datastore:"calendar"`
+	Date      string         `datastore:"date"` // YYYY-MM-DD of the occurrence.
+	Upcoming  bool           `datastore:"upcoming"`
+	Recipient string         `datastore:"recipient"`
+	Sent      time.Time      `datastore:"sent"`
+}
+
+func (entry *digestEntry) notificationLog(recipient string) *NotificationLog {
+	date := entry.Date.Format("2006-01-02")
+	upcoming := entry.Days > 0
+	name := fmt.Sprintf("%s|%s|%s", entry.Event.Key.Encode(), date, recipient)
+	if upcoming {
+		name = "upcoming|" + name
+	}
+	return &NotificationLog{
+		Key:       datastore.NameKey("NotificationLog", name, nil),
+		Calendar:  entry.Event.Key,
+		Date:      date,
+		Upcoming:  upcoming,
+		Recipient: recipient,
+	}
+}
+
+// Copy of the digest without the entries already notified to the recipient.
+func unsentNotifications(ctx context.Context, store Store, d *digest, recipient string) (*digest, error) {
+	var err error
+	unsent := d.filter(func(entry *digestEntry) bool {
+		if err != nil {
+			return false
+		}
+		getErr := store.Get(ctx, entry.notificationLog(recipient).Key, &NotificationLog{})
+		if getErr == datastore.ErrNoSuchEntity {
+			return true
+		}
+		if getErr != nil {
+			err = fmt.Errorf("failed to get notification log: %v", getErr)
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unsent, nil
+}
+
+// Logs the entries not yet notified to the recipient, in one transaction so
+// that concurrent runs don't both send them, returning the claimed entries.
+func claimNotifications(ctx context.Context, store Store, d *digest, recipient string, now time.Time) (*digest, error) {
+	var claimed *digest
+	err := store.RunInTransaction(ctx, func(tx Transaction) error {
+		var err error
+		claimed = d.filter(func(entry *digestEntry) bool {
+			if err != nil {
+				return false
+			}
+			notificationLog := entry.notificationLog(recipient)
+			err = tx.Get(notificationLog.Key, &NotificationLog{})
+			if err != datastore.ErrNoSuchEntity {
+				// Already logged, or failed.
+				return false
+			}
+			notificationLog.Sent = now
+			err = tx.Put(notificationLog.Key, notificationLog)
+			return err == nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim notifications for %s: %v", recipient, err)
+	}
+	return claimed, nil
+}
+
+// Deletes the logs of claimed entries that failed to send, so they're retried.
+func releaseNotifications(ctx context.Context, store Store, d *digest, recipient string) error {
+	var keys []*datastore.Key
+	for _, entry := range slices.Concat(d.Today, d.Upcoming) {
+		keys = append(keys, entry.notificationLog(recipient).Key)
+	}
+	err := store.DeleteMulti(ctx, keys)
+	if err != nil {
+		return fmt.Errorf("failed to release %d notifications for %s: %v", len(keys), recipient, err)
+	}
+	return nil
+}
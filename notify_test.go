@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Records the notifications instead of sending them, failing with `err` when set.
+type recordingNotifier struct {
+	notifications []*Notification
+	err           error
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, notification *Notification) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+// Saves a Person with an email Contact and a Calendar entry, returning the
+// Calendar key.
+func addTestEvent(t *testing.T, store Store, first string, last string, occasion string, date time.Time) *datastore.Key {
+	t.Helper()
+	ctx := context.Background()
+	personKey, err := saveModel(ctx, store, &Person{Key: datastore.IncompleteKey("Person", nil), FirstName: first, LastName: last, Common: Common{Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = saveModel(ctx, store, &Contact{
+		Key:         datastore.IncompleteKey("Contact", personKey),
+		ContactType: "Email",
+		ContactText: strings.ToLower(first) + "@example.com",
+		Common:      Common{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := saveModel(ctx, store, &Calendar{
+		Key:             datastore.IncompleteKey("Calendar", personKey),
+		FirstOccurrence: date,
+		Frequency:       "Annually",
+		Occasion:        occasion,
+		Common:          Common{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestNotifyEvents(t *testing.T) {
+	t.Setenv(GOOGLE_CLOUD_PROJECT, "my-project")
+	ctx := context.Background()
+	store := newMemoryStore()
+	now := time.Date(2024, 12, 1, 8, 0, 0, 0, time.UTC)
+	addTestEvent(t, store, "Jane", "Doe", "Birthday", time.Date(1980, 12, 1, 0, 0, 0, 0, time.UTC))
+	addTestEvent(t, store, "Bob", "Ray", "Anniversary", time.Date(2010, 12, 5, 0, 0, 0, 0, time.UTC))
+	addTestEvent(t, store, "Cy", "Far", "Birthday", time.Date(1990, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	first, second := &recordingNotifier{}, &recordingNotifier{}
+	subscribers := []subscriber{{Name: "log:first", Notifier: first}, {Name: "log:second", Notifier: second}}
+	_, err := notifyEvents(ctx, store, subscribers, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []*recordingNotifier{first, second} {
+		if len(n.notifications) != 1 {
+			t.Fatalf("%d notifications, want one digest per subscriber", len(n.notifications))
+		}
+		notification := n.notifications[0]
+		if notification.Subject != "my-project 1 today, 1 upcoming: Jane Doe Birthday" {
+			t.Errorf("subject %q", notification.Subject)
+		}
+		for _, want := range []string{"Jane Doe - Birthday (44 years)", "jane@example.com", "Bob Ray - Anniversary (14 years)"} {
+			if !strings.Contains(notification.Body, want) {
+				t.Errorf("body lacks %q:\n%s", want, notification.Body)
+			}
+		}
+		if strings.Contains(notification.Body, "Cy Far") || !strings.Contains(notification.HTMLBody, "Jane Doe") {
+			t.Errorf("unexpected digest:\n%s\n%s", notification.Body, notification.HTMLBody)
+		}
+	}
+
+	// A repeated run on the same day sends nothing new.
+	resp, err := notifyEvents(ctx, store, subscribers, now.Add(time.Hour), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.notifications) != 1 || len(second.notifications) != 1 {
+		t.Errorf("repeated run notified again:\n%s", resp)
+	}
+
+	// Upcoming occurrences are notified once, not on every run until they're due.
+	resp, err = notifyEvents(ctx, store, subscribers, now.AddDate(0, 0, 1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.notifications) != 1 {
+		t.Errorf("next day notified the upcoming anniversary again:\n%s", resp)
+	}
+
+	// But they are notified again when due.
+	_, err = notifyEvents(ctx, store, subscribers, now.AddDate(0, 0, 4), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.notifications) != 2 || first.notifications[1].Subject != "my-project 1 today, 0 upcoming: Bob Ray Anniversary" {
+		t.Errorf("%d notifications, want the anniversary on the day", len(first.notifications))
+	}
+}
+
+func TestClaimNotifications(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	now := time.Date(2024, 12, 1, 8, 0, 0, 0, time.UTC)
+	addTestEvent(t, store, "Jane", "Doe", "Birthday", time.Date(1980, 12, 1, 0, 0, 0, 0, time.UTC))
+	var events []Calendar
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "Calendar"}, &events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := buildDigest(ctx, store, events, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := claimNotifications(ctx, store, d, "log:", now)
+	if err != nil || len(claimed.Today) != 1 {
+		t.Fatalf("first claim = %+v, %v, want the birthday", claimed, err)
+	}
+	claimed, err = claimNotifications(ctx, store, d, "log:", now)
+	if err != nil || !claimed.empty() {
+		t.Errorf("second claim = %+v, %v, want nothing left to send", claimed, err)
+	}
+	claimed, err = claimNotifications(ctx, store, d, "log:other", now)
+	if err != nil || len(claimed.Today) != 1 {
+		t.Errorf("claim for another recipient = %+v, %v, want the birthday", claimed, err)
+	}
+
+	err = releaseNotifications(ctx, store, d, "log:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, err = claimNotifications(ctx, store, d, "log:", now)
+	if err != nil || len(claimed.Today) != 1 {
+		t.Errorf("claim after release = %+v, %v, want the birthday", claimed, err)
+	}
+}
+
+func TestNotifyEventsFailingSubscriber(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	now := time.Date(2024, 12, 1, 8, 0, 0, 0, time.UTC)
+	addTestEvent(t, store, "Jane", "Doe", "Birthday", time.Date(1980, 12, 1, 0, 0, 0, 0, time.UTC))
+
+	failing, working := &recordingNotifier{err: errors.New("unreachable")}, &recordingNotifier{}
+	subscribers := []subscriber{{Name: "webhook:failing", Notifier: failing}, {Name: "log:working", Notifier: working}}
+	_, err := notifyEvents(ctx, store, subscribers, now, false)
+	if err == nil || !strings.Contains(err.Error(), "failed to notify 1 of 2 subscribers") {
+		t.Errorf("notifyEvents = %v, want the failure reported for a retry", err)
+	}
+	if len(working.notifications) != 1 {
+		t.Errorf("working subscriber got %d notifications, want 1", len(working.notifications))
+	}
+
+	// The retry only sends to the subscriber that failed.
+	failing.err = nil
+	_, err = notifyEvents(ctx, store, subscribers, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failing.notifications) != 1 || len(working.notifications) != 1 {
+		t.Errorf("retry sent %d and %d notifications, want 1 and 1", len(failing.notifications), len(working.notifications))
+	}
+}
+
+func TestNotifyEventsDryRun(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	now := time.Date(2024, 12, 1, 8, 0, 0, 0, time.UTC)
+	addTestEvent(t, store, "Jane", "Doe", "Birthday", time.Date(1980, 12, 1, 0, 0, 0, 0, time.UTC))
+
+	n := &recordingNotifier{}
+	subscribers := []subscriber{{Name: "log:", Notifier: n}}
+	resp, err := notifyEvents(ctx, store, subscribers, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n.notifications) != 0 || !strings.Contains(resp, "Would notify log:") {
+		t.Errorf("dry run sent %d notifications:\n%s", len(n.notifications), resp)
+	}
+	logs, err := store.GetAll(ctx, &storeQuery{Kind: "NotificationLog", KeysOnly: true}, nil)
+	if err != nil || len(logs) != 0 {
+		t.Errorf("dry run logged %d notifications, %v", len(logs), err)
+	}
+}
+
+func TestParseSubscribers(t *testing.T) {
+	subscribers, err := parseSubscribers("mail:someone@gmail.com, webhook:https://chat.example.com/hook,log:,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscribers) != 3 {
+		t.Fatalf("parsed %d subscribers, want 3", len(subscribers))
+	}
+	if n, ok := subscribers[0].Notifier.(*mailNotifier); !ok || n.To[0] != "someone@gmail.com" {
+		t.Errorf("mail subscriber %#v, want a mailNotifier, also in dev mode", subscribers[0].Notifier)
+	}
+	if n, ok := subscribers[1].Notifier.(*webhookNotifier); !ok || n.URL != "https://chat.example.com/hook" {
+		t.Errorf("webhook subscriber %#v", subscribers[1].Notifier)
+	}
+
+	_, err = parseSubscribers("pigeon:home")
+	if err == nil {
+		t.Error("parsed an unknown channel")
+	}
+}
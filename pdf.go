@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Minimal PDF writer, just enough for label sheets and envelopes.
+// Only the standard Helvetica font is used, so no font data is embedded.
+// https://opensource.adobe.com/dc-acrobat-sdk-docs/pdfstandards/PDF32000_2008.pdf
+
+const POINTS_PER_INCH = 72.0
+const POINTS_PER_MM = POINTS_PER_INCH / 25.4
+
+type pdfDocument struct {
+	pages []*pdfPage
+}
+
+type pdfPage struct {
+	width   float64 // Points.
+	height  float64 // Points.
+	content bytes.Buffer
+}
+
+func (doc *pdfDocument) addPage(width, height float64) *pdfPage {
+	page := &pdfPage{width: width, height: height}
+	doc.pages = append(doc.pages, page)
+	return page
+}
+
+// Draws text with its baseline at `y` points from the top of the page.
+func (page *pdfPage) text(x, y, size float64, s string) {
+	page.content.WriteString(fmt.Sprintf("BT /F1 %.2f Tf %.2f %.2f Td (%s) Tj ET\n",
+		size, x, page.height-y, pdfEscape(pdfEncode(s))))
+}
+
+func (doc *pdfDocument) bytes() []byte {
+	var buffer bytes.Buffer
+	var offsets []int
+
+	object := func(body string) {
+		offsets = append(offsets, buffer.Len())
+		buffer.WriteString(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", len(offsets), body))
+	}
+
+	buffer.WriteString("%PDF-1.4\n")
+
+	// Objects 1-3 are fixed, followed by a page and content object per page.
+	kids := make([]string, len(doc.pages))
+	for i := range doc.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(doc.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	for i, page := range doc.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			page.width, page.height, 5+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.content.Len(), page.content.String()))
+	}
+
+	xref := buffer.Len()
+	buffer.WriteString(fmt.Sprintf("xref\n0 %d\n", len(offsets)+1))
+	buffer.WriteString("0000000000 65535 f \n")
+	for _, offset := range offsets {
+		buffer.WriteString(fmt.Sprintf("%010d 00000 n \n", offset))
+	}
+	buffer.WriteString(fmt.Sprintf("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref))
+
+	return buffer.Bytes()
+}
+
+// WinAnsiEncoding code points outside of Latin-1.
+var pdfWinAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92,
+	'“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, 'Š': 0x8a,
+	'Œ': 0x8c, 'Ž': 0x8e, 'š': 0x9a, 'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+// Converts UTF-8 to WinAnsiEncoding, replacing unsupported runes with '?'.
+func pdfEncode(s string) []byte {
+	result := make([]byte, 0, len(s))
+	for _, r := range s {
+		if b, ok := pdfWinAnsi[r]; ok {
+			result = append(result, b)
+		} else if (r >= 0x20 && r < 0x7f) || (r >= 0xa0 && r <= 0xff) {
+			result = append(result, byte(r))
+		} else {
+			result = append(result, '?')
+		}
+	}
+	return result
+}
+
+func pdfEscape(b []byte) string {
+	var buffer bytes.Buffer
+	for _, c := range b {
+		if c == '\\' || c == '(' || c == ')' {
+			buffer.WriteByte('\\')
+		}
+		buffer.WriteByte(c)
+	}
+	return buffer.String()
+}
+
+// Helvetica glyph widths for ASCII 0x20-0x7e, in 1/1000 em, from the AFM file.
+var helveticaWidths = [...]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278, // ' ' - '/'
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556, // '0' - '?'
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778, // '@' - 'O'
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556, // 'P' - '_'
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556, // '`' - 'o'
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584, // 'p' - '~'
+}
+
+// Width of `s` in points at the given font size.
+func pdfTextWidth(s string, size float64) float64 {
+	width := 0
+	for _, c := range pdfEncode(s) {
+		if c >= 0x20 && c < 0x7f {
+			width += helveticaWidths[c-0x20]
+		} else {
+			// Accented letters are close enough to the average glyph width.
+			width += 556
+		}
+	}
+	return float64(width) * size / 1000
+}
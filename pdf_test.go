@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// Checks that each xref entry points at its object and that each stream has
+// its length, returning the page count of the page tree.
+func checkPDF(t *testing.T, data []byte) int {
+	t.Helper()
+	match := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(data)
+	if match == nil {
+		t.Fatalf("no startxref at the end of %q", data)
+	}
+	xref, _ := strconv.Atoi(string(match[1]))
+	if xref >= len(data) || !bytes.HasPrefix(data[xref:], []byte("xref\n0 ")) {
+		t.Fatalf("startxref %d doesn't point at the xref table", xref)
+	}
+	var size int
+	_, err := fmt.Sscanf(string(data[xref:]), "xref\n0 %d\n", &size)
+	if err != nil {
+		t.Fatalf("invalid xref header: %v", err)
+	}
+	entries := regexp.MustCompile(`(\d{10}) (\d{5}) ([nf]) \n`).FindAllSubmatch(data[xref:], -1)
+	if len(entries) != size {
+		t.Fatalf("xref has %d entries, want %d", len(entries), size)
+	}
+	if !bytes.Contains(data, fmt.Appendf(nil, "trailer\n<< /Size %d /Root 1 0 R >>", size)) {
+		t.Errorf("trailer without /Size %d", size)
+	}
+	for i, entry := range entries[1:] {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(data[offset:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q, want %q", i+1, data[offset:min(offset+10, len(data))], want)
+		}
+	}
+
+	for _, stream := range regexp.MustCompile(`(?s)<< /Length (\d+) >>\nstream\n(.*?)endstream`).FindAllSubmatch(data, -1) {
+		length, _ := strconv.Atoi(string(stream[1]))
+		if length != len(stream[2]) {
+			t.Errorf("stream /Length %d, want %d", length, len(stream[2]))
+		}
+	}
+
+	count := regexp.MustCompile(`/Type /Pages /Kids \[[^\]]*\] /Count (\d+)`).FindSubmatch(data)
+	if count == nil {
+		t.Fatalf("no page tree in %q", data)
+	}
+	pages, _ := strconv.Atoi(string(count[1]))
+	if kids := bytes.Count(data, []byte("/Type /Page /Parent 2 0 R")); kids != pages {
+		t.Errorf("%d page objects, want /Count %d", kids, pages)
+	}
+	return pages
+}
+
+func TestPDFDocument(t *testing.T) {
+	doc := &pdfDocument{}
+	for range 3 {
+		doc.addPage(8.5*POINTS_PER_INCH, 11*POINTS_PER_INCH).text(72, 72, 10, "Jane Doe")
+	}
+	if pages := checkPDF(t, doc.bytes()); pages != 3 {
+		t.Errorf("%d pages, want 3", pages)
+	}
+}
+
+func TestPDFText(t *testing.T) {
+	for _, test := range []struct {
+		text, want string
+	}{
+		{`Jane (Doe)`, `(Jane \(Doe\)) Tj`},
+		{`C:\Users`, `(C:\\Users) Tj`},
+		{`\(`, `(\\\() Tj`},
+		{"Ren\u00e9 \u20ac 5 \u2603", "(Ren\xe9 \x80 5 ?) Tj"},
+	} {
+		page := &pdfPage{width: 100, height: 100}
+		page.text(10, 10, 12, test.text)
+		if !bytes.Contains(page.content.Bytes(), []byte(test.want)) {
+			t.Errorf("text %q drawn as %q, want %q", test.text, page.content.String(), test.want)
+		}
+	}
+}
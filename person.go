@@ -1,60 +1,150 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"html"
+	"html/template"
+	"strings"
 
 	"cloud.google.com/go/datastore"
 )
 
-func renderPersonView(ctx context.Context, client *datastore.Client, person *Entity) (string, error) {
-	var buffer bytes.Buffer
+// Root entity of the Address, Contact and Calendar kinds.
+type Person struct {
+	Key         *datastore.Key `datastore:"__key__"`
+	Category    string         `datastore:"category,omitempty" form:"select"`
+	SendCard    bool           `datastore:"send_card,omitempty" default:"false"` // Default false.
+	Title       string         `datastore:"title,omitempty"`
+	MailingName string         `datastore:"mailing_name,omitempty"`
+	FirstName   string         `datastore:"first_name,omitempty"`
+	LastName    string         `datastore:"last_name,omitempty"`
+	CompanyName string         `datastore:"company_name,omitempty"`
+	Tags        []string       `datastore:"tags,omitempty" form:"tags" hint:"book club, neighbors"` // Normalized by `parseTags`.
+	Common
+}
+
+func (person *Person) key() *datastore.Key {
+	return person.Key
+}
+
+func (person *Person) common() *Common {
+	return &person.Common
+}
+
+func (person *Person) LoadKey(key *datastore.Key) error {
+	person.Key = key
+	return nil
+}
+
+func (person *Person) Load(props []datastore.Property) error {
+	return loadModelProperties(person, props)
+}
+
+func (person *Person) Save() ([]datastore.Property, error) {
+	return saveModelProperties(person)
+}
+
+func (person *Person) words() []string {
+	return modelWords(person)
+}
+
+func (person *Person) view() (template.HTML, error) {
+	return render("Person", person)
+}
+
+func (person *Person) fix() {
+	// After other fixes, lastly.
+	person.Words = person.words()
+}
+
+func (person *Person) sendCardText() string {
+	if person.SendCard {
+		return "[SendCard]"
+	} else {
+		return ""
+	}
+}
+
+func (person *Person) viewURL() string {
+	return fmt.Sprintf("%s/person/%s", defaultVersionOrigin(), person.Key.Encode())
+}
 
-	var children []Entity
-	query := datastore.NewQuery("").Ancestor(person.Key)
-	// query = query.FilterField("__key__", ">", person.Key)
-	_, err := client.GetAll(ctx, query, &children)
+func (person *Person) displayName() string {
+	t := ""
+	if person.MailingName != "" {
+		t += fmt.Sprintf("[%s] ", person.MailingName)
+	}
+	if person.CompanyName != "" {
+		t += fmt.Sprintf("%s ", person.CompanyName)
+	}
+	if person.Title != "" {
+		t += person.Title + " "
+	}
+	if person.FirstName != "" {
+		t += person.FirstName + " "
+	}
+	if person.LastName != "" {
+		t += person.LastName
+	}
+	return strings.TrimSpace(t)
+}
+
+type personViewData struct {
+	Person    *Person
+	Children  []model // Descendants of the Person.
+	Relations []relation
+	Household *householdRow
+	CSRF      string
+}
+
+func renderPersonView(ctx context.Context, store Store, person *Person) (template.HTML, error) {
+	family, err := fetchFamily(ctx, store, person.Key)
 	if err != nil {
-		return "", fmt.Errorf("failed to get all entities: %v", err)
-	}
-
-	for _, child := range children {
-		switch child.Key.Kind {
-		case "Person":
-			name := html.EscapeString(person.displayName())
-			comments := html.EscapeString(person.Comments)
-			buffer.WriteString(fmt.Sprintf(`
-				<hr>
-				<div class="%s">
-					<a href="%s" class="edit-link">Edit</a>
-					<span class="thing">%s</span> <span class="tag">(%s) [%s] %s</span><br>
-					<div class="comments">%s</div>
-					<div class="indent">
-			`,
-				person.enabledClass(),
-				person.editURL(),
-				name,
-				person.Category,
-				person.enabledText(),
-				person.sendCardText(),
-				comments))
-		case "Contact":
-			buffer.WriteString(contactView(&child))
-		case "Address":
-			buffer.WriteString(addressView(&child))
-		case "Calendar":
-			buffer.WriteString(calendarView(&child))
-		default:
-			return "", fmt.Errorf("unknown kind: %s", child.Key.Kind)
+		return "", err
+	}
+	var children []model
+	for _, m := range family {
+		if !m.key().Equal(person.Key) {
+			children = append(children, m)
 		}
 	}
 
-	buffer.WriteString(`
-			</div>
-		</div>
-	`)
+	relations, err := personRelations(ctx, store, person.Key)
+	if err != nil {
+		return "", err
+	}
+
+	data := &personViewData{Person: person, Children: children, Relations: relations, CSRF: csrfToken(ctx)}
+	household, err := personHousehold(ctx, store, person.Key)
+	if err != nil {
+		return "", err
+	}
+	if household != nil {
+		data.Household, err = householdMembers(ctx, store, household)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return render("person", data)
+}
 
-	return buffer.String(), nil
+// The people of the keys, nil for those missing from the store, e.g. after a
+// restore or a delete in the console, so that one dangling reference doesn't
+// fail a whole page.
+func getPeople(ctx context.Context, store Store, keys []*datastore.Key) ([]*Person, error) {
+	people := make([]*Person, len(keys))
+	err := store.GetMulti(ctx, keys, people)
+	if merr, ok := err.(datastore.MultiError); ok {
+		for i, err := range merr {
+			if err == datastore.ErrNoSuchEntity {
+				people[i] = nil
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to get person %v: %v", keys[i], err)
+			}
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get %d people: %v", len(keys), err)
+	}
+	return people, nil
 }
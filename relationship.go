@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+var relationshipTypes = []string{"spouse", "parent", "child", "colleague"}
+
+// Types seen from the other Person. Types missing here are symmetric.
+var relationshipInverses = map[string]string{
+	"parent": "child",
+	"child":  "parent",
+}
+
+// Types that share an envelope when combining spouses in `/mailmerge`.
+var householdRelationshipTypes = []string{"spouse"}
+
+// `Other` is the `Type` of `Person`, e.g. the spouse. Root entity, so that the
+// Person hierarchy stays Address, Contact and Calendar only. Bidirectional:
+// seen from `Other`, `Person` is the inverse type.
+type Relationship struct {
+	Key     *datastore.Key `datastore:"__key__"`
+	Person  *datastore.Key `datastore:"person"`
+	Other   *datastore.Key `datastore:"other"`
+	Type    string         `datastore:"type"`
+	Created time.Time      `datastore:"created"`
+}
+
+func inverseRelationshipType(t string) string {
+	if inverse, ok := relationshipInverses[t]; ok {
+		return inverse
+	}
+	return t
+}
+
+// A Relationship seen from one of its two people.
+type relation struct {
+	Relationship *Relationship
+	Type         string // Type of `Person` relative to the viewer.
+	Person       *Person
+}
+
+// Relations of the Person, in the order they were created.
+func personRelations(ctx context.Context, store Store, personKey *datastore.Key) ([]relation, error) {
+	var forward, backward []*Relationship
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "Relationship", Filters: map[string]any{"person": personKey}}, &forward)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch relationships of %v: %v", personKey, err)
+	}
+	_, err = store.GetAll(ctx, &storeQuery{Kind: "Relationship", Filters: map[string]any{"other": personKey}}, &backward)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch relationships to %v: %v", personKey, err)
+	}
+
+	var relations []relation
+	var keys []*datastore.Key
+	for _, r := range forward {
+		relations = append(relations, relation{Relationship: r, Type: r.Type})
+		keys = append(keys, r.Other)
+	}
+	for _, r := range backward {
+		relations = append(relations, relation{Relationship: r, Type: inverseRelationshipType(r.Type)})
+		keys = append(keys, r.Person)
+	}
+
+	people, err := getPeople(ctx, store, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch related people of %v: %v", personKey, err)
+	}
+	for i := range relations {
+		relations[i].Person = people[i]
+	}
+	// Relationships to people deleted since are left out.
+	relations = slices.DeleteFunc(relations, func(r relation) bool { return r.Person == nil })
+	slices.SortStableFunc(relations, func(a, b relation) int {
+		return a.Relationship.Created.Compare(b.Relationship.Created)
+	})
+	return relations, nil
+}
+
+// Keys of the people having a relation of type `t`, for `rel:<type>` searches.
+func relationSearch(ctx context.Context, store Store, t string) ([]*datastore.Key, error) {
+	var forward, backward []*Relationship
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "Relationship", Filters: map[string]any{"type": t}}, &forward)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s relationships: %v", t, err)
+	}
+	if inverse := inverseRelationshipType(t); inverse != t {
+		_, err = store.GetAll(ctx, &storeQuery{Kind: "Relationship", Filters: map[string]any{"type": inverse}}, &backward)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s relationships: %v", inverse, err)
+		}
+	} else {
+		backward = forward
+	}
+
+	var keys []*datastore.Key
+	for _, r := range forward {
+		keys = append(keys, r.Person)
+	}
+	for _, r := range backward {
+		keys = append(keys, r.Other)
+	}
+	return keys, nil
+}
+
+// Combined envelope name of a couple, joined with `style`. An explicit
+// `MailingName` wins.
+func coupleName(a *Person, b *Person, style string) string {
+	for _, p := range []*Person{a, b} {
+		if p.MailingName != "" {
+			return p.MailingName
+		}
+	}
+	return joinNames([]*Person{a, b}, style)
+}
+
+// Merges the mailings of spouses who are both on the list into the mailings
+// of whoever comes first, with the combined name.
+func combineSpouses(ctx context.Context, store Store, mailings []mailing, style string) ([]mailing, error) {
+	onList := make(map[string]bool)
+	for _, m := range mailings {
+		onList[m.Person.Key.Encode()] = true
+	}
+
+	done := make(map[string]bool)
+	absorbed := make(map[string]bool) // Spouses left out, named on the other's envelope.
+	names := make(map[string]string)
+	for _, m := range mailings {
+		key := m.Person.Key.Encode()
+		if done[key] {
+			continue
+		}
+		done[key] = true
+		relations, err := personRelations(ctx, store, m.Person.Key)
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range relations {
+			other := rel.Person.Key.Encode()
+			if !slices.Contains(householdRelationshipTypes, rel.Type) || !onList[other] || done[other] {
+				continue
+			}
+			done[other] = true
+			absorbed[other] = true
+			names[key] = coupleName(m.Person, rel.Person, style)
+			break
+		}
+	}
+
+	var combined []mailing
+	for _, m := range mailings {
+		key := m.Person.Key.Encode()
+		if absorbed[key] {
+			continue
+		}
+		if name := names[key]; name != "" {
+			m.Name = name
+		}
+		combined = append(combined, m)
+	}
+	return combined, nil
+}
+
+type relationshipData struct {
+	Message    string
+	Person     *Person
+	Relations  []relation
+	Q          string
+	Candidates []*Person
+	Types      []string
+	CSRF       string
+}
+
+func relationshipHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	personKey, err := datastore.DecodeKey(getValue(r, "person"))
+	if err != nil {
+		return "", httpError(http.StatusBadRequest, "failed to decode person key %q: %v", getValue(r, "person"), err)
+	}
+	person := &Person{}
+	err = store.Get(ctx, personKey, person)
+	if err != nil {
+		return "", httpError(http.StatusNotFound, "failed to get person %v: %v", personKey, err)
+	}
+
+	action := getValue(r, "action")
+	message := ""
+	if action != "" && r.Method != "POST" {
+		return "", httpError(http.StatusMethodNotAllowed, "action %q requires POST", action)
+	}
+
+	switch action {
+	case "":
+	case "add":
+		t := getValue(r, "type")
+		if !slices.Contains(relationshipTypes, t) {
+			return "", httpError(http.StatusBadRequest, "unknown relationship type %q, expected one of %q", t, relationshipTypes)
+		}
+		otherKey, err := datastore.DecodeKey(getValue(r, "other"))
+		if err != nil || otherKey.Kind != "Person" {
+			return "", httpError(http.StatusBadRequest, "invalid other person key %q", getValue(r, "other"))
+		}
+		if otherKey.Equal(personKey) {
+			return "", httpError(http.StatusBadRequest, "a person can't be related to themselves")
+		}
+
+		relations, err := personRelations(ctx, store, personKey)
+		if err != nil {
+			return "", err
+		}
+		if slices.ContainsFunc(relations, func(rel relation) bool { return rel.Person.Key.Equal(otherKey) }) {
+			message = "Already related, remove the existing relationship first"
+			break
+		}
+		rel := &Relationship{Person: personKey, Other: otherKey, Type: t, Created: time.Now()}
+		_, err = store.Put(ctx, datastore.IncompleteKey("Relationship", nil), rel)
+		if err != nil {
+			return "", fmt.Errorf("failed to put relationship: %v", err)
+		}
+		message = fmt.Sprintf("Added %s", t)
+	case "remove":
+		key, err := datastore.DecodeKey(getValue(r, "relationship"))
+		if err != nil || key.Kind != "Relationship" {
+			return "", httpError(http.StatusBadRequest, "invalid relationship key %q", getValue(r, "relationship"))
+		}
+		rel := &Relationship{}
+		err = store.Get(ctx, key, rel)
+		if err == datastore.ErrNoSuchEntity {
+			return "", httpError(http.StatusNotFound, "no such relationship %v", key)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to get relationship %v: %v", key, err)
+		}
+		if !rel.Person.Equal(personKey) && !rel.Other.Equal(personKey) {
+			return "", httpError(http.StatusBadRequest, "relationship %v is not one of %v", key, personKey)
+		}
+		err = store.Delete(ctx, key)
+		if err != nil {
+			return "", fmt.Errorf("failed to delete relationship %v: %v", key, err)
+		}
+		message = "Removed relationship"
+	default:
+		return "", fmt.Errorf("unknown relationship action %q", action)
+	}
+
+	data := &relationshipData{
+		Message: message,
+		Person:  person,
+		Q:       getValue(r, "q"),
+		Types:   relationshipTypes,
+		CSRF:    csrfToken(ctx),
+	}
+	data.Relations, err = personRelations(ctx, store, personKey)
+	if err != nil {
+		return "", err
+	}
+
+	// People to relate to, found like the main search.
+	if words := removeEmtpy(WORDS_RE.Split(strings.ToLower(data.Q), -1)); len(words) > 0 {
+		keys, err := wordSearch(ctx, store, words)
+		if err != nil {
+			return "", err
+		}
+		keys = slices.DeleteFunc(keys, personKey.Equal)
+		people, err := getPeople(ctx, store, keys)
+		if err != nil {
+			return "", err
+		}
+		data.Candidates = slices.DeleteFunc(people, func(p *Person) bool { return p == nil })
+	}
+
+	return renderPage(ctx, "relationships", data)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestRelationshipRemove(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	var people []*datastore.Key
+	for _, name := range []string{"Jane", "John", "Ann", "Bob"} {
+		key, err := saveModel(ctx, store, &Person{Key: datastore.IncompleteKey("Person", nil), FirstName: name, Common: Common{Enabled: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, key)
+	}
+	jane, john, ann, bob := people[0], people[1], people[2], people[3]
+	spouses, err := store.Put(ctx, datastore.IncompleteKey("Relationship", nil), &Relationship{Person: jane, Other: john, Type: "spouse", Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	siblings, err := store.Put(ctx, datastore.IncompleteKey("Relationship", nil), &Relationship{Person: ann, Other: bob, Type: "sibling", Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remove := func(person *datastore.Key, rel *datastore.Key) error {
+		_, err := relationshipHandler(postForm("/relationship", url.Values{"action": {"remove"}, "person": {person.Encode()}, "relationship": {rel.Encode()}}), ctx, store)
+		return err
+	}
+	err = remove(jane, siblings)
+	if statusCode(err) != http.StatusBadRequest {
+		t.Errorf("removing a relationship of other people = %v, want 400", err)
+	}
+	err = store.Get(ctx, siblings, &Relationship{})
+	if err != nil {
+		t.Errorf("relationship of other people removed: %v", err)
+	}
+
+	// Either person may remove it.
+	err = remove(john, spouses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Get(ctx, spouses, &Relationship{})
+	if !errors.Is(err, datastore.ErrNoSuchEntity) {
+		t.Errorf("Get removed relationship = %v, want ErrNoSuchEntity", err)
+	}
+	err = remove(jane, spouses)
+	if statusCode(err) != http.StatusNotFound {
+		t.Errorf("removing it again = %v, want 404", err)
+	}
+}
+
+func TestRelationshipDangling(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	var people []*datastore.Key
+	for _, name := range []string{"Jane", "John", "Gone"} {
+		key, err := saveModel(ctx, store, &Person{Key: datastore.IncompleteKey("Person", nil), FirstName: name, LastName: "Doe", Common: Common{Enabled: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, key)
+	}
+	jane, john, gone := people[0], people[1], people[2]
+	for _, other := range []*datastore.Key{john, gone} {
+		_, err := store.Put(ctx, datastore.IncompleteKey("Relationship", nil), &Relationship{Person: jane, Other: other, Type: "spouse", Created: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deleted from the console, leaving its relationship behind.
+	err := store.Delete(ctx, gone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relations, err := personRelations(ctx, store, jane)
+	if err != nil || len(relations) != 1 || !relations[0].Person.Key.Equal(john) {
+		t.Errorf("relations %+v, %v, want only John", relations, err)
+	}
+	mailings, err := combineSpouses(ctx, store, []mailing{{Person: &Person{Key: jane, FirstName: "Jane", LastName: "Doe"}}}, "ampersand")
+	if err != nil || len(mailings) != 1 {
+		t.Errorf("mailings %+v, %v, want Jane's", mailings, err)
+	}
+	_, err = searchHandler(ctx, store, "rel:spouse")
+	if err != nil {
+		t.Errorf("search of the relationship type = %v", err)
+	}
+	_, err = relationshipHandler(getRequest("/relationship?person="+jane.Encode()+"&q=doe"), ctx, store)
+	if err != nil {
+		t.Errorf("relationships page = %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/v2"
+)
+
+// Shared state of the running instance.
+type app struct {
+	store Store
+}
+
+// Handlers return the response body, or an error rendered by `errorPage`.
+type handlerFunc func(r *http.Request, ctx context.Context, store Store) (string, error)
+
+// An error with the HTTP status code to respond with, instead of 500.
+type statusError struct {
+	Code int
+	Err  error
+}
+
+func (e *statusError) Error() string {
+	return e.Err.Error()
+}
+
+func httpError(code int, format string, a ...any) error {
+	return &statusError{Code: code, Err: fmt.Errorf(format, a...)}
+}
+
+func (a *app) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("GET /static/", http.StripPrefix("/static", http.FileServer(http.Dir("static"))))
+
+	// App Engine inbound services, protected by `login: admin` in `app.yaml`.
+	mux.Handle("POST /_ah/bounce", a.handle(bounceHandler))
+	mux.Handle("POST /_ah/mail/{to}", a.handle(inboundMailHandler))
+
+	// Runs daily from `cron.yaml`, or manually from the admin form.
+	mux.Handle("GET /task/notify", a.task(tasknotifyHandler))
+	mux.Handle("POST /task/notify", a.task(tasknotifyHandler))
+
+	// Fix entities.
+	fixAll := func(r *http.Request, ctx context.Context, store Store) (string, error) {
+		return fixAllHandler(ctx, store, r.PathValue("next"), getValue(r, "run"))
+	}
+	fixPerson := func(r *http.Request, ctx context.Context, store Store) (string, error) {
+		return fixPersonHandler(ctx, store, r.PathValue("key"), getValue(r, "run"))
+	}
+	mux.Handle("POST /task/fix/all/{next...}", a.task(fixAll))
+	mux.Handle("POST /task/fix/person/{key}", a.task(fixPerson))
+	mux.Handle("POST /task/fix/Person/{key}", a.task(fixPerson)) // Tasks queued before the path was lowercased.
+	mux.Handle("POST /task/restore/{restore}/{chunk}", a.task(taskRestoreHandler))
+	mux.Handle("POST /task/import/{import}/{chunk}", a.task(taskImportHandler))
+	mux.Handle("POST /task/tags/retag", a.task(taskRetagHandler))
+	mux.Handle("POST /task/choices/rename", a.task(taskRenameChoiceHandler))
+	mux.Handle("POST /task/custom/strip", a.task(taskStripCustomFieldHandler))
+	mux.Handle("POST /task/geocode/{next...}", a.task(taskGeocodeHandler))
+
+	mux.Handle("GET /{$}", a.page(mainPageHandler))
+	mux.Handle("POST /{$}", a.page(mainPageHandler))
+	mux.Handle("GET /person/{key}", a.page(personHandler))
+	mux.Handle("GET /relationship", a.page(relationshipHandler))
+	mux.Handle("POST /relationship", a.page(relationshipHandler))
+	mux.Handle("GET /household", a.page(householdHandler))
+	mux.Handle("POST /household", a.page(householdHandler))
+	mux.Handle("GET /map", a.page(mapHandler))
+	mux.Handle("POST /map", a.page(mapHandler))
+	mux.Handle("GET /tags", a.page(tagsHandler))
+	mux.Handle("POST /tags", a.page(tagsHandler))
+	mux.Handle("GET /choices", a.page(choicesHandler))
+	mux.Handle("POST /choices", a.page(choicesHandler))
+	mux.Handle("GET /migrations", a.page(migrationsHandler))
+	mux.Handle("POST /migrations", a.page(migrationsHandler))
+	mux.Handle("GET /customfields", a.page(customFieldsHandler))
+	mux.Handle("POST /customfields", a.page(customFieldsHandler))
+	mux.Handle("GET /inbound", a.page(inboundHandler))
+	mux.Handle("POST /inbound", a.page(inboundHandler))
+	mux.Handle("GET /campaign", a.page(campaignHandler))
+	mux.Handle("POST /campaign", a.page(campaignHandler))
+	mux.Handle("GET /mailmerge", a.page(mailmergeHandler))
+	mux.Handle("GET /labels", csrfProtect(a.handleLabels()))
+	mux.Handle("GET /import", a.page(importHandler))
+	mux.Handle("POST /import", a.page(importHandler))
+	mux.Handle("GET /backup", a.page(backupHandler))
+	mux.Handle("POST /backup", a.page(backupHandler))
+	mux.Handle("GET /backup/export", csrfProtect(a.handleExport()))
+
+	// CardDAV and CalDAV clients, exempt from `login: admin` in `app.yaml`.
+	mux.HandleFunc("/.well-known/carddav", wellKnownDAV)
+	mux.HandleFunc("/.well-known/caldav", wellKnownDAV)
+	mux.Handle(DAV_ROOT, davAuth(a.dav()))
+
+	return recoverPanics(logRequests(mux))
+}
+
+// Browser pages, which must carry the session CSRF token when POSTed.
+func (a *app) page(h handlerFunc) http.Handler {
+	return csrfProtect(a.handle(h))
+}
+
+// Task endpoints, for cron, the task queue and admins only.
+func (a *app) task(h handlerFunc) http.Handler {
+	return taskAuth(csrfProtect(a.handle(h)))
+}
+
+func (a *app) handle(h handlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// App Engine context for the in-flight HTTP request.
+		ctx := appengine.NewContext(r)
+
+		err := r.ParseForm()
+		if err != nil {
+			errorPage(w, r, httpError(http.StatusBadRequest, "failed to parse form: %v", err))
+			return
+		}
+
+		resp, err := h(r, ctx, a.store)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		fmt.Fprint(w, resp)
+	})
+}
+
+func (a *app) handleLabels() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		resp, err := labelsHandler(r, ctx, a.store)
+		if err != nil {
+			// Unwrapped, so that the status of bad parameters holds.
+			errorPage(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		_, _ = w.Write(resp)
+	})
+}
+
+type errorData struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+// Responds with the status of a `statusError`, or 500. Task, inbound service
+// and DAV callers get plain text, browsers an error page.
+func errorPage(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	var serr *statusError
+	if errors.As(err, &serr) {
+		code = serr.Code
+	}
+	log.Printf("Failed %s %s: %d %v", r.Method, r.URL.Path, code, err)
+
+	if strings.HasPrefix(r.URL.Path, "/task/") || strings.HasPrefix(r.URL.Path, "/_ah/") || strings.HasPrefix(r.URL.Path, DAV_ROOT) {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	resp, rerr := renderPage(ctx, "error", &errorData{Code: code, Status: http.StatusText(code), Message: err.Error()})
+	if rerr != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprint(w, resp)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("%s %s %d %v", r.Method, r.URL.Path, rec.status, time.Since(start))
+	})
+}
+
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			errorPage(w, r, fmt.Errorf("internal error: %v", err))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
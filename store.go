@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Persistence used by the handlers, so that they run against Datastore in
+// production or against memory for local development.
+type Store interface {
+	Get(ctx context.Context, key *datastore.Key, dst any) error
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst any) error
+	Put(ctx context.Context, key *datastore.Key, src any) (*datastore.Key, error)
+	PutMulti(ctx context.Context, keys []*datastore.Key, src any) ([]*datastore.Key, error)
+	Delete(ctx context.Context, key *datastore.Key) error
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+	// Completes incomplete keys with reserved IDs, without writing anything.
+	AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error)
+	// Keeps the IDs of complete keys, e.g. restored ones, from being allocated.
+	ReserveIDs(ctx context.Context, keys []*datastore.Key) error
+
+	// Appends the query results to `dst`, a pointer to a slice, and returns their keys.
+	GetAll(ctx context.Context, q *storeQuery, dst any) ([]*datastore.Key, error)
+	// The `ancestor` and its descendants, or only the descendants of `kind` when not empty.
+	QueryChildren(ctx context.Context, ancestor *datastore.Key, kind string, dst any) ([]*datastore.Key, error)
+	// Keys of `kind` with a `words` entry starting with `word`.
+	QueryByWord(ctx context.Context, kind string, word string) ([]*datastore.Key, error)
+
+	// Runs `f` so that its reads and writes through `tx` commit together, or
+	// not at all when it returns an error. May run `f` again on contention.
+	RunInTransaction(ctx context.Context, f func(tx Transaction) error) error
+}
+
+// Reads and writes of entities with complete keys within a transaction.
+type Transaction interface {
+	Get(key *datastore.Key, dst any) error
+	Put(key *datastore.Key, src any) error
+	Delete(key *datastore.Key) error
+}
+
+// The queries the handlers need, limited to what both stores can evaluate.
+type storeQuery struct {
+	Kind     string         // Empty for all kinds below `Ancestor`.
+	Ancestor *datastore.Key // Optional.
+	Filters  map[string]any // Property equality.
+	After    *datastore.Key // Only keys greater than this one.
+	Order    string         // Property, with "-" prefix for descending; key order otherwise.
+	Limit    int
+	KeysOnly bool
+}
+
+type datastoreStore struct {
+	client *datastore.Client
+}
+
+func (s *datastoreStore) Get(ctx context.Context, key *datastore.Key, dst any) error {
+	return s.client.Get(ctx, key, dst)
+}
+
+func (s *datastoreStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst any) error {
+	return s.client.GetMulti(ctx, keys, dst)
+}
+
+func (s *datastoreStore) Put(ctx context.Context, key *datastore.Key, src any) (*datastore.Key, error) {
+	return s.client.Put(ctx, key, src)
+}
+
+func (s *datastoreStore) PutMulti(ctx context.Context, keys []*datastore.Key, src any) ([]*datastore.Key, error) {
+	return s.client.PutMulti(ctx, keys, src)
+}
+
+func (s *datastoreStore) Delete(ctx context.Context, key *datastore.Key) error {
+	return s.client.Delete(ctx, key)
+}
+
+func (s *datastoreStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return s.client.DeleteMulti(ctx, keys)
+}
+
+func (s *datastoreStore) GetAll(ctx context.Context, q *storeQuery, dst any) ([]*datastore.Key, error) {
+	query := datastore.NewQuery(q.Kind)
+	if q.Ancestor != nil {
+		query = query.Ancestor(q.Ancestor)
+	}
+	names := make([]string, 0, len(q.Filters))
+	for name := range q.Filters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		query = query.FilterField(name, "=", q.Filters[name])
+	}
+	if q.After != nil {
+		query = query.FilterField("__key__", ">", q.After)
+	}
+	if q.Order != "" {
+		query = query.Order(q.Order)
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+	if q.KeysOnly {
+		query = query.KeysOnly()
+	}
+	return s.client.GetAll(ctx, query, dst)
+}
+
+func (s *datastoreStore) QueryChildren(ctx context.Context, ancestor *datastore.Key, kind string, dst any) ([]*datastore.Key, error) {
+	return s.GetAll(ctx, &storeQuery{Kind: kind, Ancestor: ancestor}, dst)
+}
+
+func (s *datastoreStore) QueryByWord(ctx context.Context, kind string, word string) ([]*datastore.Key, error) {
+	query := datastore.NewQuery(kind)
+	query = query.FilterEntity(datastore.PropertyFilter{FieldName: "words", Operator: ">=", Value: word})
+	query = query.FilterEntity(datastore.PropertyFilter{FieldName: "words", Operator: "<=", Value: word + "~"})
+	query = query.KeysOnly()
+	return s.client.GetAll(ctx, query, nil)
+}
+
+func (s *datastoreStore) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	return s.client.AllocateIDs(ctx, keys)
+}
+
+func (s *datastoreStore) ReserveIDs(ctx context.Context, keys []*datastore.Key) error {
+	return s.client.ReserveIDs(ctx, keys)
+}
+
+func (s *datastoreStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	_, err := s.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(&datastoreTransaction{tx: tx})
+	})
+	return err
+}
+
+type datastoreTransaction struct {
+	tx *datastore.Transaction
+}
+
+func (t *datastoreTransaction) Get(key *datastore.Key, dst any) error {
+	return t.tx.Get(key, dst)
+}
+
+func (t *datastoreTransaction) Put(key *datastore.Key, src any) error {
+	_, err := t.tx.Put(key, src)
+	return err
+}
+
+func (t *datastoreTransaction) Delete(key *datastore.Key) error {
+	return t.tx.Delete(key)
+}
+
+// Entities held as Datastore properties, so that loading and saving behave
+// like Datastore, including `datastore.PropertyLoadSaver` implementations.
+type memoryStore struct {
+	mu       sync.Mutex
+	txMu     sync.Mutex // Runs one transaction at a time.
+	entities map[string]memoryEntity
+	nextID   int64
+}
+
+type memoryEntity struct {
+	key        *datastore.Key
+	properties []datastore.Property
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entities: map[string]memoryEntity{}}
+}
+
+func saveProperties(src any) ([]datastore.Property, error) {
+	if pls, ok := src.(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	props, err := datastore.SaveStruct(src)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(props, func(p datastore.Property) bool { return p.Name == "__key__" }), nil
+}
+
+func loadProperties(dst any, key *datastore.Key, props []datastore.Property) error {
+	if kl, ok := dst.(datastore.KeyLoader); ok {
+		err := kl.LoadKey(key)
+		if err != nil {
+			return err
+		}
+	}
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return pls.Load(slices.Clone(props))
+	}
+
+	err := datastore.LoadStruct(dst, props)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(dst).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("datastore"), ",")
+		if name == "__key__" {
+			v.Field(i).Set(reflect.ValueOf(key))
+		}
+	}
+	return nil
+}
+
+// Allocates an ID for an incomplete key.
+func (s *memoryStore) complete(key *datastore.Key) *datastore.Key {
+	if !key.Incomplete() {
+		return key
+	}
+	s.nextID++
+	return datastore.IDKey(key.Kind, s.nextID, key.Parent)
+}
+
+func (s *memoryStore) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		result[i] = s.complete(key)
+	}
+	return result, nil
+}
+
+// IDs are allocated from one sequence, so it continues after the highest one.
+func (s *memoryStore) ReserveIDs(ctx context.Context, keys []*datastore.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		s.nextID = max(s.nextID, key.ID)
+	}
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, key *datastore.Key, dst any) error {
+	s.mu.Lock()
+	e, ok := s.entities[key.Encode()]
+	s.mu.Unlock()
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	return loadProperties(dst, e.key, e.properties)
+}
+
+// Element `i` of the slice `v` as a pointer, allocating nil pointers.
+func sliceElement(v reflect.Value, i int) any {
+	elem := v.Index(i)
+	if elem.Kind() == reflect.Interface && !elem.IsNil() {
+		return elem.Interface()
+	}
+	if elem.Kind() == reflect.Pointer {
+		if elem.IsNil() {
+			elem.Set(reflect.New(elem.Type().Elem()))
+		}
+		return elem.Interface()
+	}
+	return elem.Addr().Interface()
+}
+
+func (s *memoryStore) GetMulti(ctx context.Context, keys []*datastore.Key, dst any) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return fmt.Errorf("dst must be a slice of length %d", len(keys))
+	}
+
+	merr := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		merr[i] = s.Get(ctx, key, sliceElement(v, i))
+		failed = failed || merr[i] != nil
+	}
+	if failed {
+		return merr
+	}
+	return nil
+}
+
+func (s *memoryStore) Put(ctx context.Context, key *datastore.Key, src any) (*datastore.Key, error) {
+	props, err := saveProperties(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save %v: %v", key, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key = s.complete(key)
+	s.entities[key.Encode()] = memoryEntity{key: key, properties: props}
+	return key, nil
+}
+
+func (s *memoryStore) PutMulti(ctx context.Context, keys []*datastore.Key, src any) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, fmt.Errorf("src must be a slice of length %d", len(keys))
+	}
+
+	result := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		var err error
+		result[i], err = s.Put(ctx, key, sliceElement(v, i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key *datastore.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entities, key.Encode())
+	return nil
+}
+
+func (s *memoryStore) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	for _, key := range keys {
+		_ = s.Delete(ctx, key)
+	}
+	return nil
+}
+
+func isAncestor(ancestor *datastore.Key, key *datastore.Key) bool {
+	for ; key != nil; key = key.Parent {
+		if key.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// Values of the named property, flattening multi-valued properties.
+func propertyValues(props []datastore.Property, name string) []any {
+	var values []any
+	for _, p := range props {
+		if p.Name != name {
+			continue
+		}
+		if multi, ok := p.Value.([]any); ok {
+			values = append(values, multi...)
+		} else {
+			values = append(values, p.Value)
+		}
+	}
+	return values
+}
+
+func equalValues(a any, b any) bool {
+	if t, ok := a.(time.Time); ok {
+		u, ok := b.(time.Time)
+		return ok && t.Equal(u)
+	}
+	// Datastore stores all integers as int64.
+	if i, ok := b.(int); ok {
+		b = int64(i)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// -1, 0 or 1 comparing the values, which are expected to be of the same type.
+func compareValues(a any, b any) int {
+	switch a := a.(type) {
+	case string:
+		b, _ := b.(string)
+		return strings.Compare(a, b)
+	case int64:
+		b, _ := b.(int64)
+		return cmpOrdered(a, b)
+	case float64:
+		b, _ := b.(float64)
+		return cmpOrdered(a, b)
+	case time.Time:
+		b, _ := b.(time.Time)
+		return a.Compare(b)
+	case bool:
+		b, _ := b.(bool)
+		return cmpOrdered(boolInt(a), boolInt(b))
+	}
+	return 0
+}
+
+func cmpOrdered[T int | int64 | float64](a T, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Datastore key order: path from the root, by kind, then IDs before names.
+func compareKeys(a *datastore.Key, b *datastore.Key) int {
+	path := func(k *datastore.Key) []*datastore.Key {
+		var p []*datastore.Key
+		for ; k != nil; k = k.Parent {
+			p = append([]*datastore.Key{k}, p...)
+		}
+		return p
+	}
+	pa, pb := path(a), path(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if c := strings.Compare(pa[i].Kind, pb[i].Kind); c != 0 {
+			return c
+		}
+		if pa[i].Name == "" && pb[i].Name != "" {
+			return -1
+		}
+		if pa[i].Name != "" && pb[i].Name == "" {
+			return 1
+		}
+		if c := cmpOrdered(pa[i].ID, pb[i].ID); c != 0 {
+			return c
+		}
+		if c := strings.Compare(pa[i].Name, pb[i].Name); c != 0 {
+			return c
+		}
+	}
+	return cmpOrdered(len(pa), len(pb))
+}
+
+func (s *memoryStore) matches(q *storeQuery, e memoryEntity) bool {
+	if q.Kind != "" && e.key.Kind != q.Kind {
+		return false
+	}
+	if q.Ancestor != nil && !isAncestor(q.Ancestor, e.key) {
+		return false
+	}
+	if q.After != nil && compareKeys(e.key, q.After) <= 0 {
+		return false
+	}
+	for name, want := range q.Filters {
+		if !slices.ContainsFunc(propertyValues(e.properties, name), func(v any) bool { return equalValues(v, want) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matching entities in query order.
+func (s *memoryStore) query(q *storeQuery, match func(e memoryEntity) bool) []memoryEntity {
+	s.mu.Lock()
+	var results []memoryEntity
+	for _, e := range s.entities {
+		if s.matches(q, e) && (match == nil || match(e)) {
+			results = append(results, e)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(results, func(i, j int) bool { return compareKeys(results[i].key, results[j].key) < 0 })
+	if q.Order != "" {
+		name, descending := strings.CutPrefix(q.Order, "-")
+		first := func(e memoryEntity) any {
+			values := propertyValues(e.properties, name)
+			if len(values) == 0 {
+				return nil
+			}
+			return values[0]
+		}
+		sort.SliceStable(results, func(i, j int) bool {
+			c := compareValues(first(results[i]), first(results[j]))
+			if descending {
+				return c > 0
+			}
+			return c < 0
+		})
+	}
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results
+}
+
+func (s *memoryStore) GetAll(ctx context.Context, q *storeQuery, dst any) ([]*datastore.Key, error) {
+	results := s.query(q, nil)
+
+	var v reflect.Value
+	if !q.KeysOnly {
+		v = reflect.ValueOf(dst)
+		if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Slice {
+			return nil, fmt.Errorf("dst must be a pointer to a slice")
+		}
+		v = v.Elem()
+	}
+
+	keys := make([]*datastore.Key, len(results))
+	for i, e := range results {
+		keys[i] = e.key
+		if q.KeysOnly {
+			continue
+		}
+		v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		err := loadProperties(sliceElement(v, v.Len()-1), e.key, e.properties)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %v: %v", e.key, err)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) QueryChildren(ctx context.Context, ancestor *datastore.Key, kind string, dst any) ([]*datastore.Key, error) {
+	return s.GetAll(ctx, &storeQuery{Kind: kind, Ancestor: ancestor}, dst)
+}
+
+func (s *memoryStore) QueryByWord(ctx context.Context, kind string, word string) ([]*datastore.Key, error) {
+	results := s.query(&storeQuery{Kind: kind}, func(e memoryEntity) bool {
+		return slices.ContainsFunc(propertyValues(e.properties, "words"), func(v any) bool {
+			w, _ := v.(string)
+			return w >= word && w <= word+"~"
+		})
+	})
+
+	keys := make([]*datastore.Key, len(results))
+	for i, e := range results {
+		keys[i] = e.key
+	}
+	return keys, nil
+}
+
+// Writes of a transaction, applied when it commits. Nil entities are deletes.
+type memoryTransaction struct {
+	store  *memoryStore
+	writes map[string]*memoryEntity
+}
+
+func (s *memoryStore) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	tx := &memoryTransaction{store: s, writes: map[string]*memoryEntity{}}
+	err := f(tx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for encoded, e := range tx.writes {
+		if e == nil {
+			delete(s.entities, encoded)
+		} else {
+			s.entities[encoded] = *e
+		}
+	}
+	return nil
+}
+
+func (t *memoryTransaction) Get(key *datastore.Key, dst any) error {
+	e, ok := t.writes[key.Encode()]
+	if !ok {
+		return t.store.Get(context.Background(), key, dst)
+	}
+	if e == nil {
+		return datastore.ErrNoSuchEntity
+	}
+	return loadProperties(dst, e.key, e.properties)
+}
+
+func (t *memoryTransaction) Put(key *datastore.Key, src any) error {
+	if key.Incomplete() {
+		return fmt.Errorf("transactions need complete keys, got %v", key)
+	}
+	props, err := saveProperties(src)
+	if err != nil {
+		return fmt.Errorf("failed to save %v: %v", key, err)
+	}
+	t.writes[key.Encode()] = &memoryEntity{key: key, properties: props}
+	return nil
+}
+
+func (t *memoryTransaction) Delete(key *datastore.Key) error {
+	t.writes[key.Encode()] = nil
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type storeTestEntity struct {
+	Key     *datastore.Key `datastore:"__key__"`
+	Name    string         `datastore:"name"`
+	Rank    int            `datastore:"rank"`
+	Tags    []string       `datastore:"tags"`
+	Created time.Time      `datastore:"created"`
+}
+
+// Store with root entities "a" to "e" of kind Test, ranked in reverse.
+func newTestStore(t *testing.T) (*memoryStore, []*datastore.Key) {
+	t.Helper()
+	ctx := context.Background()
+	store := newMemoryStore()
+	var keys []*datastore.Key
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		e := &storeTestEntity{Name: name, Rank: 5 - i, Tags: []string{"all", name}, Created: time.Date(2024, 1, 1+i, 0, 0, 0, 0, time.UTC)}
+		key, err := store.Put(ctx, datastore.IncompleteKey("Test", nil), e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return store, keys
+}
+
+func entityNames(entities []storeTestEntity) []string {
+	var names []string
+	for _, e := range entities {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestMemoryStoreGetPut(t *testing.T) {
+	ctx := context.Background()
+	store, keys := newTestStore(t)
+
+	if slices.ContainsFunc(keys, (*datastore.Key).Incomplete) {
+		t.Fatalf("Put returned incomplete keys %v", keys)
+	}
+	got := &storeTestEntity{}
+	err := store.Get(ctx, keys[1], got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "b" || got.Rank != 4 || !slices.Equal(got.Tags, []string{"all", "b"}) || !got.Key.Equal(keys[1]) {
+		t.Errorf("Get = %+v, want b with its key", got)
+	}
+
+	got.Name = "B"
+	key, err := store.Put(ctx, keys[1], got)
+	if err != nil || !key.Equal(keys[1]) {
+		t.Fatalf("Put = %v, %v, want %v", key, err, keys[1])
+	}
+	err = store.Get(ctx, keys[1], got)
+	if err != nil || got.Name != "B" {
+		t.Errorf("Get after Put = %q, %v, want B", got.Name, err)
+	}
+
+	err = store.Get(ctx, datastore.NameKey("Test", "missing", nil), got)
+	if !errors.Is(err, datastore.ErrNoSuchEntity) {
+		t.Errorf("Get missing = %v, want ErrNoSuchEntity", err)
+	}
+
+	err = store.Delete(ctx, keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Get(ctx, keys[1], got)
+	if !errors.Is(err, datastore.ErrNoSuchEntity) {
+		t.Errorf("Get deleted = %v, want ErrNoSuchEntity", err)
+	}
+}
+
+func TestMemoryStoreMulti(t *testing.T) {
+	ctx := context.Background()
+	store, keys := newTestStore(t)
+
+	entities := make([]storeTestEntity, 2)
+	err := store.GetMulti(ctx, []*datastore.Key{keys[2], keys[0]}, entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entityNames(entities); !slices.Equal(names, []string{"c", "a"}) {
+		t.Errorf("GetMulti = %q, want [c a]", names)
+	}
+
+	// Pointer elements, and a missing entity reported per key.
+	missing := datastore.NameKey("Test", "missing", nil)
+	pointers := make([]*storeTestEntity, 2)
+	err = store.GetMulti(ctx, []*datastore.Key{keys[3], missing}, pointers)
+	var merr datastore.MultiError
+	if !errors.As(err, &merr) || merr[0] != nil || !errors.Is(merr[1], datastore.ErrNoSuchEntity) {
+		t.Fatalf("GetMulti with missing = %v, want MultiError [nil ErrNoSuchEntity]", err)
+	}
+	if pointers[0].Name != "d" {
+		t.Errorf("GetMulti loaded %q, want d", pointers[0].Name)
+	}
+
+	put, err := store.PutMulti(ctx, []*datastore.Key{datastore.IncompleteKey("Test", nil), datastore.NameKey("Test", "f", nil)},
+		[]*storeTestEntity{{Name: "x"}, {Name: "f"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if put[0].Incomplete() || put[1].Name != "f" {
+		t.Errorf("PutMulti keys = %v", put)
+	}
+
+	err = store.DeleteMulti(ctx, put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.GetMulti(ctx, put, make([]storeTestEntity, 2))
+	if !errors.As(err, &merr) || !errors.Is(merr[0], datastore.ErrNoSuchEntity) || !errors.Is(merr[1], datastore.ErrNoSuchEntity) {
+		t.Errorf("GetMulti deleted = %v, want ErrNoSuchEntity for both", err)
+	}
+}
+
+func TestMemoryStoreGetAll(t *testing.T) {
+	ctx := context.Background()
+	store, keys := newTestStore(t)
+	_, err := store.Put(ctx, datastore.IncompleteKey("Other", nil), &storeTestEntity{Name: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query *storeQuery
+		want  []string
+	}{
+		{"kind in key order", &storeQuery{Kind: "Test"}, []string{"a", "b", "c", "d", "e"}},
+		{"filter", &storeQuery{Kind: "Test", Filters: map[string]any{"name": "c"}}, []string{"c"}},
+		{"filter int", &storeQuery{Kind: "Test", Filters: map[string]any{"rank": 2}}, []string{"d"}},
+		{"filter multi-valued", &storeQuery{Kind: "Test", Filters: map[string]any{"tags": "all"}}, []string{"a", "b", "c", "d", "e"}},
+		{"filters all match", &storeQuery{Kind: "Test", Filters: map[string]any{"tags": "b", "rank": 5}}, nil},
+		{"order", &storeQuery{Kind: "Test", Order: "rank"}, []string{"e", "d", "c", "b", "a"}},
+		{"order descending", &storeQuery{Kind: "Test", Order: "-created"}, []string{"e", "d", "c", "b", "a"}},
+		{"limit", &storeQuery{Kind: "Test", Limit: 2}, []string{"a", "b"}},
+		{"order and limit", &storeQuery{Kind: "Test", Order: "-name", Limit: 2}, []string{"e", "d"}},
+		{"after", &storeQuery{Kind: "Test", After: keys[2]}, []string{"d", "e"}},
+		{"after and limit", &storeQuery{Kind: "Test", After: keys[0], Limit: 1}, []string{"b"}},
+	}
+	for _, test := range tests {
+		var entities []storeTestEntity
+		got, err := store.GetAll(ctx, test.query, &entities)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if names := entityNames(entities); !slices.Equal(names, test.want) {
+			t.Errorf("%s: GetAll = %q, want %q", test.name, names, test.want)
+		}
+		for i := range entities {
+			if !entities[i].Key.Equal(got[i]) {
+				t.Errorf("%s: entity %d has key %v, GetAll returned %v", test.name, i, entities[i].Key, got[i])
+			}
+		}
+	}
+
+	got, err := store.GetAll(ctx, &storeQuery{Kind: "Test", KeysOnly: true, Limit: 3}, nil)
+	if err != nil || !slices.EqualFunc(got, keys[:3], (*datastore.Key).Equal) {
+		t.Errorf("GetAll keys only = %v, %v, want %v", got, err, keys[:3])
+	}
+}
+
+func TestMemoryStoreQueryChildren(t *testing.T) {
+	ctx := context.Background()
+	store, keys := newTestStore(t)
+	parent := keys[0]
+	child, err := store.Put(ctx, datastore.IncompleteKey("Child", parent), &storeTestEntity{Name: "child"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Put(ctx, datastore.IncompleteKey("Grandchild", child), &storeTestEntity{Name: "grandchild"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Put(ctx, datastore.IncompleteKey("Child", keys[1]), &storeTestEntity{Name: "cousin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var family []storeTestEntity
+	_, err = store.QueryChildren(ctx, parent, "", &family)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entityNames(family); !slices.Equal(names, []string{"a", "child", "grandchild"}) {
+		t.Errorf("QueryChildren all kinds = %q, want the ancestor first, then its descendants", names)
+	}
+
+	var children []storeTestEntity
+	_, err = store.QueryChildren(ctx, parent, "Child", &children)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entityNames(children); !slices.Equal(names, []string{"child"}) {
+		t.Errorf("QueryChildren Child = %q, want [child]", names)
+	}
+}
+
+func TestMemoryStoreQueryByWord(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	for _, words := range [][]string{{"jane", "doe"}, {"janet"}, {"john"}} {
+		_, err := store.Put(ctx, datastore.IncompleteKey("Person", nil), &struct {
+			Words []string `datastore:"words"`
+		}{words})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := store.QueryByWord(ctx, "Person", "jan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("QueryByWord jan = %v, want the two prefix matches", keys)
+	}
+}
+
+func TestMemoryStoreRunInTransaction(t *testing.T) {
+	ctx := context.Background()
+	store, keys := newTestStore(t)
+
+	err := store.RunInTransaction(ctx, func(tx Transaction) error {
+		e := &storeTestEntity{}
+		err := tx.Get(keys[0], e)
+		if err != nil {
+			return err
+		}
+		e.Name = "A"
+		err = tx.Put(keys[0], e)
+		if err != nil {
+			return err
+		}
+		// Reads see the transaction's own writes.
+		err = tx.Get(keys[0], e)
+		if err != nil || e.Name != "A" {
+			t.Errorf("Get in transaction = %q, %v, want A", e.Name, err)
+		}
+		return tx.Delete(keys[1])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &storeTestEntity{}
+	err = store.Get(ctx, keys[0], got)
+	if err != nil || got.Name != "A" {
+		t.Errorf("Get after commit = %q, %v, want A", got.Name, err)
+	}
+	err = store.Get(ctx, keys[1], got)
+	if !errors.Is(err, datastore.ErrNoSuchEntity) {
+		t.Errorf("Get deleted in transaction = %v, want ErrNoSuchEntity", err)
+	}
+
+	failed := errors.New("failed")
+	err = store.RunInTransaction(ctx, func(tx Transaction) error {
+		err := tx.Put(keys[2], &storeTestEntity{Name: "C"})
+		if err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Errorf("RunInTransaction = %v, want the error of f", err)
+	}
+	err = store.Get(ctx, keys[2], got)
+	if err != nil || got.Name != "c" {
+		t.Errorf("Get after rollback = %q, %v, want c", got.Name, err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/appengine/v2/taskqueue"
+)
+
+// People retagged by one `/task/tags/retag` request, before it continues in a new task.
+const RETAG_BATCH = 100
+
+// Lowercase, with single spaces, so that tags compare equal in queries.
+func normalizeTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), " ")
+}
+
+// Tags of a comma separated list, normalized and without duplicates.
+func parseTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		tag = normalizeTag(tag)
+		if tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Search word of the tag, e.g. `tag=book_club` for "book club".
+func tagWord(tag string) string {
+	return "tag=" + searchSlug(tag)
+}
+
+// Replaces the tag `from` with `to`, or removes it when `to` is empty.
+// Returns whether the tags changed.
+func (person *Person) retag(from string, to string) bool {
+	i := slices.Index(person.Tags, from)
+	if i < 0 {
+		return false
+	}
+	person.Tags = slices.Delete(person.Tags, i, i+1)
+	if to != "" && !slices.Contains(person.Tags, to) {
+		person.Tags = slices.Insert(person.Tags, i, to)
+	}
+	return true
+}
+
+type tagCount struct {
+	Tag   string
+	Word  string
+	Count int
+}
+
+// Every tag in use, with the number of people having it, by name.
+func fetchTagCounts(ctx context.Context, store Store) ([]tagCount, error) {
+	var people []Person
+	_, err := store.GetAll(ctx, &storeQuery{Kind: "Person"}, &people)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch people: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, person := range people {
+		for _, tag := range person.Tags {
+			counts[tag]++
+		}
+	}
+	var tags []tagCount
+	for tag, count := range counts {
+		tags = append(tags, tagCount{Tag: tag, Word: tagWord(tag), Count: count})
+	}
+	slices.SortFunc(tags, func(a, b tagCount) int { return strings.Compare(a.Tag, b.Tag) })
+	return tags, nil
+}
+
+func retagTask(from string, to string, next *datastore.Key) *taskqueue.Task {
+	params := url.Values{"from": {from}, "to": {to}}
+	if next != nil {
+		params.Set("next", next.Encode())
+	}
+	return taskqueue.NewPOSTTask("/task/tags/retag", params)
+}
+
+// Replaces the tag `from` with `to` on a batch of people, or removes it when
+// `to` is empty, continuing after the last one in a new task.
+func taskRetagHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	var buffer bytes.Buffer
+
+	from := normalizeTag(getValue(r, "from"))
+	to := normalizeTag(getValue(r, "to"))
+	if from == "" {
+		return "", httpError(http.StatusBadRequest, "missing tag to replace")
+	}
+
+	query := &storeQuery{Kind: "Person", Filters: map[string]any{"tags": from}, Limit: RETAG_BATCH}
+	if next := getValue(r, "next"); next != "" {
+		key, err := datastore.DecodeKey(next)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode person key %q: %v", next, err)
+		}
+		query.After = key
+	}
+
+	var people []Person
+	keys, err := store.GetAll(ctx, query, &people)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch people tagged %q: %v", from, err)
+	}
+
+	if len(people) == RETAG_BATCH {
+		buffer.WriteString("Adding continuation task\n")
+		resp, err := addTask(ctx, retagTask(from, to, keys[len(keys)-1]))
+		if err != nil {
+			return "", fmt.Errorf("failed to add continuation task: %v", err)
+		}
+		buffer.WriteString(resp + "\n")
+	}
+
+	for i := range people {
+		people[i].retag(from, to)
+		people[i].fix()
+		buffer.WriteString(fmt.Sprintf("%4d: %v  %v\n", i+1, keys[i], people[i].displayName()))
+	}
+	_, err = store.PutMulti(ctx, keys, people)
+	if err != nil {
+		return "", fmt.Errorf("failed to put %d retagged people: %v", len(people), err)
+	}
+
+	if to == "" {
+		buffer.WriteString(fmt.Sprintf("Removed %q from %d people", from, len(people)))
+	} else {
+		buffer.WriteString(fmt.Sprintf("Replaced %q with %q on %d people", from, to, len(people)))
+	}
+	return buffer.String(), nil
+}
+
+type tagsData struct {
+	Message string
+	Tags    []tagCount
+	CSRF    string
+}
+
+// Lists the tags in use, and renames, merges or deletes the selected ones on
+// every Person through `/task/tags/retag`.
+func tagsHandler(r *http.Request, ctx context.Context, store Store) (string, error) {
+	action := getValue(r, "action")
+	message := ""
+
+	if action != "" && r.Method != "POST" {
+		return "", httpError(http.StatusMethodNotAllowed, "action %q requires POST", action)
+	}
+
+	var from []string
+	for _, tag := range r.Form["from"] {
+		if tag = normalizeTag(tag); tag != "" {
+			from = append(from, tag)
+		}
+	}
+	to := normalizeTag(getValue(r, "to"))
+
+	switch action {
+	case "":
+	case "rename", "delete":
+		if len(from) == 0 {
+			return "", httpError(http.StatusBadRequest, "no tags selected")
+		}
+		if action == "rename" && to == "" {
+			return "", httpError(http.StatusBadRequest, "missing new tag name")
+		}
+		if action == "delete" {
+			to = ""
+		}
+
+		var tasks []*taskqueue.Task
+		for _, tag := range from {
+			if tag != to {
+				tasks = append(tasks, retagTask(tag, to, nil))
+			}
+		}
+		resp, err := addTasks(ctx, tasks)
+		if err != nil {
+			return "", err
+		}
+		if to == "" {
+			message = fmt.Sprintf("Deleting %q. %s", from, resp)
+		} else {
+			message = fmt.Sprintf("Replacing %q with %q. %s", from, to, resp)
+		}
+	default:
+		return "", fmt.Errorf("unknown tags action %q", action)
+	}
+
+	tags, err := fetchTagCounts(ctx, store)
+	if err != nil {
+		return "", err
+	}
+
+	return renderPage(ctx, "tags", &tagsData{Message: message, Tags: tags, CSRF: csrfToken(ctx)})
+}
+
+// Mailings of people having any of the tags, all of them without tags.
+func filterTagged(mailings []mailing, tags []string) []mailing {
+	if len(tags) == 0 {
+		return mailings
+	}
+	return slices.DeleteFunc(mailings, func(m mailing) bool {
+		return !slices.ContainsFunc(m.Person.Tags, func(tag string) bool { return slices.Contains(tags, tag) })
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"google.golang.org/appengine/v2"
+)
+
+// Trusted App Engine headers, which are stripped from external requests.
+// https://cloud.google.com/appengine/docs/standard/scheduling-jobs-with-cron-yaml#securing_urls_for_cron
+// https://cloud.google.com/tasks/docs/creating-appengine-handlers#reading_request_headers
+func isCronOrTaskQueue(r *http.Request) bool {
+	return r.Header.Get("X-Appengine-Cron") == "true" || r.Header.Get("X-AppEngine-QueueName") != ""
+}
+
+// Describes who triggered a task request, and whether they may run it:
+// cron, the task queue, or an admin running it manually.
+func taskCaller(r *http.Request) (string, bool) {
+	if r.Header.Get("X-Appengine-Cron") == "true" {
+		return "cron", true
+	}
+	if queue := r.Header.Get("X-AppEngine-QueueName"); queue != "" {
+		return fmt.Sprintf("task queue %s (task %s, retry %s)", queue, r.Header.Get("X-AppEngine-TaskName"), r.Header.Get("X-AppEngine-TaskRetryCount")), true
+	}
+
+	ctx := appengine.NewContext(r)
+	u := currentUser(ctx)
+	if u == nil {
+		return "anonymous", isDev()
+	}
+	return u.Email, isAdmin(ctx)
+}
+
+// Middleware for `/task/` endpoints, which only cron, the task queue and admins may run.
+func taskAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := taskCaller(r)
+		if !ok {
+			log.Printf("Refused %s %s from %s", r.Method, r.URL.Path, caller)
+			http.Error(w, fmt.Sprintf("forbidden task %q", r.URL.Path), http.StatusForbidden)
+			return
+		}
+
+		log.Printf("Running %s %s for %s", r.Method, r.URL.Path, caller)
+		next.ServeHTTP(w, r)
+	})
+}
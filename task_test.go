@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine/v2/user"
+)
+
+func TestTaskAuth(t *testing.T) {
+	// Outside of dev, where everyone is an admin.
+	t.Setenv(GAE_APPLICATION, "s~pda-test")
+	admin := ADMINS_FREDSA[0]
+	t.Cleanup(func() { currentUser = user.Current })
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		email   string
+		csrf    string // Form token, of the "token" session.
+		want    int
+	}{
+		{"cron", "GET", map[string]string{"X-Appengine-Cron": "true"}, "", "", http.StatusOK},
+		{"task queue", "POST", map[string]string{"X-AppEngine-QueueName": "default"}, "", "", http.StatusOK},
+		{"admin with csrf token", "POST", nil, admin, "token", http.StatusOK},
+		{"admin without csrf token", "POST", nil, admin, "", http.StatusForbidden},
+		{"admin with another csrf token", "POST", nil, admin, "other", http.StatusForbidden},
+		{"admin GET", "GET", nil, admin, "", http.StatusMethodNotAllowed},
+		{"someone else", "POST", nil, "someone@example.com", "token", http.StatusForbidden},
+		{"anonymous", "POST", nil, "", "token", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		ran := false
+		handler := taskAuth(csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ran = true
+		})))
+
+		form := url.Values{}
+		if test.csrf != "" {
+			form.Set(CSRF_FIELD, test.csrf)
+		}
+		r := httptest.NewRequest(test.method, "/task/notify", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: CSRF_COOKIE, Value: "token"})
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		currentUser = func(ctx context.Context) *user.User {
+			if test.email == "" {
+				return nil
+			}
+			return &user.User{Email: test.email}
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.want || ran != (test.want == http.StatusOK) {
+			t.Errorf("%s: status %d, ran %v, want %d", test.name, w.Code, ran, test.want)
+		}
+	}
+}
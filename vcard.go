@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// A Person with its enabled children, as one vCard 3.0.
+// https://datatracker.ietf.org/doc/html/rfc2426
+type card struct {
+	Person   *Person
+	Children []model // Contacts and Addresses, in key order.
+}
+
+// Contact types that have a vCard property. Others are left alone by a PUT.
+var vcardContactTypes = []string{"Email", "Voice", "Mobile", "Facsimile", "URL"}
+
+// Text escaping, the same for iCalendar.
+func vcardEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`).Replace(strings.ReplaceAll(s, "\r\n", "\n"))
+}
+
+func vcardUnescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' || s[i] == 'N' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Splits a structured value on unescaped `;`, unescaping each component.
+func vcardComponents(value string) []string {
+	var components []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' {
+			i++
+		} else if value[i] == ';' {
+			components = append(components, vcardUnescape(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(components, vcardUnescape(value[start:]))
+}
+
+func vcardMethodType(method string) string {
+	switch method {
+	case "Business":
+		return "WORK"
+	case "Personal":
+		return "HOME"
+	}
+	return ""
+}
+
+func (c *card) vcard() string {
+	var lines []string
+	add := func(name string, types []string, value string) {
+		var t []string
+		for _, s := range types {
+			if s != "" {
+				t = append(t, s)
+			}
+		}
+		if len(t) > 0 {
+			name += ";TYPE=" + strings.Join(t, ",")
+		}
+		lines = append(lines, name+":"+value)
+	}
+
+	p := c.Person
+	add("BEGIN", nil, "VCARD")
+	add("VERSION", nil, "3.0")
+	add("UID", nil, vcardEscape(p.Key.Encode()))
+	fn := strings.TrimSpace(strings.Join(removeEmtpy([]string{p.Title, p.FirstName, p.LastName}), " "))
+	if fn == "" {
+		fn = p.CompanyName
+	}
+	add("FN", nil, vcardEscape(fn))
+	add("N", nil, strings.Join([]string{vcardEscape(p.LastName), vcardEscape(p.FirstName), "", vcardEscape(p.Title), ""}, ";"))
+	if p.CompanyName != "" {
+		add("ORG", nil, vcardEscape(p.CompanyName))
+	}
+	if p.Comments != "" {
+		add("NOTE", nil, vcardEscape(p.Comments))
+	}
+	if p.Category != "" && p.Category != defaultChoices["Category"][0] {
+		add("CATEGORIES", nil, vcardEscape(p.Category))
+	}
+	if p.MailingName != "" {
+		add("X-PDA-MAILING-NAME", nil, vcardEscape(p.MailingName))
+	}
+	add("X-PDA-SEND-CARD", nil, fmt.Sprintf("%v", p.SendCard))
+
+	for _, m := range c.Children {
+		switch child := m.(type) {
+		case *Contact:
+			method := vcardMethodType(child.ContactMethod)
+			text := vcardEscape(child.ContactText)
+			switch child.ContactType {
+			case "Email":
+				add("EMAIL", []string{"INTERNET", method}, text)
+			case "Voice":
+				add("TEL", []string{"VOICE", method}, text)
+			case "Mobile":
+				add("TEL", []string{"CELL", method}, text)
+			case "Facsimile":
+				add("TEL", []string{"FAX", method}, text)
+			case "URL":
+				add("URL", []string{method}, text)
+			}
+		case *Address:
+			t := ""
+			switch child.AddressType {
+			case "Home":
+				t = "HOME"
+			case "Business":
+				t = "WORK"
+			}
+			street := strings.Join(removeEmtpy([]string{child.AddressLine1, child.AddressLine2}), "\n")
+			add("ADR", []string{t}, strings.Join([]string{"", "", vcardEscape(street), vcardEscape(child.City), vcardEscape(child.StateProvince), vcardEscape(child.PostalCode), vcardEscape(child.Country)}, ";"))
+		}
+	}
+	add("END", nil, "VCARD")
+	return foldLines(lines)
+}
+
+// Joins content lines with CRLF, folding those longer than 75 octets without
+// splitting UTF-8 sequences, as vCard and iCalendar require.
+func foldLines(lines []string) string {
+	var b strings.Builder
+	for _, line := range lines {
+		// Continuation lines count their leading space.
+		limit := 75
+		for len(line) > limit {
+			n := limit
+			for n > 0 && line[n]&0xC0 == 0x80 {
+				n--
+			}
+			b.WriteString(line[:n] + "\r\n ")
+			line = line[n:]
+			limit = 74
+		}
+		b.WriteString(line + "\r\n")
+	}
+	return b.String()
+}
+
+func (c *card) etag() string {
+	sum := sha1.Sum([]byte(c.vcard()))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+type vcardProperty struct {
+	Name  string
+	Types []string // Uppercase TYPE parameters.
+	Value string   // Still escaped.
+}
+
+func (p *vcardProperty) hasType(t string) bool {
+	return slices.Contains(p.Types, t)
+}
+
+func parseVCard(text string) ([]vcardProperty, error) {
+	// Unfold continuation lines.
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read vCard: %v", err)
+	}
+
+	var props []vcardProperty
+	for _, line := range lines {
+		head, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid vCard line %q", line)
+		}
+		params := strings.Split(head, ";")
+		name := strings.ToUpper(params[0])
+		// Drop the group of grouped properties like `item1.EMAIL`.
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[i+1:]
+		}
+		p := vcardProperty{Name: name, Value: value}
+		for _, param := range params[1:] {
+			k, v, ok := strings.Cut(param, "=")
+			if !ok {
+				// vCard 2.1 bare type, e.g. `TEL;CELL:`.
+				v = k
+			} else if strings.ToUpper(k) != "TYPE" {
+				continue
+			}
+			for _, t := range strings.Split(strings.Trim(v, `"`), ",") {
+				p.Types = append(p.Types, strings.ToUpper(t))
+			}
+		}
+		props = append(props, p)
+	}
+
+	if len(props) < 2 || props[0].Name != "BEGIN" || props[len(props)-1].Name != "END" {
+		return nil, fmt.Errorf("not a vCard")
+	}
+	return props, nil
+}
+
+func vcardMethod(p *vcardProperty) string {
+	switch {
+	case p.hasType("WORK"):
+		return "Business"
+	case p.hasType("HOME"):
+		return "Personal"
+	}
+	return ""
+}
+
+// Updates the Person from the vCard. Its Contacts and Addresses are matched by
+// text and enabled, the ones missing from the vCard are disabled, and new ones
+// get incomplete keys. Contact types without a vCard property are left alone.
+// CATEGORIES only sets one of the `categories`.
+func (c *card) update(props []vcardProperty, categories []string) {
+	p := c.Person
+	p.Enabled = true
+	p.FirstName, p.LastName, p.Title, p.CompanyName, p.Comments = "", "", "", "", ""
+	fn := ""
+
+	var contacts []*Contact
+	var addresses []*Address
+	for i := range props {
+		prop := &props[i]
+		switch prop.Name {
+		case "N":
+			n := vcardComponents(prop.Value)
+			for len(n) < 5 {
+				n = append(n, "")
+			}
+			p.LastName = n[0]
+			p.FirstName = strings.TrimSpace(n[1] + " " + n[2])
+			p.Title = n[3]
+		case "FN":
+			fn = vcardUnescape(prop.Value)
+		case "ORG":
+			p.CompanyName = vcardComponents(prop.Value)[0]
+		case "NOTE":
+			p.Comments = vcardUnescape(prop.Value)
+		case "CATEGORIES":
+			for _, category := range strings.Split(prop.Value, ",") {
+				category = vcardUnescape(category)
+				if i := slices.IndexFunc(categories, func(c string) bool { return strings.EqualFold(c, category) }); i >= 0 {
+					p.Category = categories[i]
+				}
+			}
+		case "X-PDA-MAILING-NAME":
+			p.MailingName = vcardUnescape(prop.Value)
+		case "X-PDA-SEND-CARD":
+			p.SendCard = strings.EqualFold(prop.Value, "true")
+		case "EMAIL", "TEL", "URL":
+			contact := &Contact{ContactText: vcardUnescape(prop.Value), ContactMethod: vcardMethod(prop), Common: Common{Enabled: true}}
+			switch {
+			case prop.Name == "EMAIL":
+				contact.ContactType = "Email"
+			case prop.Name == "URL":
+				contact.ContactType = "URL"
+			case prop.hasType("CELL"):
+				contact.ContactType = "Mobile"
+			case prop.hasType("FAX"):
+				contact.ContactType = "Facsimile"
+			default:
+				contact.ContactType = "Voice"
+			}
+			contacts = append(contacts, contact)
+		case "ADR":
+			adr := vcardComponents(prop.Value)
+			for len(adr) < 7 {
+				adr = append(adr, "")
+			}
+			street := strings.SplitN(strings.TrimSpace(strings.Join(removeEmtpy(adr[:3]), "\n")), "\n", 2)
+			address := &Address{AddressLine1: street[0], City: adr[3], StateProvince: adr[4], PostalCode: adr[5], Country: adr[6], Common: Common{Enabled: true}}
+			if len(street) > 1 {
+				address.AddressLine2 = strings.ReplaceAll(street[1], "\n", ", ")
+			}
+			switch {
+			case prop.hasType("HOME"):
+				address.AddressType = "Home"
+			case prop.hasType("WORK"):
+				address.AddressType = "Business"
+			}
+			addresses = append(addresses, address)
+		}
+	}
+	if p.FirstName == "" && p.LastName == "" && p.CompanyName == "" {
+		if i := strings.LastIndex(fn, " "); i >= 0 {
+			p.FirstName, p.LastName = fn[:i], fn[i+1:]
+		} else {
+			p.LastName = fn
+		}
+	}
+
+	var children []model
+	for _, m := range c.Children {
+		matched := false
+		switch child := m.(type) {
+		case *Contact:
+			if !slices.Contains(vcardContactTypes, child.ContactType) {
+				children = append(children, child)
+				continue
+			}
+			i := slices.IndexFunc(contacts, func(e *Contact) bool { return strings.EqualFold(e.ContactText, child.ContactText) })
+			if i >= 0 {
+				match := contacts[i]
+				contacts = slices.Delete(contacts, i, i+1)
+				child.ContactType, child.ContactMethod = match.ContactType, match.ContactMethod
+				matched = true
+			}
+		case *Address:
+			i := slices.IndexFunc(addresses, func(e *Address) bool {
+				return strings.EqualFold(e.AddressLine1, child.AddressLine1) && strings.EqualFold(e.City, child.City)
+			})
+			if i >= 0 {
+				match := addresses[i]
+				addresses = slices.Delete(addresses, i, i+1)
+				// Only what a vCard carries, keeping comments, custom
+				// values and the location.
+				child.AddressType = match.AddressType
+				child.AddressLine1, child.AddressLine2 = match.AddressLine1, match.AddressLine2
+				child.City, child.StateProvince = match.City, match.StateProvince
+				child.PostalCode, child.Country = match.PostalCode, match.Country
+				matched = true
+			}
+		default:
+			children = append(children, m)
+			continue
+		}
+		m.common().Enabled = matched
+		children = append(children, m)
+	}
+	for _, contact := range contacts {
+		contact.Key = datastore.IncompleteKey("Contact", p.Key)
+		children = append(children, contact)
+	}
+	for _, address := range addresses {
+		address.Key = datastore.IncompleteKey("Address", p.Key)
+		children = append(children, address)
+	}
+	c.Children = children
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestVCardRoundTrip(t *testing.T) {
+	personKey := datastore.IDKey("Person", 1, nil)
+	person := &Person{
+		Key:         personKey,
+		Title:       "Dr.",
+		FirstName:   "Jane; Ann",
+		LastName:    `Doe, Jr. \ Sr.`,
+		CompanyName: "Doe; Ray, Partners",
+		Category:    "Relatives",
+		MailingName: "The Does",
+		SendCard:    true,
+		Common:      Common{Enabled: true, Comments: "First line\nSecond line, with a comma; and a semicolon. " + strings.Repeat("Überlänge ", 12)},
+	}
+	address := &Address{
+		Key:           datastore.IDKey("Address", 2, personKey),
+		AddressType:   "Home",
+		AddressLine1:  "1 Main St",
+		AddressLine2:  "Apt 2; Back",
+		City:          "Springfield",
+		StateProvince: "IL",
+		PostalCode:    "62701",
+		Country:       "United States",
+		Common:        Common{Enabled: true},
+	}
+	email := &Contact{Key: datastore.IDKey("Contact", 3, personKey), ContactType: "Email", ContactMethod: "Business", ContactText: "jane@example.com", Common: Common{Enabled: true}}
+	mobile := &Contact{Key: datastore.IDKey("Contact", 4, personKey), ContactType: "Mobile", ContactText: "+1 555 010 2030", Common: Common{Enabled: true}}
+	original := &card{Person: person, Children: []model{address, email, mobile}}
+
+	text := original.vcard()
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line of %d octets, want folding past 75: %q", len(line), line)
+		}
+		if !utf8.ValidString(line) {
+			t.Errorf("folding split a UTF-8 sequence: %q", line)
+		}
+	}
+	for _, want := range []string{`N:Doe\, Jr. \\ Sr.;Jane\; Ann;;Dr.;`, `ORG:Doe\; Ray\, Partners`, "ADR;TYPE=HOME:;;1 Main St\\nApt 2\\; Back;Springfield;IL;62701;United States"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("vCard lacks %q:\n%s", want, text)
+		}
+	}
+
+	props, err := parseVCard(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := &card{Person: &Person{Key: personKey}}
+	parsed.update(props, defaultChoices["Category"])
+
+	p := parsed.Person
+	if p.Title != person.Title || p.FirstName != person.FirstName || p.LastName != person.LastName ||
+		p.CompanyName != person.CompanyName || p.Comments != person.Comments || p.Category != person.Category ||
+		p.MailingName != person.MailingName || p.SendCard != person.SendCard {
+		t.Errorf("round trip of person\n%+v\ngave\n%+v", person, p)
+	}
+	if len(parsed.Children) != 3 {
+		t.Fatalf("round trip gave %d children, want 3", len(parsed.Children))
+	}
+	var addresses []*Address
+	var contacts []*Contact
+	for _, m := range parsed.Children {
+		switch child := m.(type) {
+		case *Address:
+			addresses = append(addresses, child)
+		case *Contact:
+			contacts = append(contacts, child)
+		}
+	}
+	if len(addresses) != 1 {
+		t.Fatalf("round trip gave %d addresses, want 1", len(addresses))
+	}
+	a := addresses[0]
+	if a.AddressType != address.AddressType || a.AddressLine1 != address.AddressLine1 || a.AddressLine2 != address.AddressLine2 ||
+		a.City != address.City || a.StateProvince != address.StateProvince || a.PostalCode != address.PostalCode || a.Country != address.Country {
+		t.Errorf("round trip of address\n%+v\ngave\n%+v", address, a)
+	}
+	for i, want := range []*Contact{email, mobile} {
+		c := contacts[i]
+		if c.ContactType != want.ContactType || c.ContactMethod != want.ContactMethod || c.ContactText != want.ContactText {
+			t.Errorf("round trip of contact %+v gave %+v", want, c)
+		}
+	}
+
+	// The same card again, once stored.
+	stored := &card{Person: p, Children: []model{a, contacts[0], contacts[1]}}
+	a.Key, contacts[0].Key, contacts[1].Key = address.Key, email.Key, mobile.Key
+	if stored.vcard() != text {
+		t.Errorf("second round trip changed the vCard:\n%s\nwant\n%s", stored.vcard(), text)
+	}
+}
+
+func TestParseVCard(t *testing.T) {
+	text := "BEGIN:VCARD\r\nVERSION:2.1\r\nN:Doe;Jane\r\nTEL;CELL:+1 555\r\n 010 2030\r\nitem1.EMAIL;type=\"INTERNET,WORK\":jane@example.com\r\nEND:VCARD\r\n"
+	props, err := parseVCard(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tel, email := props[3], props[4]
+	if tel.Name != "TEL" || tel.Value != "+1 555010 2030" || !tel.hasType("CELL") {
+		t.Errorf("unfolded bare-typed property %+v", tel)
+	}
+	if email.Name != "EMAIL" || !email.hasType("INTERNET") || !email.hasType("WORK") {
+		t.Errorf("grouped property %+v", email)
+	}
+
+	for _, bad := range []string{"", "BEGIN:VCARD\r\n", "BEGIN:VCARD\r\nno colon\r\nEND:VCARD\r\n"} {
+		_, err = parseVCard(bad)
+		if err == nil {
+			t.Errorf("parsed invalid vCard %q", bad)
+		}
+	}
+}
+
+func TestVCardPutKeepsAddress(t *testing.T) {
+	t.Setenv(CARDDAV_USERNAME, "pda")
+	t.Setenv(CARDDAV_PASSWORD, "secret")
+	ctx := context.Background()
+	store := newMemoryStore()
+	handler := davAuth((&app{store: store}).dav())
+	personKey, err := saveModel(ctx, store, &Person{Key: datastore.IncompleteKey("Person", nil), FirstName: "Jane", LastName: "Doe", Common: Common{Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom := datastore.Property{Name: CUSTOM_PREFIX + "Gate code", Value: "1234", NoIndex: true}
+	addressKey, err := saveModel(ctx, store, &Address{
+		Key:          datastore.IncompleteKey("Address", personKey),
+		AddressType:  "Home",
+		AddressLine1: "1 Main St",
+		City:         "Springfield",
+		Location:     &datastore.GeoPoint{Lat: 39.8, Lng: -89.6},
+		Geocoded:     "1 Main St, Springfield",
+		GeocodedBy:   "stub",
+		Common:       Common{Enabled: true, Comments: "Ring twice", Custom: []datastore.Property{custom}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	href := cardHref(personKey)
+	w := davRequest(t, handler, "GET", href, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: status %d", w.Code)
+	}
+	r := httptest.NewRequest("PUT", href, strings.NewReader(w.Body.String()))
+	r.SetBasicAuth("pda", "secret")
+	r.Header.Set("If-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("PUT: status %d\n%s", w.Code, w.Body)
+	}
+
+	address := &Address{}
+	err = store.Get(ctx, addressKey, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.Comments != "Ring twice" || formatCustomValue(address.customValue("Gate code")) != "1234" ||
+		address.Location == nil || address.GeocodedBy != "stub" || !address.Enabled {
+		t.Errorf("address after PUT of the same card %+v, want its comments, custom values and location kept", address)
+	}
+}